@@ -0,0 +1,436 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Aggregate counts a user's events per event type, honouring the type, time
+// and payload filters
+func (es *EventStore) Aggregate(userID int64, filters QueryFilters) (map[string]int, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := filters.Validate(); err != nil {
+		return nil, &FilterError{Err: err}
+	}
+
+	where, args := buildWhereClause(userID, es.storeFilters(filters))
+	query := "SELECT event_type, COUNT(*) FROM events" + where + " GROUP BY event_type"
+
+	rows, err := es.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("aggregate query failed: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var eventType string
+		var count int
+		if err := rows.Scan(&eventType, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		counts[eventType] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+
+	return counts, nil
+}
+
+// TypeDelta compares one event type's count between two cohorts, A and B
+type TypeDelta struct {
+	EventType string   `json:"event_type"`
+	A         int      `json:"a"`
+	B         int      `json:"b"`
+	Delta     int      `json:"delta"`
+	Change    *float64 `json:"change_percent"` // nil when the type is new in B
+}
+
+// DiffTypeCounts compares two per-type counts, as returned by Aggregate.
+// Types present in either cohort are listed, largest change first, ties
+// broken by type.
+func DiffTypeCounts(a, b map[string]int) []TypeDelta {
+	types := make(map[string]bool)
+	for eventType := range a {
+		types[eventType] = true
+	}
+	for eventType := range b {
+		types[eventType] = true
+	}
+
+	deltas := make([]TypeDelta, 0, len(types))
+	for eventType := range types {
+		deltas = append(deltas, typeDelta(eventType, a[eventType], b[eventType]))
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		di, dj := abs(deltas[i].Delta), abs(deltas[j].Delta)
+		if di != dj {
+			return di > dj
+		}
+		return deltas[i].EventType < deltas[j].EventType
+	})
+	return deltas
+}
+
+// typeDelta builds the TypeDelta for counts a and b
+func typeDelta(eventType string, a, b int) TypeDelta {
+	delta := TypeDelta{EventType: eventType, A: a, B: b, Delta: b - a}
+	if a != 0 {
+		change := float64(b-a) / float64(a) * 100
+		delta.Change = &change
+	}
+	return delta
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// DistinctPayloadValues counts the distinct values a payload field takes
+// across all users, restricted by the event type and time filters. Events
+// without the field are ignored.
+func (es *EventStore) DistinctPayloadValues(field string, filters QueryFilters) (int, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	path, err := payloadPath(field)
+	if err != nil {
+		return 0, err
+	}
+
+	filters = es.storeFilters(filters)
+	where, args := payloadFieldWhere(path, filters)
+	query := "SELECT COUNT(DISTINCT json_extract(" + payloadJSONSQL(filters) + ", ?)) FROM events" + where
+
+	var count int
+	if err := es.db.QueryRow(query, append([]interface{}{path}, args...)...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("cardinality query failed: %v", err)
+	}
+	return count, nil
+}
+
+// EstimateDistinctPayloadValues approximates DistinctPayloadValues with a
+// HyperLogLog sketch computed over the streamed values. It uses constant
+// memory regardless of cardinality.
+func (es *EventStore) EstimateDistinctPayloadValues(field string, filters QueryFilters) (uint64, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	path, err := payloadPath(field)
+	if err != nil {
+		return 0, err
+	}
+
+	// quote() keeps 1 and "1" distinct, matching COUNT(DISTINCT)
+	filters = es.storeFilters(filters)
+	where, args := payloadFieldWhere(path, filters)
+	query := "SELECT quote(json_extract(" + payloadJSONSQL(filters) + ", ?)) FROM events" + where
+
+	rows, err := es.db.Query(query, append([]interface{}{path}, args...)...)
+	if err != nil {
+		return 0, fmt.Errorf("cardinality query failed: %v", err)
+	}
+	defer rows.Close()
+
+	sketch := newHyperLogLog()
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return 0, fmt.Errorf("failed to scan row: %v", err)
+		}
+		sketch.Add(value)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("rows iteration error: %v", err)
+	}
+
+	return sketch.Estimate(), nil
+}
+
+// payloadFieldWhere builds the WHERE clause selecting events that carry the
+// payload field and match the type and time filters
+func payloadFieldWhere(path string, filters QueryFilters) (string, []interface{}) {
+	where := " WHERE json_extract(" + payloadJSONSQL(filters) + ", ?) IS NOT NULL"
+	args := []interface{}{path}
+	return appendFilterConditions(where, args, filters)
+}
+
+// time bucket granularities accepted by Histogram
+const (
+	BucketMinute = "minute"
+	BucketHour   = "hour"
+	BucketDay    = "day"
+)
+
+// bucketFormats truncates a stored RFC3339 timestamp to the start of its
+// bucket with SQLite's strftime
+var bucketFormats = map[string]string{
+	BucketMinute: "%Y-%m-%dT%H:%M:00Z",
+	BucketHour:   "%Y-%m-%dT%H:00:00Z",
+	BucketDay:    "%Y-%m-%dT00:00:00Z",
+}
+
+// Bucket is the number of events in the time bucket starting at Start
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// Histogram counts matching events per minute, hour or day, oldest bucket
+// first. Buckets without events are omitted.
+func (es *EventStore) Histogram(userID int64, filters QueryFilters, bucket string) ([]Bucket, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	format, ok := bucketFormats[bucket]
+	if !ok {
+		return nil, fmt.Errorf("unknown bucket %q (expected minute, hour or day)", bucket)
+	}
+	if err := filters.Validate(); err != nil {
+		return nil, &FilterError{Err: err}
+	}
+
+	where, args := buildWhereClause(userID, es.storeFilters(filters))
+	query := "SELECT strftime(?, timestamp) AS bucket, COUNT(*) FROM events" + where + " GROUP BY bucket ORDER BY bucket"
+
+	rows, err := es.db.Query(query, append([]interface{}{format}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("histogram query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var buckets []Bucket
+	for rows.Next() {
+		var start string
+		var b Bucket
+		if err := rows.Scan(&start, &b.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		if b.Start, err = time.Parse(time.RFC3339, start); err != nil {
+			return nil, fmt.Errorf("failed to parse bucket: %v", err)
+		}
+		buckets = append(buckets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+
+	return buckets, nil
+}
+
+// UserCount is the number of matching events stored for a user
+type UserCount struct {
+	UserID int64 `json:"user_id"`
+	Events int   `json:"events"`
+}
+
+// TopUsers ranks users by their number of matching events, busiest first,
+// and returns the first n. Ties are broken by user ID.
+func (es *EventStore) TopUsers(filters QueryFilters, n int) ([]UserCount, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if n <= 0 {
+		return nil, fmt.Errorf("limit must be positive, got %d", n)
+	}
+	if err := filters.Validate(); err != nil {
+		return nil, &FilterError{Err: err}
+	}
+
+	filters.AllUsers = true
+	where, args := buildWhereClause(0, es.storeFilters(filters))
+	query := "SELECT user_id, COUNT(*) AS events FROM events" + where + " GROUP BY user_id ORDER BY events DESC, user_id LIMIT ?"
+
+	rows, err := es.db.Query(query, append(args, n)...)
+	if err != nil {
+		return nil, fmt.Errorf("top users query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var users []UserCount
+	for rows.Next() {
+		var user UserCount
+		if err := rows.Scan(&user.UserID, &user.Events); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+
+	return users, nil
+}
+
+// UserRange is the span of a user's stored events
+type UserRange struct {
+	UserID int64     `json:"user_id"`
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+	Events int       `json:"events"`
+}
+
+// UserActivityRange returns the timestamps of a user's first and last
+// events and the number of events. A user without events gets zero times
+// and a count of 0.
+func (es *EventStore) UserActivityRange(userID int64) (first, last time.Time, count int, err error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	var firstStr, lastStr sql.NullString
+	err = es.db.QueryRow("SELECT MIN(timestamp), MAX(timestamp), COUNT(*) FROM events WHERE user_id = ?", userID).Scan(&firstStr, &lastStr, &count)
+	if err != nil {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("user range query failed: %v", err)
+	}
+	if count == 0 {
+		return time.Time{}, time.Time{}, 0, nil
+	}
+	if first, err = time.Parse(time.RFC3339, firstStr.String); err != nil {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("failed to parse timestamp: %v", err)
+	}
+	if last, err = time.Parse(time.RFC3339, lastStr.String); err != nil {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("failed to parse timestamp: %v", err)
+	}
+	return first, last, count, nil
+}
+
+// UserActivityRanges returns the span of every user's events, ordered by
+// user ID. A non-positive limit returns every user.
+func (es *EventStore) UserActivityRanges(limit int) ([]UserRange, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	// Grouping walks idx_user_timestamp, so MIN and MAX come from the
+	// ends of each user's run of the index
+	query := "SELECT user_id, MIN(timestamp), MAX(timestamp), COUNT(*) FROM events GROUP BY user_id ORDER BY user_id"
+	var args []interface{}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := es.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("user range query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var ranges []UserRange
+	for rows.Next() {
+		var r UserRange
+		var first, last string
+		if err := rows.Scan(&r.UserID, &first, &last, &r.Events); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		if r.First, err = time.Parse(time.RFC3339, first); err != nil {
+			return nil, fmt.Errorf("failed to parse timestamp: %v", err)
+		}
+		if r.Last, err = time.Parse(time.RFC3339, last); err != nil {
+			return nil, fmt.Errorf("failed to parse timestamp: %v", err)
+		}
+		ranges = append(ranges, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+
+	return ranges, nil
+}
+
+// DuplicateGroup is a user, timestamp and event type stored more than once
+type DuplicateGroup struct {
+	UserID    int64     `json:"user_id"`
+	Timestamp time.Time `json:"timestamp"`
+	EventType string    `json:"event_type"`
+	Count     int       `json:"count"`
+}
+
+// FindDuplicates lists the groups of events sharing user, timestamp and
+// event type, largest group first, without modifying anything. Payloads are
+// not compared. A non-positive limit returns every group.
+func (es *EventStore) FindDuplicates(limit int) ([]DuplicateGroup, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	query := `
+		SELECT user_id, timestamp, event_type, COUNT(*) AS c
+		FROM events
+		GROUP BY user_id, timestamp, event_type
+		HAVING c > 1
+		ORDER BY c DESC, user_id, timestamp, event_type`
+	var args []interface{}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := es.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("duplicate query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var groups []DuplicateGroup
+	for rows.Next() {
+		var timestamp string
+		var group DuplicateGroup
+		if err := rows.Scan(&group.UserID, &timestamp, &group.EventType, &group.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		if group.Timestamp, err = time.Parse(time.RFC3339, timestamp); err != nil {
+			return nil, fmt.Errorf("failed to parse timestamp: %v", err)
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+
+	return groups, nil
+}
+
+// DistinctEventTypes lists the event types a user has, sorted by name
+func (es *EventStore) DistinctEventTypes(userID int64) ([]string, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	return es.distinctEventTypes(" WHERE user_id = ?", userID)
+}
+
+// AllDistinctEventTypes lists the event types across all users, sorted by
+// name
+func (es *EventStore) AllDistinctEventTypes() ([]string, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	return es.distinctEventTypes("")
+}
+
+func (es *EventStore) distinctEventTypes(where string, args ...interface{}) ([]string, error) {
+	rows, err := es.db.Query("SELECT DISTINCT event_type FROM events"+where+" ORDER BY event_type", args...)
+	if err != nil {
+		return nil, fmt.Errorf("event type query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var types []string
+	for rows.Next() {
+		var eventType string
+		if err := rows.Scan(&eventType); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		types = append(types, eventType)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return types, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BenchOptions configures Bench
+type BenchOptions struct {
+	Events int   // synthetic events to record
+	Seed   int64 // generator seed; the same seed records the same events
+	Runs   int   // times each query is run; the median latency is reported
+
+	Config StoreConfig
+	Record RecordOptions
+}
+
+// BenchResult is the outcome of Bench
+type BenchResult struct {
+	Events       int           `json:"events"`
+	RecordTime   time.Duration `json:"record_time_ns"`
+	EventsPerSec float64       `json:"events_per_sec"`
+	Queries      []BenchQuery  `json:"queries"`
+}
+
+// BenchQuery is the median latency of one representative query
+type BenchQuery struct {
+	Name    string        `json:"name"`
+	Latency time.Duration `json:"latency_ns"`
+}
+
+// Bench records synthetic events into a fresh database in a temporary
+// directory and times representative queries against it. The directory is
+// removed afterwards.
+func Bench(opts BenchOptions) (*BenchResult, error) {
+	if opts.Events < 1 {
+		return nil, fmt.Errorf("events must be at least 1, got %d", opts.Events)
+	}
+	if opts.Runs < 1 {
+		return nil, fmt.Errorf("runs must be at least 1, got %d", opts.Runs)
+	}
+
+	dir, err := os.MkdirTemp("", "eventlog-bench-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Generating up front keeps the generator out of the recorded time
+	input := filepath.Join(dir, "events.txt")
+	if err := writeBenchEvents(input, opts.Events, opts.Seed); err != nil {
+		return nil, err
+	}
+
+	store, err := NewEventStoreWithConfig(filepath.Join(dir, "bench.db"), opts.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	start := time.Now()
+	recorded, _, err := store.Record(input, opts.Record)
+	if err != nil {
+		return nil, err
+	}
+	result := &BenchResult{Events: recorded, RecordTime: time.Since(start)}
+	result.EventsPerSec = float64(recorded) / result.RecordTime.Seconds()
+
+	// User 42 is among the generator's heavy users (0-1999)
+	day := time.Date(2023, 8, 14, 10, 0, 0, 0, time.UTC)
+	hour := QueryFilters{AllUsers: true, From: day.Add(2 * time.Hour), To: day.Add(3 * time.Hour)}
+	queries := []struct {
+		name string
+		run  func() error
+	}{
+		{"query user", func() error {
+			_, err := store.Query(42, QueryFilters{}, OutputOptions{}, io.Discard)
+			return err
+		}},
+		{"query user by type", func() error {
+			_, err := store.Query(42, QueryFilters{EventTypes: []string{"login"}}, OutputOptions{}, io.Discard)
+			return err
+		}},
+		{"query user by time", func() error {
+			_, err := store.Query(42, QueryFilters{From: day, To: day.Add(6 * time.Hour)}, OutputOptions{}, io.Discard)
+			return err
+		}},
+		{"query all users, 1 hour", func() error {
+			_, err := store.Query(0, hour, OutputOptions{}, io.Discard)
+			return err
+		}},
+		{"count errors, 1 hour", func() error {
+			filters := hour
+			filters.EventTypes = []string{"error"}
+			_, err := store.Count(0, filters)
+			return err
+		}},
+		{"payload filter", func() error {
+			filters := QueryFilters{EventTypes: []string{"purchase"}}
+			filters.PayloadConditions = []PayloadCondition{{Field: "price", Op: ">", Value: 50.0}}
+			_, err := store.Query(42, filters, OutputOptions{}, io.Discard)
+			return err
+		}},
+		{"aggregate user", func() error {
+			_, err := store.Aggregate(42, QueryFilters{})
+			return err
+		}},
+		{"top users", func() error {
+			_, err := store.TopUsers(QueryFilters{}, 10)
+			return err
+		}},
+		{"stats", func() error {
+			_, err := store.GetStats()
+			return err
+		}},
+		// A real file, unlike io.Discard, shows the cost of a write
+		// system call per event
+		{"dump user to file, unbuffered", func() error {
+			return benchDump(store, filepath.Join(dir, "dump.txt"), 1)
+		}},
+		{"dump user to file, buffered", func() error {
+			return benchDump(store, filepath.Join(dir, "dump.txt"), DefaultOutputBufferSize)
+		}},
+	}
+
+	for _, query := range queries {
+		latencies := make([]time.Duration, opts.Runs)
+		for i := range latencies {
+			start := time.Now()
+			if err := query.run(); err != nil {
+				return nil, fmt.Errorf("%s: %v", query.name, err)
+			}
+			latencies[i] = time.Since(start)
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		result.Queries = append(result.Queries, BenchQuery{Name: query.name, Latency: latencies[len(latencies)/2]})
+	}
+
+	return result, nil
+}
+
+// benchDump writes user 42's events to path with the given output buffer size
+func benchDump(store *EventStore, path string, bufferSize int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	defer file.Close()
+	_, err = store.Query(42, QueryFilters{}, OutputOptions{BufferSize: bufferSize}, file)
+	return err
+}
+
+// writeBenchEvents writes n synthetic events to filename. The distribution
+// mirrors data/generate_test_data.go, which is a separate program and cannot
+// be imported: a day of events, 80% of them from 20% of 10,000 users, with
+// weighted event types and type-specific payloads.
+func writeBenchEvents(filename string, n int, seed int64) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create benchmark input: %v", err)
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+
+	rng := rand.New(rand.NewSource(seed))
+	eventTypes := []string{"login", "purchase", "logout", "page_view", "search", "download", "signup", "error"}
+	weights := []int{15, 10, 12, 30, 20, 5, 3, 5}
+	ips := []string{"192.168.1.1", "10.0.0.1", "172.16.0.1", "203.0.113.1", "198.51.100.1"}
+	items := []string{"A123", "B456", "C789", "D012", "E345", "F678", "G901", "H234"}
+	locations := []string{"US", "UK", "CA", "AU", "DE", "FR", "JP", "IN"}
+	devices := []string{"mobile", "desktop", "tablet", "smart-tv"}
+	pages := []string{"/home", "/products", "/cart", "/checkout", "/profile", "/search", "/help"}
+	pick := func(values []string) string { return values[rng.Intn(len(values))] }
+
+	const userCount = 10000
+	baseTime := time.Date(2023, 8, 14, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		timestamp := baseTime.Add(time.Duration(rng.Intn(24*60)) * time.Minute)
+		var userID int
+		if rng.Float64() < 0.8 {
+			userID = rng.Intn(userCount / 5)
+		} else {
+			userID = userCount/5 + rng.Intn(userCount*4/5)
+		}
+
+		r := rng.Intn(100) // the weights add up to 100
+		eventType := eventTypes[0]
+		for j, weight := range weights {
+			if r < weight {
+				eventType = eventTypes[j]
+				break
+			}
+			r -= weight
+		}
+
+		var payload map[string]interface{}
+		switch eventType {
+		case "login":
+			payload = map[string]interface{}{"ip": pick(ips), "device": pick(devices)}
+		case "purchase":
+			payload = map[string]interface{}{"item": pick(items), "price": float64(rng.Intn(10000)) / 100}
+		case "logout":
+			payload = map[string]interface{}{"duration": rng.Intn(3600)}
+		case "page_view":
+			payload = map[string]interface{}{"page": pick(pages), "device": pick(devices)}
+		case "search":
+			payload = map[string]interface{}{"page": "/search"}
+		case "download":
+			payload = map[string]interface{}{"item": pick(items)}
+		case "signup":
+			payload = map[string]interface{}{"ip": pick(ips), "location": pick(locations)}
+		case "error":
+			payload = map[string]interface{}{"status": fmt.Sprint(400 + rng.Intn(200)), "page": pick(pages)}
+		}
+		encoded, _ := json.Marshal(payload)
+
+		fmt.Fprintf(writer, "%s | %d | %s | %s\n", timestamp.Format(time.RFC3339), userID, eventType, encoded)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write benchmark input: %v", err)
+	}
+	return nil
+}
+
+// formatBenchResult renders a BenchResult as an aligned text report
+func formatBenchResult(result *BenchResult) string {
+	var report strings.Builder
+	fmt.Fprintf(&report, "Recorded %d events in %v (%.0f events/sec)\n\n", result.Events, result.RecordTime.Round(time.Millisecond), result.EventsPerSec)
+	fmt.Fprintf(&report, "%-32s %12s\n", "query", "latency")
+	for _, query := range result.Queries {
+		fmt.Fprintf(&report, "%-32s %12v\n", query.Name, query.Latency.Round(time.Microsecond))
+	}
+	return report.String()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixtureSeed makes every fixture hold the same events from run to run
+const fixtureSeed = 1
+
+// fixtures caches the stores built by fixtureStore by event count, since
+// generating and recording them dominates a short benchmark
+var (
+	fixturesMu sync.Mutex
+	fixtures   = make(map[int]*EventStore)
+)
+
+// fixtureStore returns an in-memory store holding n events from the
+// deterministic generator behind the bench command. Stores are shared
+// between benchmarks and must not be written to.
+func fixtureStore(tb testing.TB, n int) *EventStore {
+	tb.Helper()
+	fixturesMu.Lock()
+	defer fixturesMu.Unlock()
+	if store, ok := fixtures[n]; ok {
+		return store
+	}
+
+	input := filepath.Join(tb.TempDir(), "events.txt")
+	if err := writeBenchEvents(input, n, fixtureSeed); err != nil {
+		tb.Fatalf("writeBenchEvents: %v", err)
+	}
+	store, err := NewEventStore(MemoryDBPath)
+	if err != nil {
+		tb.Fatalf("NewEventStore: %v", err)
+	}
+	if recorded, _, err := store.Record(input, RecordOptions{}); err != nil || recorded != n {
+		store.Close()
+		tb.Fatalf("Record: recorded %d of %d events: %v", recorded, n, err)
+	}
+	fixtures[n] = store
+	return store
+}
+
+// BenchmarkQueryUserType times the common query shapes against a fixed
+// dataset. User 42 is one of the generator's heavy users.
+func BenchmarkQueryUserType(b *testing.B) {
+	store := fixtureStore(b, 100000)
+	day := time.Date(2023, 8, 14, 10, 0, 0, 0, time.UTC)
+
+	shapes := []struct {
+		name    string
+		userID  int64
+		filters QueryFilters
+	}{
+		{"user", 42, QueryFilters{}},
+		{"user+type", 42, QueryFilters{EventTypes: []string{"login"}}},
+		{"user+time", 42, QueryFilters{From: day, To: day.Add(6 * time.Hour)}},
+		{"all-users+time", 0, QueryFilters{AllUsers: true, From: day.Add(2 * time.Hour), To: day.Add(3 * time.Hour)}},
+	}
+	for _, shape := range shapes {
+		b.Run(shape.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := store.Query(shape.userID, shape.filters, OutputOptions{}, io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRecordWorkers records the same generated file with one parsing
+// worker, with four and with one per CPU, showing what parallel parsing
+// gains. Run with -benchtime=1x for a single pass over the file.
+func BenchmarkRecordWorkers(b *testing.B) {
+	const events = 200000
+	input := filepath.Join(b.TempDir(), "events.txt")
+	if err := writeBenchEvents(input, events, fixtureSeed); err != nil {
+		b.Fatalf("writeBenchEvents: %v", err)
+	}
+
+	counts := []int{1, 4}
+	if runtime.NumCPU() > 4 {
+		counts = append(counts, runtime.NumCPU())
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				store, err := NewEventStore(MemoryDBPath)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				recorded, _, err := store.Record(input, RecordOptions{Workers: workers})
+				if err != nil || recorded != events {
+					b.Fatalf("Record: recorded %d of %d events: %v", recorded, events, err)
+				}
+
+				b.StopTimer()
+				store.Close()
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(events)*float64(b.N)/b.Elapsed().Seconds(), "events/s")
+		})
+	}
+}
+
+// BenchmarkQueryOutputBuffer dumps an hour of every user's events, about
+// 4,000 lines, to a file with output buffering effectively off and at the
+// default size. A real file,
+// unlike io.Discard, pays for a write system call per flush.
+func BenchmarkQueryOutputBuffer(b *testing.B) {
+	store := fixtureStore(b, 100000)
+	path := filepath.Join(b.TempDir(), "dump.txt")
+	day := time.Date(2023, 8, 14, 10, 0, 0, 0, time.UTC)
+	hour := QueryFilters{AllUsers: true, From: day.Add(2 * time.Hour), To: day.Add(3 * time.Hour)}
+
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"unbuffered", 1},
+		{"buffered", DefaultOutputBufferSize},
+	}
+	for _, size := range sizes {
+		b.Run(size.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				file, err := os.Create(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = store.Query(0, hour, OutputOptions{BufferSize: size.size}, file)
+				file.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// expectedSchema lists the tables and indexes every migrated database has,
+// by sqlite_master type and name
+var expectedSchema = []struct{ kind, name string }{
+	{"table", "events"},
+	{"table", "settings"},
+	{"index", "idx_user_timestamp"},
+	{"index", "idx_user_type_timestamp"},
+	{"index", "idx_type_timestamp"},
+}
+
+// IntegrityCheck runs SQLite's integrity and foreign key checks and checks
+// that the expected table and indexes exist. It reports whether the
+// database is healthy and, if not, the problems found, one per entry.
+func (es *EventStore) IntegrityCheck() (bool, []string, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	var issues []string
+
+	// integrity_check reports a single "ok" row when it finds nothing. Damage
+	// bad enough to stop the check itself is a finding too.
+	rows, err := es.db.Query("PRAGMA integrity_check")
+	if isCorrupt(err) {
+		return false, []string{err.Error()}, nil
+	}
+	if err != nil {
+		return false, nil, &StoreError{Op: "run integrity check", Err: err}
+	}
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			rows.Close()
+			return false, nil, &StoreError{Op: "read integrity check", Err: err}
+		}
+		if message != "ok" {
+			issues = append(issues, message)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); isCorrupt(err) {
+		return false, append(issues, err.Error()), nil
+	} else if err != nil {
+		return false, nil, &StoreError{Op: "read integrity check", Err: err}
+	}
+
+	rows, err = es.db.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return false, nil, &StoreError{Op: "run foreign key check", Err: err}
+	}
+	for rows.Next() {
+		var table, parent string
+		var rowID, foreignKey *int64 // rowid is NULL for WITHOUT ROWID tables
+		if err := rows.Scan(&table, &rowID, &parent, &foreignKey); err != nil {
+			rows.Close()
+			return false, nil, &StoreError{Op: "read foreign key check", Err: err}
+		}
+		row := "?"
+		if rowID != nil {
+			row = fmt.Sprint(*rowID)
+		}
+		issues = append(issues, fmt.Sprintf("row %s of %s references a missing row of %s", row, table, parent))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, nil, &StoreError{Op: "read foreign key check", Err: err}
+	}
+
+	present := make(map[string]string)
+	rows, err = es.db.Query("SELECT name, type FROM sqlite_master WHERE type IN ('table', 'index')")
+	if err != nil {
+		return false, nil, &StoreError{Op: "read schema", Err: err}
+	}
+	for rows.Next() {
+		var name, kind string
+		if err := rows.Scan(&name, &kind); err != nil {
+			rows.Close()
+			return false, nil, &StoreError{Op: "read schema", Err: err}
+		}
+		present[name] = kind
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, nil, &StoreError{Op: "read schema", Err: err}
+	}
+	var missing []string
+	for _, object := range expectedSchema {
+		if present[object.name] != object.kind {
+			missing = append(missing, fmt.Sprintf("%s %s is missing", object.kind, object.name))
+		}
+	}
+
+	issues = append(issues, missing...)
+	return len(issues) == 0, issues, nil
+}
+
+// isCorrupt reports whether err is SQLite finding the database file damaged
+func isCorrupt(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrCorrupt || sqliteErr.Code == sqlite3.ErrNotADB)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"database/sql"
+	"fmt"
+	"io"
+	"sync"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Compressed payloads are stored as BLOBs in the payload column, which
+// SQLite's dynamic typing allows next to the TEXT of uncompressed rows, so
+// no migration is needed and both kinds can be mixed in one database. The
+// first byte of a compressed payload names its format. Only a BLOB is ever
+// compressed: raw payloads recorded without JSON validation are TEXT that
+// may start with any byte.
+//
+// gzip is not used: its header and trailer make the typical 40-60 byte
+// payload larger, not smaller. Raw DEFLATE primed with a dictionary of
+// common keys and values compresses even short payloads.
+const payloadFormatDeflate = 0x01
+
+// payloadDictionary primes DEFLATE for payloadFormatDeflate. Stored payloads
+// depend on it byte for byte, so it must never change; add a new format
+// instead.
+var payloadDictionary = []byte(`{"ip":"192.168.1.1","device":"mobile","item":"A123","price":,"location":"US","status":"","duration":,"page":"/home"}`)
+
+// driverName is the SQLite driver with the payload_text function that SQL
+// uses to read compressed payloads, and normalize_type applying
+// normalizeEventType
+const driverName = "sqlite3_eventlog"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			err := conn.RegisterFunc("payload_text", func(blob []byte) (string, error) {
+				payload, err := decompressPayload(blob)
+				return string(payload), err
+			}, true)
+			if err != nil {
+				return err
+			}
+			return conn.RegisterFunc("normalize_type", normalizeEventType, true)
+		},
+	})
+}
+
+// payloadSQL reads the payload column as JSON text in SQL, decompressing
+// BLOBs. Text rows never call into Go.
+const payloadSQL = "(CASE WHEN typeof(payload) = 'blob' THEN payload_text(payload) ELSE payload END)"
+
+// validPayloadSQL is payloadSQL reading payloads that are not JSON as NULL,
+// which the JSON functions would otherwise fail on
+const validPayloadSQL = "(CASE WHEN json_valid(" + payloadSQL + ") THEN " + payloadSQL + " END)"
+
+// payloadJSONSQL returns the payload expression for SQL JSON functions under
+// filters: validPayloadSQL if the store may hold payloads that are not JSON,
+// else the cheaper payloadSQL
+func payloadJSONSQL(filters QueryFilters) string {
+	if filters.rawPayloads {
+		return validPayloadSQL
+	}
+	return payloadSQL
+}
+
+// deflateWriters reuses DEFLATE writers, which are costly to allocate, across
+// compressed inserts
+var deflateWriters = sync.Pool{
+	New: func() any {
+		writer, _ := flate.NewWriterDict(nil, flate.BestCompression, payloadDictionary)
+		return writer
+	},
+}
+
+// compressPayload encodes JSON text as a payloadFormatDeflate BLOB
+func compressPayload(payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(payloadFormatDeflate)
+
+	writer := deflateWriters.Get().(*flate.Writer)
+	writer.Reset(&buf)
+	writer.Write(payload)
+	writer.Close()
+	deflateWriters.Put(writer)
+	return buf.Bytes()
+}
+
+// isCompressedPayload reports whether a payload stored as a BLOB is in a
+// compressed format. TEXT payloads must not be passed to it.
+func isCompressedPayload(stored []byte) bool {
+	return len(stored) > 0 && stored[0] == payloadFormatDeflate
+}
+
+// decompressPayload returns the JSON text of a payload stored as a BLOB,
+// which is returned as is unless it is compressed
+func decompressPayload(stored []byte) ([]byte, error) {
+	if !isCompressedPayload(stored) {
+		return stored, nil
+	}
+	reader := flate.NewReaderDict(bytes.NewReader(stored[1:]), payloadDictionary)
+	defer reader.Close()
+
+	payload, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload: %v", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvSource is a lineSource reading timestamp,user_id,event_type,payload
+// records with encoding/csv, so quoted payloads may contain commas, quotes
+// and newlines. A first row whose leading field is not a timestamp is taken
+// to be a header and skipped.
+type csvSource struct {
+	reader *csv.Reader
+	parser *Parser
+	first  bool
+
+	record    []string
+	recordErr error // malformed CSV for the current record
+	text      string
+	line      int
+	err       error
+}
+
+func newCSVSource(r io.Reader, parser *Parser) *csvSource {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // field count is checked by ParseCSV
+	return &csvSource{reader: reader, parser: parser, first: true}
+}
+
+// Scan reads the next record. Malformed CSV is reported through
+// ParseRecord rather than stopping the scan.
+func (cs *csvSource) Scan() bool {
+	for {
+		record, err := cs.reader.Read()
+		if err == io.EOF {
+			return false
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			cs.record = nil
+			cs.recordErr = parseErr.Err
+			cs.text = parseErr.Error()
+			cs.line = parseErr.StartLine
+			cs.first = false
+			return true
+		}
+		if err != nil {
+			cs.err = err
+			return false
+		}
+
+		cs.line, _ = cs.reader.FieldPos(0)
+		if cs.first {
+			cs.first = false
+			if _, err := parseFlexibleTime(strings.TrimSpace(record[0])); err != nil {
+				continue // header row
+			}
+		}
+
+		cs.record = record
+		cs.recordErr = nil
+		cs.text = strings.Join(record, ",")
+		return true
+	}
+}
+
+// Text returns the current record re-joined with commas, for messages
+func (cs *csvSource) Text() string {
+	return cs.text
+}
+
+// ParseRecord parses the current record with the source's parser
+func (cs *csvSource) ParseRecord() (*Event, error) {
+	if cs.recordErr != nil {
+		return nil, fmt.Errorf("invalid format: %v", cs.recordErr)
+	}
+	return cs.parser.ParseCSV(cs.record)
+}
+
+// Position reports the line the current record starts on
+func (cs *csvSource) Position() string {
+	return fmt.Sprintf("line %d", cs.line)
+}
+
+// Err returns the first read error encountered
+func (cs *csvSource) Err() error {
+	return cs.err
+}
+
+// csvHeader names the columns written by CSVRecord
+var csvHeader = []string{"timestamp", "user_id", "event_type", "payload"}
+
+// CSVRecord returns the event as timestamp,user_id,event_type,payload fields
+// for encoding/csv; it is the inverse of ParseEventCSV
+func (e *Event) CSVRecord() []string {
+	return []string{
+		e.Timestamp.Format(time.RFC3339Nano),
+		strconv.FormatInt(e.UserID, 10),
+		e.EventType,
+		e.payloadString(),
+	}
+}
+
+// marshalCSVLine encodes one record as a CSV line without the trailing
+// newline, quoting fields as needed
+func marshalCSVLine(record []string) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(record)
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
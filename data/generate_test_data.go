@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"time"
@@ -19,14 +21,28 @@ type EventPayload struct {
 	Page     string  `json:"page,omitempty"`
 }
 
-func generateTestData(filename string, numEvents int) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+// status receives progress messages; it is stderr when events go to stdout
+var status io.Writer = os.Stdout
+
+// generateTestData writes numEvents random events to filename, or stdout for
+// "-". With appendOnly the events are added to the end of an existing file
+// instead of replacing it. The same seed always yields the same events.
+func generateTestData(filename string, numEvents int, appendOnly bool, seed int64) error {
+	file := os.Stdout
+	if filename != "-" {
+		mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if appendOnly {
+			mode = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		var err error
+		file, err = os.OpenFile(filename, mode, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
 	}
-	defer file.Close()
 
-	rand.Seed(time.Now().UnixNano())
+	rng := rand.New(rand.NewSource(seed))
 
 	// Event types with different probabilities
 	eventTypes := []string{"login", "purchase", "logout", "page_view", "search", "download", "signup", "error"}
@@ -50,21 +66,21 @@ func generateTestData(filename string, numEvents int) error {
 
 	for i := 0; i < numEvents; i++ {
 		// Generate realistic timestamp (events spread over 24 hours)
-		offsetMinutes := rand.Intn(24 * 60) // 24 hours in minutes
+		offsetMinutes := rng.Intn(24 * 60) // 24 hours in minutes
 		timestamp := baseTime.Add(time.Duration(offsetMinutes) * time.Minute)
 
 		// User distribution: 80% of events from 20% of users (Pareto principle)
 		var userID int
-		if rand.Float64() < 0.8 {
+		if rng.Float64() < 0.8 {
 			// Heavy users (20% of user base)
-			userID = rand.Intn(userCount / 5)
+			userID = rng.Intn(userCount / 5)
 		} else {
 			// Light users (80% of user base)
-			userID = userCount/5 + rand.Intn(userCount*4/5)
+			userID = userCount/5 + rng.Intn(userCount*4/5)
 		}
 
 		// Select event type based on weights
-		eventType := weightedChoice(eventTypes, eventWeights, totalWeight)
+		eventType := weightedChoice(rng, eventTypes, eventWeights, totalWeight)
 
 		// Generate payload based on event type
 		var payload EventPayload
@@ -72,22 +88,22 @@ func generateTestData(filename string, numEvents int) error {
 		switch eventType {
 		case "login":
 			payload = EventPayload{
-				IP:     ips[rand.Intn(len(ips))],
-				Device: devices[rand.Intn(len(devices))],
+				IP:     ips[rng.Intn(len(ips))],
+				Device: devices[rng.Intn(len(devices))],
 			}
 		case "purchase":
 			payload = EventPayload{
-				Item:  items[rand.Intn(len(items))],
-				Price: float64(rand.Intn(10000)) / 100.0, // $0.00 to $99.99
+				Item:  items[rng.Intn(len(items))],
+				Price: float64(rng.Intn(10000)) / 100.0, // $0.00 to $99.99
 			}
 		case "logout":
 			payload = EventPayload{
-				Duration: rand.Intn(3600), // 0 to 1 hour in seconds
+				Duration: rng.Intn(3600), // 0 to 1 hour in seconds
 			}
 		case "page_view":
 			payload = EventPayload{
-				Page:   pages[rand.Intn(len(pages))],
-				Device: devices[rand.Intn(len(devices))],
+				Page:   pages[rng.Intn(len(pages))],
+				Device: devices[rng.Intn(len(devices))],
 			}
 		case "search":
 			payload = EventPayload{
@@ -95,17 +111,17 @@ func generateTestData(filename string, numEvents int) error {
 			}
 		case "download":
 			payload = EventPayload{
-				Item: items[rand.Intn(len(items))],
+				Item: items[rng.Intn(len(items))],
 			}
 		case "signup":
 			payload = EventPayload{
-				IP:       ips[rand.Intn(len(ips))],
-				Location: locations[rand.Intn(len(locations))],
+				IP:       ips[rng.Intn(len(ips))],
+				Location: locations[rng.Intn(len(locations))],
 			}
 		case "error":
 			payload = EventPayload{
-				Status: fmt.Sprintf("%d", 400+rand.Intn(200)), // 400-599 error codes
-				Page:   pages[rand.Intn(len(pages))],
+				Status: fmt.Sprintf("%d", 400+rng.Intn(200)), // 400-599 error codes
+				Page:   pages[rng.Intn(len(pages))],
 			}
 		}
 
@@ -120,17 +136,17 @@ func generateTestData(filename string, numEvents int) error {
 
 		// Progress indicator
 		if i%100000 == 0 {
-			fmt.Printf("Generated %d events...\n", i)
+			fmt.Fprintf(status, "Generated %d events...\n", i)
 		}
 	}
 
-	fmt.Printf("Successfully generated %d events in %s\n", numEvents, filename)
+	fmt.Fprintf(status, "Successfully generated %d events in %s\n", numEvents, filename)
 	return nil
 }
 
-func weightedChoice(choices []string, weights []int, totalWeight int) string {
+func weightedChoice(rng *rand.Rand, choices []string, weights []int, totalWeight int) string {
 
-	r := rand.Intn(totalWeight)
+	r := rng.Intn(totalWeight)
 	cumulative := 0
 
 	for i, weight := range weights {
@@ -144,31 +160,56 @@ func weightedChoice(choices []string, weights []int, totalWeight int) string {
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run generate_test_data.go <output_file> [num_events]")
+	flagSet := flag.NewFlagSet("generate_test_data", flag.ExitOnError)
+	appendOnly := flagSet.Bool("append", false, "Append to the output file instead of overwriting it")
+	seed := flagSet.Int64("seed", 0, "Random seed for reproducible output (0 seeds from the clock)")
+
+	// Flags may come before or after the positional arguments
+	var positional []string
+	args := os.Args[1:]
+	for {
+		flagSet.Parse(args)
+		args = flagSet.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if len(positional) < 1 {
+		fmt.Println("Usage: go run generate_test_data.go <output_file|-> [num_events] [--append] [--seed=<n>]")
 		os.Exit(1)
 	}
 
-	filename := os.Args[1]
+	filename := positional[0]
+	if filename == "-" {
+		status = os.Stderr
+	}
 	numEvents := 1000000 // default 1M
 
-	if len(os.Args) > 2 {
-		fmt.Sscanf(os.Args[2], "%d", &numEvents)
+	if len(positional) > 1 {
+		fmt.Sscanf(positional[1], "%d", &numEvents)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
 	}
 
-	fmt.Printf("Generating %d events...\n", numEvents)
+	fmt.Fprintf(status, "Generating %d events...\n", numEvents)
 	start := time.Now()
 
-	err := generateTestData(filename, numEvents)
+	err := generateTestData(filename, numEvents, *appendOnly, *seed)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		fmt.Fprintf(status, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
 	duration := time.Since(start)
-	fmt.Printf("Completed in %v\n", duration)
+	fmt.Fprintf(status, "Completed in %v\n", duration)
 
 	// Calculate file size
-	stat, _ := os.Stat(filename)
-	fmt.Printf("File size: %.2f MB\n", float64(stat.Size())/(1024*1024))
+	if filename != "-" {
+		stat, _ := os.Stat(filename)
+		fmt.Printf("File size: %.2f MB\n", float64(stat.Size())/(1024*1024))
+	}
 }
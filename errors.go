@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reasons a line cannot be parsed as an event. A ParseError wraps one of
+// them, so callers can test for it with errors.Is.
+var (
+	ErrInvalidFormat    = errors.New("invalid format")
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+	ErrInvalidUserID    = errors.New("invalid user ID")
+	ErrInvalidEventType = errors.New("invalid event type")
+	ErrInvalidPayload   = errors.New("invalid JSON payload")
+	ErrEmptyPayload     = errors.New("empty payload") // also ErrInvalidPayload
+	ErrInvalidUTF8      = errors.New("invalid UTF-8") // also ErrInvalidFormat
+	ErrLineTooLong      = errors.New("line too long") // from the line reader
+)
+
+// errInvalidUTF8 is the reason given for a line that is not UTF-8
+var errInvalidUTF8 = fmt.Errorf("%w: %w", ErrInvalidFormat, ErrInvalidUTF8)
+
+// ParseError reports an input line that cannot be recorded. The parsers
+// leave Line zero; Record and Validate fill it in.
+type ParseError struct {
+	Line   int    // 1-based line number in the input, or 0 when unknown
+	Reason string // human-readable cause, as printed in warnings
+	Err    error  // one of the Err* reasons above, or the underlying error
+}
+
+// Error returns the reason alone; callers prefix the position, which for
+// some sources names a file or CSV record as well as the line
+func (e *ParseError) Error() string {
+	return e.Reason
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parseErrorf returns a ParseError wrapping reason with a formatted message
+func parseErrorf(reason error, format string, args ...interface{}) *ParseError {
+	return &ParseError{Reason: fmt.Sprintf(format, args...), Err: reason}
+}
+
+// lineError returns err as a ParseError for input line lineNum. Errors that
+// are not ParseErrors, such as schema violations, are wrapped as they are.
+func lineError(err error, lineNum int) *ParseError {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		located := *parseErr
+		located.Line = lineNum
+		return &located
+	}
+	return &ParseError{Line: lineNum, Reason: err.Error(), Err: err}
+}
+
+// ErrReadOnly is what a store opened with StoreConfig.ReadOnly returns,
+// wrapped in a StoreError, for any write
+var ErrReadOnly = errors.New("database is open read-only")
+
+// FilterError reports query filters the store refuses, as opposed to a
+// failure of the database while applying them
+type FilterError struct {
+	Err error // what is wrong with the filters
+}
+
+func (e *FilterError) Error() string {
+	return "invalid filters: " + e.Err.Error()
+}
+
+func (e *FilterError) Unwrap() error {
+	return e.Err
+}
+
+// StoreError reports a failure of the database itself while recording or
+// querying, as opposed to bad input or options
+type StoreError struct {
+	Op  string // what failed, such as "insert event"
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.Op, e.Err)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseErrorSentinels(t *testing.T) {
+	tests := []struct {
+		line string
+		want error
+	}{
+		{"2023-08-14T10:00:00Z | 1 | login", ErrInvalidFormat},
+		{"yesterday | 1 | login | {}", ErrInvalidTimestamp},
+		{"2023-08-14T10:00:00Z | one | login | {}", ErrInvalidUserID},
+		{"2023-08-14T10:00:00Z | 1 |   | {}", ErrInvalidEventType},
+		{"2023-08-14T10:00:00Z | 1 | login | {broken", ErrInvalidPayload},
+		{"2023-08-14T10:00:00Z | 1 | login | \xff", ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		_, err := ParseEvent(tt.line)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("ParseEvent(%q) = %v, want errors.Is %v", tt.line, err, tt.want)
+		}
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("ParseEvent(%q) = %T, want a *ParseError", tt.line, err)
+		} else if parseErr.Line != 0 {
+			t.Errorf("ParseEvent(%q): Line = %d, want 0 from the parser", tt.line, parseErr.Line)
+		}
+	}
+}
+
+func TestEmptyPayloadRejectIsBothSentinels(t *testing.T) {
+	parser := &Parser{EmptyPayload: EmptyPayloadReject}
+	_, err := parser.Parse("2023-08-14T10:00:00Z | 1 | login |  ")
+	if !errors.Is(err, ErrEmptyPayload) || !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("got %v, want both ErrEmptyPayload and ErrInvalidPayload", err)
+	}
+}
+
+func TestLineErrorKeepsReason(t *testing.T) {
+	_, err := ParseEvent("2023-08-14T10:00:00Z | one | login | {}")
+	located := lineError(err, 7)
+	if located.Line != 7 || !errors.Is(located, ErrInvalidUserID) {
+		t.Errorf("lineError = line %d, %v; want line 7 wrapping ErrInvalidUserID", located.Line, located)
+	}
+
+	other := errors.New("schema violation")
+	wrapped := lineError(other, 3)
+	if wrapped.Line != 3 || !errors.Is(wrapped, other) {
+		t.Errorf("lineError of a plain error = line %d, %v; want line 3 wrapping it", wrapped.Line, wrapped)
+	}
+}
+
+func TestStrictRecordReturnsLocatedParseError(t *testing.T) {
+	store := newTestStore(t)
+	input := writeTestInput(t,
+		"2023-08-14T10:00:00Z | 1 | login | {}",
+		"2023-08-14T10:01:00Z | 1 | login | {broken",
+	)
+
+	_, _, err := store.Record(input, RecordOptions{Strict: true})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("Record = %v, want a *ParseError", err)
+	}
+	if parseErr.Line != 2 || !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("got line %d, %v; want line 2 wrapping ErrInvalidPayload", parseErr.Line, err)
+	}
+}
+
+func TestStoreErrorWrapsReadOnly(t *testing.T) {
+	store := &EventStore{config: StoreConfig{ReadOnly: true}}
+	err := store.writable("insert event")
+
+	var storeErr *StoreError
+	if !errors.As(err, &storeErr) || storeErr.Op != "insert event" {
+		t.Fatalf("writable = %v, want a *StoreError for insert event", err)
+	}
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("writable = %v, want errors.Is ErrReadOnly", err)
+	}
+	if got, want := err.Error(), "failed to insert event: database is open read-only"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestLintGroupsErrorsBySentinel(t *testing.T) {
+	input := strings.Join([]string{
+		"2023-08-14T10:00:00Z | 1 | login | {}",
+		"2023-08-14T10:00:00Z | 1 | login",
+		"yesterday | 1 | login | {}",
+		"2023-08-14T10:00:00Z | one | login | {}",
+		"2023-08-14T10:00:00Z | 1 |  | {}",
+		"2023-08-14T10:00:00Z | 1 | login | {",
+		"2023-08-14T10:00:00Z | 1 | login | \"\xff\"",
+		"2023-08-14T10:00:00Z | 1 | login | " + strings.Repeat("x", 100),
+	}, "\n")
+	report, err := lintLines(newLineReader(strings.NewReader(input), 80))
+	if err != nil {
+		t.Fatalf("lintLines: %v", err)
+	}
+
+	want := map[string]int{
+		"bad_format":       1,
+		"bad_timestamp":    1,
+		"bad_user_id":      1,
+		"empty_event_type": 1,
+		"bad_json":         1,
+		"bad_utf8":         1,
+		"line_too_long":    1,
+	}
+	if report.Valid != 1 || !reflect.DeepEqual(report.ErrorsByKind, want) {
+		t.Errorf("lint found %d valid lines and errors %v, want 1 and %v", report.Valid, report.ErrorsByKind, want)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// followPollInterval is how often a followed file is checked for new data
+const followPollInterval = 250 * time.Millisecond
+
+// DefaultFollowFlushInterval is how often Follow commits a partial batch so
+// recent events become queryable without waiting for a full batch
+const DefaultFollowFlushInterval = 2 * time.Second
+
+// fileFollower is a lineSource that keeps reading a file as it grows, like
+// tail -f. When no new data is available Scan reports an empty line after
+// each poll so the ingester gets a chance to commit partial batches. A file
+// that shrinks or is replaced at the same path is reopened from the start.
+type fileFollower struct {
+	name   string
+	file   *os.File
+	reader *bufio.Reader
+	offset int64
+	stop   <-chan struct{}
+
+	partial string // bytes read past the last newline
+	line    string
+	lineNum int
+	err     error
+}
+
+// newFileFollower opens a file for following from its beginning
+func newFileFollower(name string, stop <-chan struct{}) (*fileFollower, error) {
+	ff := &fileFollower{name: name, stop: stop}
+	if err := ff.open(); err != nil {
+		return nil, err
+	}
+	return ff, nil
+}
+
+// open (re)opens the followed file and resets the read position
+func (ff *fileFollower) open() error {
+	file, err := os.Open(ff.name)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	if ff.file != nil {
+		ff.file.Close()
+	}
+	ff.file = file
+	ff.reader = bufio.NewReader(file)
+	ff.offset = 0
+	ff.partial = ""
+	ff.lineNum = 0
+	return nil
+}
+
+// Scan returns the next complete line, or an empty line after an idle poll.
+// It returns false once stop is closed or a read error occurs.
+func (ff *fileFollower) Scan() bool {
+	if ff.err != nil {
+		return false
+	}
+
+	chunk, err := ff.reader.ReadString('\n')
+	ff.offset += int64(len(chunk))
+	if err == nil {
+		ff.lineNum++
+		ff.line = strings.TrimRight(ff.partial+chunk, "\r\n")
+		ff.partial = ""
+		return true
+	}
+	if err != io.EOF {
+		ff.err = err
+		return false
+	}
+	ff.partial += chunk
+
+	if err := ff.checkRotation(); err != nil {
+		ff.err = err
+		return false
+	}
+
+	select {
+	case <-ff.stop:
+		// Hand over a trailing line without a newline before stopping
+		if ff.partial != "" {
+			ff.lineNum++
+			ff.line = ff.partial
+			ff.partial = ""
+			return true
+		}
+		return false
+	case <-time.After(followPollInterval):
+	}
+
+	ff.line = ""
+	return true
+}
+
+// checkRotation reopens the file if it was truncated or replaced since the
+// last read
+func (ff *fileFollower) checkRotation() error {
+	current, err := ff.file.Stat()
+	if err != nil {
+		return err
+	}
+	latest, err := os.Stat(ff.name)
+	if err != nil {
+		// Mid-rotation the path may briefly not exist; keep the old file
+		return nil
+	}
+
+	switch {
+	case !os.SameFile(current, latest):
+		logger.Warnf("%s was replaced; reopening", ff.name)
+	case latest.Size() < ff.offset:
+		logger.Warnf("%s was truncated; reopening", ff.name)
+	default:
+		return nil
+	}
+	return ff.open()
+}
+
+// Text returns the line selected by the last call to Scan
+func (ff *fileFollower) Text() string {
+	return ff.line
+}
+
+// Position describes the line number within the current file
+func (ff *fileFollower) Position() string {
+	return fmt.Sprintf("line %d", ff.lineNum)
+}
+
+// Err returns the read error that stopped following, if any
+func (ff *fileFollower) Err() error {
+	return ff.err
+}
+
+// Close closes the followed file
+func (ff *fileFollower) Close() {
+	ff.file.Close()
+}
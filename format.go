@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// OutputOptions controls how query results are rendered
+type OutputOptions struct {
+	Format string // FormatText, FormatJSON or FormatCSV
+
+	// Flatten merges payload keys into the top-level JSON object. Keys that
+	// collide with timestamp/user_id/event_type get a "payload_" prefix and
+	// non-object payloads stay under a "payload" key.
+	Flatten bool
+
+	// Location is the zone timestamps are rendered in; nil means UTC
+	Location *time.Location
+
+	// ShowID adds each event's row ID: a leading field in text and CSV, an
+	// "id" key in JSON
+	ShowID bool
+
+	// ShowIngested adds when each event was recorded, in Location: a
+	// leading field in text and CSV, a leading "ingested_at" key in JSON.
+	// Events recorded before ingest times were kept show it empty, or null
+	// in JSON.
+	ShowIngested bool
+
+	// Template, when set, renders each event with text/template instead of
+	// Format. It sees the fields of templateEvent.
+	Template string
+
+	// Pretty indents JSON output, one multi-line object per event
+	Pretty bool
+
+	// ExpandPayload replaces the payload column of text output with these
+	// payload keys as key=value columns. Nested keys use dots, as in
+	// "n.z"; a key the payload lacks prints as key=.
+	ExpandPayload []string
+
+	// Fields, when set, restricts the output to these fields in this order:
+	// id, timestamp, user_id, event_type, payload, or payload.<key> for a
+	// single payload value. JSON output uses the field names as keys.
+	Fields []string
+
+	// BufferSize is how many bytes of output are collected before each
+	// write to the destination; zero means DefaultOutputBufferSize. Larger
+	// buffers mean fewer write system calls on big dumps.
+	BufferSize int
+
+	// Number prefixes each event with its 1-based position in the results,
+	// counting the events skipped by QueryFilters.Offset: a leading column
+	// in text and CSV, a leading "number" key in JSON
+	Number bool
+
+	// Explode adds these payload keys to CSV output as columns after the
+	// payload, extracted by SQLite; a key the payload lacks is empty.
+	// Nested keys use dots, as in "geo.country".
+	Explode []string
+}
+
+// DefaultOutputBufferSize is the output buffer size when none is set
+const DefaultOutputBufferSize = 64 * 1024
+
+// eventFields are the top-level fields OutputOptions.Fields accepts
+var eventFields = map[string]bool{"id": true, "timestamp": true, "user_id": true, "event_type": true, "payload": true}
+
+// templateEvent is what an output template is executed with
+type templateEvent struct {
+	ID         int64
+	Timestamp  templateTime
+	UserID     int64
+	EventType  string
+	Payload    string       // JSON text
+	IngestedAt templateTime // zero unless OutputOptions.ShowIngested
+}
+
+// templateTime prints as RFC3339Nano in templates while keeping time.Time's
+// methods, as in {{.Timestamp.Unix}}
+type templateTime struct {
+	time.Time
+}
+
+func (tt templateTime) String() string {
+	return tt.Format(time.RFC3339Nano)
+}
+
+// Validate checks that the output options are supported
+func (oo *OutputOptions) Validate() error {
+	switch oo.Format {
+	case FormatText, FormatJSON, FormatCSV, "":
+	default:
+		return fmt.Errorf("unknown output format %q (expected text, json or csv)", oo.Format)
+	}
+	if oo.Flatten && oo.Format != FormatJSON {
+		return fmt.Errorf("flatten requires the json format")
+	}
+	if oo.Pretty && oo.Format != FormatJSON {
+		return fmt.Errorf("pretty requires the json format")
+	}
+	if oo.BufferSize < 0 {
+		return fmt.Errorf("buffer size cannot be negative, got %d", oo.BufferSize)
+	}
+	if oo.Number && oo.Template != "" {
+		return fmt.Errorf("number cannot be combined with a template")
+	}
+	if len(oo.Explode) > 0 {
+		if oo.Format != FormatCSV {
+			return fmt.Errorf("explode requires the csv format")
+		}
+		if len(oo.Fields) > 0 {
+			return fmt.Errorf("explode cannot be combined with fields")
+		}
+		seen := make(map[string]bool)
+		for _, key := range oo.Explode {
+			if _, err := payloadPath(key); err != nil {
+				return fmt.Errorf("explode: %v", err)
+			}
+			if seen[key] {
+				return fmt.Errorf("explode key %q is listed twice", key)
+			}
+			seen[key] = true
+		}
+	}
+	if len(oo.Fields) > 0 {
+		if oo.Template != "" || oo.Flatten || oo.ShowID || len(oo.ExpandPayload) > 0 {
+			return fmt.Errorf("fields cannot be combined with a template, flatten, show-id or expand-payload")
+		}
+		seen := make(map[string]bool)
+		for _, field := range oo.Fields {
+			if !eventFields[field] {
+				if !strings.HasPrefix(field, "payload.") {
+					return fmt.Errorf("unknown field %q (expected id, timestamp, user_id, event_type, payload or payload.<key>)", field)
+				}
+				if _, err := payloadPath(field); err != nil {
+					return err
+				}
+			}
+			if seen[field] {
+				return fmt.Errorf("field %q is listed twice", field)
+			}
+			seen[field] = true
+		}
+	}
+	if len(oo.ExpandPayload) > 0 {
+		if oo.Format != FormatText && oo.Format != "" {
+			return fmt.Errorf("expand-payload requires the text format")
+		}
+		if oo.Template != "" {
+			return fmt.Errorf("expand-payload cannot be combined with a template")
+		}
+		for _, key := range oo.ExpandPayload {
+			if key == "" {
+				return fmt.Errorf("expand-payload has an empty key")
+			}
+		}
+	}
+	if oo.Template != "" {
+		if oo.Format != FormatText && oo.Format != "" {
+			return fmt.Errorf("a template cannot be combined with the %s format", oo.Format)
+		}
+		if _, err := oo.compileTemplate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileTemplate parses the output template and executes it once on an
+// empty event, so that unknown fields are reported before any query runs
+func (oo *OutputOptions) compileTemplate() (*template.Template, error) {
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(oo.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	if err := tmpl.Execute(io.Discard, templateEvent{}); err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// renderer returns the function rendering each event as one output line,
+// with the template compiled once up front
+func (oo *OutputOptions) renderer() (func(*Event) ([]byte, error), error) {
+	if oo.Template == "" && oo.ShowIngested {
+		return oo.prefixColumn(oo.render, "ingested_at", oo.ingestedColumn), nil
+	}
+	if oo.Template == "" {
+		return oo.render, nil
+	}
+	tmpl, err := oo.compileTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	return func(e *Event) ([]byte, error) {
+		timestamp, ingestedAt := e.Timestamp, e.IngestedAt
+		if oo.Location != nil {
+			timestamp = timestamp.In(oo.Location)
+			ingestedAt = ingestedAt.In(oo.Location)
+		}
+		buf.Reset()
+		err := tmpl.Execute(&buf, templateEvent{
+			ID:         e.ID,
+			Timestamp:  templateTime{timestamp},
+			UserID:     e.UserID,
+			EventType:  e.EventType,
+			Payload:    e.payloadString(),
+			IngestedAt: templateTime{ingestedAt},
+		})
+		return buf.Bytes(), err
+	}, nil
+}
+
+// header returns the line written before any events, or nil if the format
+// has none
+func (oo *OutputOptions) header() ([]byte, error) {
+	if oo.Format != FormatCSV {
+		return nil, nil
+	}
+	var columns []string
+	if oo.Number {
+		columns = append(columns, "number")
+	}
+	if oo.ShowIngested {
+		columns = append(columns, "ingested_at")
+	}
+	switch {
+	case len(oo.Fields) > 0:
+		columns = append(columns, oo.Fields...)
+	case oo.ShowID:
+		columns = append(append(columns, "id"), csvHeader...)
+	default:
+		columns = append(columns, csvHeader...)
+	}
+	return marshalCSVLine(append(columns, oo.Explode...))
+}
+
+// numbered wraps render to prefix each line with its position, counting on
+// from offset, as described for OutputOptions.Number
+func (oo *OutputOptions) numbered(render func(*Event) ([]byte, error), offset int) func(*Event) ([]byte, error) {
+	n := offset
+	return oo.prefixColumn(render, "number", func(*Event) (string, string) {
+		n++
+		number := strconv.Itoa(n)
+		return number, number
+	})
+}
+
+// ingestedColumn returns an event's ingest time as text and as JSON, for
+// OutputOptions.ShowIngested
+func (oo *OutputOptions) ingestedColumn(e *Event) (string, string) {
+	if e.IngestedAt.IsZero() {
+		return "", "null"
+	}
+	ingestedAt := e.IngestedAt
+	if oo.Location != nil {
+		ingestedAt = ingestedAt.In(oo.Location)
+	}
+	text := ingestedAt.Format(time.RFC3339Nano)
+	return text, `"` + text + `"`
+}
+
+// prefixColumn wraps render to add a column before the rest of each line:
+// a leading key in JSON, a leading field in text and CSV. value returns the
+// column as plain text, which must need no CSV quoting, and as JSON.
+func (oo *OutputOptions) prefixColumn(render func(*Event) ([]byte, error), key string, value func(*Event) (string, string)) func(*Event) ([]byte, error) {
+	return func(e *Event) ([]byte, error) {
+		line, err := render(e)
+		if err != nil {
+			return nil, err
+		}
+		text, encoded := value(e)
+
+		switch oo.Format {
+		case FormatJSON:
+			// Every JSON rendering is a non-empty object; pretty output is
+			// indented again with the new key
+			object := bytes.TrimLeft(line, " \n")
+			prefixed := append([]byte(`{"`+key+`":`+encoded+`,`), object[1:]...)
+			if !oo.Pretty {
+				return prefixed, nil
+			}
+			var buf bytes.Buffer
+			err := json.Indent(&buf, prefixed, "", "  ")
+			return buf.Bytes(), err
+		case FormatCSV:
+			return append([]byte(text+","), line...), nil
+		default:
+			return append([]byte(text+DefaultDelimiter), line...), nil
+		}
+	}
+}
+
+// render formats a single event as one output line
+func (oo *OutputOptions) render(e *Event) ([]byte, error) {
+	if len(oo.Fields) > 0 {
+		if oo.Location != nil {
+			local := *e
+			local.Timestamp = e.Timestamp.In(oo.Location)
+			e = &local
+		}
+		return oo.renderFields(e)
+	}
+	if oo.Location != nil || !oo.ShowID {
+		local := *e
+		if oo.Location != nil {
+			local.Timestamp = e.Timestamp.In(oo.Location)
+		}
+		if !oo.ShowID {
+			local.ID = 0 // left out of JSON
+		}
+		e = &local
+	}
+	if oo.Flatten || oo.Pretty {
+		line, err := e.MarshalLine(FormatJSON)
+		if oo.Flatten {
+			line, err = e.marshalFlatJSON()
+		}
+		if err != nil || !oo.Pretty {
+			return line, err
+		}
+		var buf bytes.Buffer
+		err = json.Indent(&buf, line, "", "  ")
+		return buf.Bytes(), err
+	}
+	if len(oo.ExpandPayload) > 0 {
+		return oo.renderExpanded(e), nil
+	}
+
+	switch {
+	case oo.Format == FormatCSV && (oo.ShowID || len(oo.Explode) > 0):
+		var record []string
+		if oo.ShowID {
+			record = append(record, strconv.FormatInt(e.ID, 10))
+		}
+		record = append(record, e.CSVRecord()...)
+		return marshalCSVLine(append(record, e.extracted...))
+	case !oo.ShowID || oo.Format == FormatJSON:
+		return e.MarshalLine(oo.Format)
+	default:
+		return []byte(strconv.FormatInt(e.ID, 10) + DefaultDelimiter + e.String()), nil
+	}
+}
+
+// marshalFlatJSON renders the event as a JSON object with the payload keys
+// promoted next to timestamp, user_id and event_type
+func (e *Event) marshalFlatJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	reserved := map[string]bool{"timestamp": true, "user_id": true, "event_type": true}
+	writeField := func(key string, value interface{}) error {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(encoded)
+		return nil
+	}
+
+	if e.ID != 0 {
+		writeField("id", e.ID)
+		reserved["id"] = true
+	}
+	writeField("timestamp", e.Timestamp.Format(time.RFC3339Nano))
+	writeField("user_id", e.UserID)
+	writeField("event_type", e.EventType)
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(e.Payload, &fields); err != nil || fields == nil {
+		// Not an object: keep the payload intact under its own key
+		if err := writeField("payload", e.payloadJSON()); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := key
+		for reserved[name] {
+			name = "payload_" + name
+		}
+		reserved[name] = true
+		if err := writeField(name, fields[key]); err != nil {
+			return nil, err
+		}
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// renderExpanded renders the event in the text format with the payload
+// column replaced by the ExpandPayload keys as key=value columns
+func (oo *OutputOptions) renderExpanded(e *Event) []byte {
+	fields := make(map[string]string)
+	flattenPayload("", e.Payload, fields)
+
+	var buf bytes.Buffer
+	if oo.ShowID {
+		buf.WriteString(strconv.FormatInt(e.ID, 10) + DefaultDelimiter)
+	}
+	buf.WriteString(e.Timestamp.Format(time.RFC3339Nano) + DefaultDelimiter)
+	buf.WriteString(strconv.FormatInt(e.UserID, 10) + DefaultDelimiter)
+	buf.WriteString(e.EventType)
+	for _, key := range oo.ExpandPayload {
+		buf.WriteString(DefaultDelimiter + key + "=" + fields[key])
+	}
+	return buf.Bytes()
+}
+
+// flattenPayload adds the leaves of a JSON document to fields, keyed by
+// their dotted path under prefix. Strings are stored unquoted and other
+// values, arrays included, as JSON text.
+func flattenPayload(prefix string, raw json.RawMessage, fields map[string]string) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &object); err == nil && object != nil {
+		for key, value := range object {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenPayload(key, value, fields)
+		}
+		return
+	}
+	if prefix == "" {
+		return // a payload that is not an object has no keys
+	}
+
+	fields[prefix] = jsonText(raw)
+}
+
+// queryFilters returns filters adjusted to select what the output shows:
+// no payload when it is never shown, and the exploded payload keys
+func (oo *OutputOptions) queryFilters(filters QueryFilters) QueryFilters {
+	// The dedupe window compares payloads, so it still needs them
+	if !oo.needsPayload() && filters.DedupeWindow == 0 {
+		filters.omitPayload = true
+	}
+	filters.ingested = oo.ShowIngested
+	filters.extract = nil
+	for _, key := range oo.Explode {
+		path, _ := payloadPath(key) // checked by Validate
+		filters.extract = append(filters.extract, path)
+	}
+	return filters
+}
+
+// needsPayload reports whether rendering reads event payloads. Only Fields
+// can leave them out.
+func (oo *OutputOptions) needsPayload() bool {
+	if len(oo.Fields) == 0 {
+		return true
+	}
+	for _, field := range oo.Fields {
+		if field == "payload" || strings.HasPrefix(field, "payload.") {
+			return true
+		}
+	}
+	return false
+}
+
+// renderFields renders the Fields of an event: as a JSON object in JSON,
+// as a record in CSV and as delimited values in text. A payload key the
+// payload lacks is null in JSON and empty otherwise.
+func (oo *OutputOptions) renderFields(e *Event) ([]byte, error) {
+	values := make([]json.RawMessage, len(oo.Fields))
+	for i, field := range oo.Fields {
+		var value interface{}
+		switch field {
+		case "id":
+			value = e.ID
+		case "timestamp":
+			value = e.Timestamp.Format(time.RFC3339Nano)
+		case "user_id":
+			value = e.UserID
+		case "event_type":
+			value = e.EventType
+		case "payload":
+			values[i] = e.payloadJSON()
+			continue
+		default:
+			values[i] = lookupPayload(e.Payload, strings.Split(strings.TrimPrefix(field, "payload."), "."))
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = encoded
+	}
+
+	if oo.Format == FormatJSON {
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		for i, field := range oo.Fields {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			name, _ := json.Marshal(field)
+			buf.Write(name)
+			buf.WriteByte(':')
+			if values[i] == nil {
+				buf.WriteString("null")
+			} else {
+				buf.Write(values[i])
+			}
+		}
+		buf.WriteByte('}')
+		if !oo.Pretty {
+			return buf.Bytes(), nil
+		}
+		var pretty bytes.Buffer
+		err := json.Indent(&pretty, buf.Bytes(), "", "  ")
+		return pretty.Bytes(), err
+	}
+
+	record := make([]string, len(values))
+	for i, value := range values {
+		record[i] = jsonText(value)
+	}
+	if oo.Format == FormatCSV {
+		return marshalCSVLine(record)
+	}
+	return []byte(strings.Join(record, DefaultDelimiter)), nil
+}
+
+// lookupPayload returns the value at path in a JSON payload, or nil if the
+// payload has no such key
+func lookupPayload(raw json.RawMessage, path []string) json.RawMessage {
+	for _, key := range path {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return nil
+		}
+		value, ok := object[key]
+		if !ok {
+			return nil
+		}
+		raw = value
+	}
+	return raw
+}
+
+// jsonText renders a JSON value as plain text: strings without quotes,
+// other values as JSON and a missing value as the empty string
+func jsonText(raw json.RawMessage) string {
+	if raw == nil {
+		return ""
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	return string(raw)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// jsonSchemaDialect is the JSON Schema version EventJSONSchema follows
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// eventSchemaFields adds a description, and constraints the Go type cannot
+// express, to the schema of each JSON field of Event, by field name
+var eventSchemaFields = map[string]map[string]interface{}{
+	"id": {
+		"description": "Row ID assigned by the database, present on events read from it",
+		"minimum":     1,
+	},
+	"timestamp": {
+		"description": "When the event happened, as RFC3339 with fractional seconds as needed; written in UTC unless a time zone is requested",
+	},
+	"user_id": {
+		"description": "ID of the user the event belongs to",
+	},
+	"event_type": {
+		"description": "Kind of event, such as login or purchase",
+		"pattern":     `\S`,
+	},
+	"payload": {
+		"description": "Event data as any JSON value, usually an object; null when the event has none. Payloads recorded with --no-json-validate that are not JSON appear as strings.",
+	},
+}
+
+// EventJSONSchema returns a JSON Schema document describing an event as
+// query --format=json writes it and record --input-format=json reads it.
+// The properties follow the json tags of Event, so a field added without a
+// description or of a type the schema cannot express is an error.
+func EventJSONSchema() (map[string]interface{}, error) {
+	properties := make(map[string]interface{})
+	required := []string{}
+
+	eventType := reflect.TypeOf(Event{})
+	for i := 0; i < eventType.NumField(); i++ {
+		field := eventType.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		property, err := jsonSchemaType(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", field.Name, err)
+		}
+		extra, ok := eventSchemaFields[name]
+		if !ok {
+			return nil, fmt.Errorf("field %s has no schema description", field.Name)
+		}
+		for key, value := range extra {
+			property[key] = value
+		}
+		properties[name] = property
+
+		if options != "omitempty" {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]interface{}{
+		"$schema":     jsonSchemaDialect,
+		"title":       "eventlog event",
+		"description": "One event, as a JSON object on a line of its own",
+		"type":        "object",
+		"properties":  properties,
+		"required":    required,
+	}, nil
+}
+
+// jsonSchemaType returns the schema of the JSON values encoding/json
+// produces for t
+func jsonSchemaType(t reflect.Type) (map[string]interface{}, error) {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}, nil
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}, nil // any JSON value
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}, nil
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	default:
+		return nil, fmt.Errorf("no JSON Schema type for %s", t)
+	}
+}
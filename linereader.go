@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DefaultMaxLineSize is the longest input line accepted when
+// RecordOptions.MaxLineSize is not set
+const DefaultMaxLineSize = 1024 * 1024
+
+// lineReader is a lineSource like bufio.Scanner, except that a line longer
+// than maxLine does not stop the scan: it is reported through LineErr and
+// reading continues with the next line. Memory use stays bounded by maxLine.
+type lineReader struct {
+	reader  *bufio.Reader
+	maxLine int
+
+	line    string
+	lineErr error
+	err     error
+}
+
+func newLineReader(r io.Reader, maxLine int) *lineReader {
+	if maxLine <= 0 {
+		maxLine = DefaultMaxLineSize
+	}
+	return &lineReader{reader: bufio.NewReaderSize(r, 64*1024), maxLine: maxLine}
+}
+
+// Scan reads the next line, dropping the line ending
+func (lr *lineReader) Scan() bool {
+	lr.line, lr.lineErr = "", nil
+
+	var buf []byte
+	overflow := false
+	for {
+		chunk, err := lr.reader.ReadSlice('\n')
+		// Keep two extra bytes so "\r\n" never counts against the limit
+		if !overflow && len(buf)+len(chunk) <= lr.maxLine+2 {
+			buf = append(buf, chunk...)
+		} else {
+			overflow = true
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			if len(buf) == 0 && !overflow {
+				return false
+			}
+			break
+		}
+		if err != nil {
+			lr.err = err
+			return false
+		}
+		break
+	}
+
+	lr.line = strings.TrimSuffix(strings.TrimSuffix(string(buf), "\n"), "\r")
+	if overflow || len(lr.line) > lr.maxLine {
+		lr.lineErr = fmt.Errorf("%w: exceeds %d bytes (raise --max-line)", ErrLineTooLong, lr.maxLine)
+		if lr.line == "" {
+			lr.line = "(overlong line)"
+		}
+	}
+	return true
+}
+
+// Text returns the line read by the last call to Scan; for an overlong line
+// only its beginning
+func (lr *lineReader) Text() string {
+	return lr.line
+}
+
+// LineErr reports why the current line cannot be used, if it cannot
+func (lr *lineReader) LineErr() error {
+	return lr.lineErr
+}
+
+// Err returns the first read error encountered
+func (lr *lineReader) Err() error {
+	return lr.err
+}
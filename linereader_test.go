@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestLineReaderLongLines(t *testing.T) {
+	// bufio.MaxScanTokenSize is the 64KB limit that used to drop lines
+	overScanner := strings.Repeat("x", bufio.MaxScanTokenSize+1)
+	input := "first\r\n" + overScanner + "\n" + strings.Repeat("y", 200) + "\nlast"
+
+	reader := newLineReader(strings.NewReader(input), 100*1024)
+	var lines []string
+	var lineErrs []error
+	for reader.Scan() {
+		lines = append(lines, reader.Text())
+		lineErrs = append(lineErrs, reader.LineErr())
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	want := []string{"first", overScanner, strings.Repeat("y", 200), "last"}
+	if len(lines) != len(want) {
+		t.Fatalf("read %d lines, want %d", len(lines), len(want))
+	}
+	for i := range want {
+		if lines[i] != want[i] || lineErrs[i] != nil {
+			t.Errorf("line %d: %d bytes, error %v; want %d bytes, no error", i+1, len(lines[i]), lineErrs[i], len(want[i]))
+		}
+	}
+}
+
+func TestLineReaderReportsOverlongLine(t *testing.T) {
+	input := "short\n" + strings.Repeat("x", 150) + "\nexactly " + strings.Repeat("z", 92) + "\nafter\n"
+	reader := newLineReader(strings.NewReader(input), 100)
+
+	var errs []bool
+	var lines []string
+	for reader.Scan() {
+		lines = append(lines, reader.Text())
+		errs = append(errs, reader.LineErr() != nil)
+	}
+	if got, want := len(lines), 4; got != want {
+		t.Fatalf("read %d lines, want %d", got, want)
+	}
+	wantErrs := []bool{false, true, false, false}
+	for i := range wantErrs {
+		if errs[i] != wantErrs[i] {
+			t.Errorf("line %d: too long reported %v, want %v", i+1, errs[i], wantErrs[i])
+		}
+	}
+	if lines[3] != "after" {
+		t.Errorf("line after the overlong one = %q, want after", lines[3])
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// LintReport summarises the quality of an input file without ingesting it
+type LintReport struct {
+	Lines        int            `json:"lines"` // non-empty lines
+	Valid        int            `json:"valid"`
+	Invalid      int            `json:"invalid"`
+	ErrorsByKind map[string]int `json:"errors_by_kind"`
+	EventTypes   map[string]int `json:"event_types"`
+	MinTimestamp string         `json:"min_timestamp,omitempty"`
+	MaxTimestamp string         `json:"max_timestamp,omitempty"`
+	PayloadKeys  []string       `json:"payload_keys"`
+}
+
+// LintFile runs every line of a file through ParseEvent and accumulates
+// parse error kinds, event type counts, the timestamp range and the payload
+// keys seen. The database is not involved.
+func LintFile(filename string) (*LintReport, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	return lintLines(newLineReader(file, DefaultMaxLineSize))
+}
+
+// lintLines builds a LintReport from a line source
+func lintLines(source lineSource) (*LintReport, error) {
+	report := &LintReport{
+		ErrorsByKind: make(map[string]int),
+		EventTypes:   make(map[string]int),
+	}
+	var minTime, maxTime time.Time
+	keys := make(map[string]bool)
+	validator, _ := source.(lineValidator)
+
+	for source.Scan() {
+		line := source.Text()
+		if line == "" {
+			continue
+		}
+		report.Lines++
+
+		var event *Event
+		var err error
+		if validator != nil {
+			err = validator.LineErr()
+		}
+		if err == nil {
+			event, err = ParseEvent(line)
+		}
+		if err != nil {
+			report.Invalid++
+			report.ErrorsByKind[parseErrorKind(err)]++
+			continue
+		}
+		report.Valid++
+		report.EventTypes[event.EventType]++
+
+		if minTime.IsZero() || event.Timestamp.Before(minTime) {
+			minTime = event.Timestamp
+		}
+		if event.Timestamp.After(maxTime) {
+			maxTime = event.Timestamp
+		}
+
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(event.Payload, &fields) == nil {
+			for key := range fields {
+				keys[key] = true
+			}
+		}
+	}
+
+	if err := source.Err(); err != nil {
+		return report, fmt.Errorf("error reading file: %v", err)
+	}
+
+	if report.Valid > 0 {
+		report.MinTimestamp = minTime.Format(time.RFC3339)
+		report.MaxTimestamp = maxTime.Format(time.RFC3339)
+	}
+
+	report.PayloadKeys = make([]string, 0, len(keys))
+	for key := range keys {
+		report.PayloadKeys = append(report.PayloadKeys, key)
+	}
+	sort.Strings(report.PayloadKeys)
+
+	return report, nil
+}
+
+// parseErrorKind classifies a ParseEvent or line reader error by the
+// field that failed
+func parseErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrLineTooLong):
+		return "line_too_long"
+	case errors.Is(err, ErrInvalidUTF8): // before the ErrInvalidFormat it wraps
+		return "bad_utf8"
+	case errors.Is(err, ErrInvalidFormat):
+		return "bad_format"
+	case errors.Is(err, ErrInvalidTimestamp):
+		return "bad_timestamp"
+	case errors.Is(err, ErrInvalidUserID):
+		return "bad_user_id"
+	case errors.Is(err, ErrInvalidEventType):
+		return "empty_event_type"
+	case errors.Is(err, ErrInvalidPayload):
+		return "bad_json"
+	default:
+		return "other"
+	}
+}
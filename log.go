@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Log levels, selected by the global --quiet and --verbose flags
+const (
+	LogQuiet   = iota // errors only
+	LogNormal         // also progress, warnings and timings
+	LogVerbose        // also a line per ingested event
+)
+
+// leveledLogger writes diagnostics to stderr so that stdout carries only
+// command results and stays safe to pipe. Errors are reported by fail.
+type leveledLogger struct {
+	out   io.Writer
+	level int
+}
+
+// logger is shared by the commands and the store
+var logger = &leveledLogger{out: os.Stderr, level: LogNormal}
+
+// enabled reports whether messages of the given level are written
+func (l *leveledLogger) enabled(level int) bool {
+	return l.level >= level
+}
+
+// Infof reports progress and summaries
+func (l *leveledLogger) Infof(format string, args ...interface{}) {
+	if l.enabled(LogNormal) {
+		fmt.Fprintf(l.out, format+"\n", args...)
+	}
+}
+
+// Warnf reports a problem that does not stop the command
+func (l *leveledLogger) Warnf(format string, args ...interface{}) {
+	if l.enabled(LogNormal) {
+		fmt.Fprintf(l.out, "Warning: "+format+"\n", args...)
+	}
+}
+
+// Debugf reports per-event detail
+func (l *leveledLogger) Debugf(format string, args ...interface{}) {
+	if l.enabled(LogVerbose) {
+		fmt.Fprintf(l.out, "Debug: "+format+"\n", args...)
+	}
+}
@@ -1,138 +1,2398 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// Error codes reported by --error-format=json
+const (
+	codeUsage           = "usage"
+	codeInvalidArgument = "invalid_argument"
+	codeInvalidFilter   = "invalid_filter"
+	codeNotFound        = "not_found"
+	codeStoreError      = "store_error"
+	codeTimeout         = "timeout"
+	codeInvalidInput    = "invalid_input"
+)
+
+// Command synopses shared by printUsage and the per-command usage errors
+const (
+	recordUsage      = "eventlog record [--merge-sorted] <file>...|<dir> [--glob=<pattern>] [--replace|--truncate [--confirm]] [--input-format=pipe|csv|json|--parser=<name>] [--delimiter=<sep>] [--empty-payload=null|{}|reject] [--dedupe] [--canonicalize] [--normalize-type] [--no-json-validate] [--sample=<fraction> [--seed=<n>]] [--max-line=<bytes>] [--batch=<n>] [--workers=<n>] [--strict] [--min-time=<ISO8601>] [--max-time=<ISO8601>] [--schema=<file>] [--dry-run] [--follow [--flush-interval=<duration>]] [--journal-mode=<mode>] [--synchronous=<level>] [--cache-size=<n>] [--mmap-size=<bytes>] [--compress-payload] [--timeout=<duration>] [--errors-file=<path>] [--no-checkpoint]"
+	queryUsage       = "eventlog query <user-id>|--all-users|--user-from=<id> --user-to=<id> [--type=<type>[,<type>...]] [--from=<ISO8601>|--since=<duration>] [--to=<ISO8601>|--until=<duration>] [--ingested-from=<ISO8601>] [--ingested-to=<ISO8601>] [--limit=<n>] [--offset=<n>] [--order=asc|desc] [--sort-payload=<key> [--sort-dir=asc|desc] [--sort-numeric]] [--dedupe-window=<duration>] [--where-payload=<key><op><value>]... [--has-key=<key>]... [--missing-key=<key>]... [--format=text|json|csv] [--flatten] [--pretty] [--expand-payload=<key>[,<key>...]] [--explode=<key>[,<key>...]] [--fields=<field>[,<field>...]] [--show-id] [--show-ingested] [--number] [--id=<n>|--id-range=<a>-<b>] [--sample=<fraction> [--seed=<n>]] [--template=<template>] [--buffer-size=<bytes>] [--stats-json] [--count] [--distinct-types] [--explain] [--tz=<zone>] [--timeout=<duration>] [--read-write]"
+	statsUsage       = "eventlog stats [--use-summary] [--format=text|json|prometheus]"
+	cardinalityUsage = "eventlog cardinality --field=payload.<key> [--type=<type>[,<type>...]] [--from=<ISO8601>] [--to=<ISO8601>] [--approx]"
+	lintUsage        = "eventlog lint <file> [--format=text|json]"
+	validateUsage    = "eventlog validate <file>|- [--max-errors=<n>] [--input-format=pipe|csv|json] [--delimiter=<sep>] [--empty-payload=null|{}|reject] [--max-line=<bytes>] [--min-time=<ISO8601>] [--max-time=<ISO8601>] [--schema=<file>] [--format=text|json]"
+	deleteUsage      = "eventlog delete <user-id> [--type=<type>[,<type>...]] [--from=<ISO8601>] [--to=<ISO8601>] [--confirm]"
+	aggregateUsage   = "eventlog aggregate <user-id> [--from=<ISO8601>] [--to=<ISO8601>] [--tz=<zone>] [--use-summary] [--format=text|json]"
+	diffUsage        = "eventlog diff [--a-user=<user-id>] [--b-user=<user-id>] [--a-from=<ISO8601>] [--a-to=<ISO8601>] [--b-from=<ISO8601>] [--b-to=<ISO8601>] [--tz=<zone>] [--format=text|json]"
+	histogramUsage   = "eventlog histogram <user-id>|--all-users [--bucket=minute|hour|day] [--type=<type>[,<type>...]] [--from=<ISO8601>] [--to=<ISO8601>] [--where-payload=<key><op><value>]... [--format=text|json]"
+	topUsersUsage    = "eventlog top-users [--limit=<n>] [--type=<type>[,<type>...]] [--from=<ISO8601>|--since=<duration>] [--to=<ISO8601>|--until=<duration>] [--format=text|json]"
+	duplicatesUsage  = "eventlog find-duplicates [--limit=<n>] [--format=text|json]"
+	recentUsage      = "eventlog recent <user-id> [--limit=<n>] [--chronological] [--format=text|json|csv] [--tz=<zone>]"
+	userRangeUsage   = "eventlog user-range <user-id>|--all-users [--limit=<n>] [--format=text|json]"
+	mergeUsage       = "eventlog merge --from=<other.db> [--dedupe]"
+	replayUsage      = "eventlog replay <user-id>|--all-users [--speed=<factor>] [--type=<type>[,<type>...]] [--from=<ISO8601>|--since=<duration>] [--to=<ISO8601>|--until=<duration>] [--limit=<n>] [--format=text|json|csv] [--tz=<zone>]"
+	summaryUsage     = "eventlog rebuild-summary [--drop]"
+	checkpointUsage  = "eventlog checkpoint [--format=text|json]"
+	checkUsage       = "eventlog check [--format=text|json]"
+	benchUsage       = "eventlog bench [--events=<n>] [--seed=<n>] [--runs=<n>] [--batch=<n>] [--workers=<n>] [--journal-mode=<mode>] [--synchronous=<level>] [--cache-size=<n>] [--mmap-size=<bytes>] [--compress-payload] [--format=text|json]"
+	purgeUsage       = "eventlog purge --older-than=<duration> [--dry-run]"
+	shellUsage       = "eventlog shell"
+	schemaUsage      = "eventlog schema"
+	exportUsage      = "eventlog export <user-id> [--type=<type>[,<type>...]] [--from=<ISO8601>] [--to=<ISO8601>] [--where-payload=<key><op><value>]... [--delimiter=<sep>] [--tz=<zone>] [--out=<file>]"
+)
+
+// defaultDBPath is used when neither --db nor EVENTLOG_DB is set
+const defaultDBPath = "events.db"
+
+// errorFormat selects how command failures are reported: "text" or "json"
+var errorFormat = "text"
+
+// busyTimeout is how long commands wait for another process's lock, set by
+// --busy-timeout
+var busyTimeout = DefaultBusyTimeout
+
 func main() {
-	if len(os.Args) < 2 {
+	globalFlags := flag.NewFlagSet("eventlog", flag.ExitOnError)
+	globalFlags.Usage = printUsage
+	globalFlags.StringVar(&errorFormat, "error-format", "text", "Error output format: text or json")
+	dbPath := globalFlags.String("db", "", "Path to the SQLite database (default $EVENTLOG_DB or "+defaultDBPath+")")
+	quiet := globalFlags.Bool("quiet", false, "Report only errors on stderr, no progress, warnings or timings")
+	verbose := globalFlags.Bool("verbose", false, "Also report every ingested event on stderr")
+	globalFlags.DurationVar(&busyTimeout, "busy-timeout", DefaultBusyTimeout, "How long to wait for another process writing to the database before failing")
+	globalFlags.Parse(os.Args[1:])
+
+	switch {
+	case *quiet && *verbose:
+		fail(codeInvalidArgument, "--quiet and --verbose cannot be combined")
+	case *quiet:
+		logger.level = LogQuiet
+	case *verbose:
+		logger.level = LogVerbose
+	}
+
+	if errorFormat != "text" && errorFormat != "json" {
+		requested := errorFormat
+		errorFormat = "text"
+		fail(codeInvalidArgument, "unknown error format %q (expected text or json)", requested)
+	}
+	if busyTimeout <= 0 {
+		fail(codeInvalidArgument, "--busy-timeout must be positive, got %v", busyTimeout)
+	}
+
+	args := globalFlags.Args()
+	if len(args) < 1 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	command := os.Args[1]
+	if *dbPath == "" {
+		*dbPath = os.Getenv("EVENTLOG_DB")
+	}
+	if *dbPath == "" {
+		*dbPath = defaultDBPath
+	}
+	paths, err := databasePaths(*dbPath)
+	if err != nil {
+		fail(codeNotFound, "%v", err)
+	}
+	if len(paths) == 1 {
+		*dbPath = paths[0]
+	} else if args[0] != "query" {
+		fail(codeInvalidArgument, "only query can read several databases at once")
+	}
+
+	runCommand(*dbPath, args)
+}
+
+// runCommand dispatches args, a command name and its arguments, to the
+// command's handler
+func runCommand(dbPath string, args []string) {
+	command := args[0]
 	
 	switch command {
 	case "record":
-		handleRecord(os.Args[2:])
+		handleRecord(dbPath, args[1:])
 	case "query":
-		handleQuery(os.Args[2:])
+		handleQuery(dbPath, args[1:])
+	case "stats":
+		handleStats(dbPath, args[1:])
+	case "cardinality":
+		handleCardinality(dbPath, args[1:])
+	case "lint":
+		handleLint(args[1:])
+	case "validate":
+		handleValidate(args[1:])
+	case "schema":
+		handleSchema(args[1:])
+	case "aggregate":
+		handleAggregate(dbPath, args[1:])
+	case "diff":
+		handleDiff(dbPath, args[1:])
+	case "delete":
+		handleDelete(dbPath, args[1:])
+	case "histogram":
+		handleHistogram(dbPath, args[1:])
+	case "top-users":
+		handleTopUsers(dbPath, args[1:])
+	case "find-duplicates":
+		handleFindDuplicates(dbPath, args[1:])
+	case "recent":
+		handleRecent(dbPath, args[1:])
+	case "user-range":
+		handleUserRange(dbPath, args[1:])
+	case "checkpoint":
+		handleCheckpoint(dbPath, args[1:])
+	case "check":
+		handleCheck(dbPath, args[1:])
+	case "purge":
+		handlePurge(dbPath, args[1:])
+	case "merge":
+		handleMerge(dbPath, args[1:])
+	case "rebuild-summary":
+		handleRebuildSummary(dbPath, args[1:])
+	case "export":
+		handleExport(dbPath, args[1:])
+	case "replay":
+		handleReplay(dbPath, args[1:])
+	case "shell":
+		handleShell(dbPath, args[1:])
+	case "bench":
+		handleBench(args[1:])
 	default:
-		fmt.Printf("Unknown command: %s\n", command)
+		if errorFormat == "json" {
+			fail(codeUsage, "unknown command: %s", command)
+		}
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
 		printUsage()
-		os.Exit(1)
+		exit(1)
 	}
 }
 
-func handleRecord(args []string) {
-	if len(args) < 1 {
-		fmt.Println("Usage: eventlog record <file>")
-		os.Exit(1)
+func handleRecord(dbPath string, args []string) {
+	flagSet := newFlagSet("record")
+	replace := flagSet.Bool("replace", false, "Delete all existing events before ingesting")
+	truncate := flagSet.Bool("truncate", false, "Same as --replace")
+	confirm := flagSet.Bool("confirm", false, "Confirm --replace or --truncate when the database already holds events")
+	mergeSorted := flagSet.Bool("merge-sorted", false, "Merge several time-sorted files into global timestamp order")
+	batch := flagSet.Int("batch", DefaultBatchSize, "Events per transaction; progress is printed after each batch")
+	strict := flagSet.Bool("strict", false, "Fail on the first invalid line instead of skipping it")
+	dedupe := flagSet.Bool("dedupe", false, "Add a unique index if missing and skip events that are already stored")
+	follow := flagSet.Bool("follow", false, "Keep watching the file for appended events until interrupted")
+	flushInterval := flagSet.Duration("flush-interval", DefaultFollowFlushInterval, "With --follow, commit partial batches this often")
+	workers := flagSet.Int("workers", runtime.NumCPU(), "Number of goroutines parsing lines in parallel")
+	minTimeStr := flagSet.String("min-time", "", "Skip events before this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	maxTimeStr := flagSet.String("max-time", "", "Skip events after this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	delimiter := flagSet.String("delimiter", DefaultDelimiter, `Field separator of pipe-format lines (\t for tab)`)
+	emptyPayload := flagSet.String("empty-payload", EmptyPayloadNull, "Store empty payloads as null or {}, or reject them")
+	maxLine := flagSet.Int("max-line", DefaultMaxLineSize, "Longest accepted line in bytes; longer lines are skipped")
+	inputFormat := flagSet.String("input-format", InputFormatPipe, "Input format: pipe, csv (timestamp,user_id,event_type,payload) or json (one event object per line)")
+	parserName := flagSet.String("parser", "", "Parse each line with this registered parser ("+strings.Join(lineParserNames(), ", ")+") instead of --input-format")
+	schemaPath := flagSet.String("schema", "", "JSON file mapping event types to required payload keys and kinds")
+	dryRun := flagSet.Bool("dry-run", false, "Parse and check the input and report what would be recorded, without opening the database")
+	glob := flagSet.String("glob", "*", "When recording a directory, the file name pattern to ingest (e.g. '*.log*')")
+	timeout := flagSet.Duration("timeout", 0, "Give up after this long, keeping the batches already committed (0 for no limit)")
+	canonicalize := flagSet.Bool("canonicalize", false, "Store payloads with sorted keys and no extra whitespace, so identical objects dedupe")
+	normalizeType := flagSet.Bool("normalize-type", false, "Trim and lowercase event types, so Login and LOGIN are one type; the database keeps doing so")
+	noJSONValidate := flagSet.Bool("no-json-validate", false, "Store pipe-format payloads as given, without checking that they are JSON")
+	sample := flagSet.Float64("sample", 1, "Record roughly this fraction (0-1] of the valid events, for quick approximate runs")
+	seed := flagSet.Int64("seed", 0, "Seed for --sample, making the sample reproducible (random when unset)")
+	noCheckpoint := flagSet.Bool("no-checkpoint", false, "Leave the WAL as it is after recording instead of checkpointing and truncating it")
+	errorsFile := flagSet.String("errors-file", "", "Write skipped lines, with their line number and reason, to this file as JSON lines instead of warning about them")
+
+	defaults := DefaultStoreConfig()
+	journalMode := flagSet.String("journal-mode", defaults.JournalMode, "SQLite journal mode (DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF)")
+	synchronous := flagSet.String("synchronous", defaults.Synchronous, "SQLite synchronous level (OFF, NORMAL, FULL, EXTRA)")
+	cacheSize := flagSet.Int("cache-size", defaults.CacheSize, "SQLite page cache size (pages, or KiB if negative)")
+	mmapSize := flagSet.Int64("mmap-size", defaults.MmapSize, "Bytes of memory-mapped I/O (0 disables)")
+	compress := flagSet.Bool("compress-payload", false, "Store payloads compressed; they are decompressed transparently on read")
+
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) < 1 || (len(positional) > 1 && !*mergeSorted) {
+		usage(recordUsage)
 	}
-	
-	filename := args[0]
-	
-	// Check if file exists
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		fmt.Printf("Error: File %s does not exist\n", filename)
-		os.Exit(1)
+
+	if *batch < 1 {
+		fail(codeInvalidArgument, "batch size must be at least 1, got %d", *batch)
+	}
+	if *workers < 1 {
+		fail(codeInvalidArgument, "workers must be at least 1, got %d", *workers)
+	}
+	if *maxLine < 1 {
+		fail(codeInvalidArgument, "max line must be at least 1, got %d", *maxLine)
+	}
+	if *follow && *mergeSorted {
+		fail(codeInvalidArgument, "--follow cannot be combined with --merge-sorted")
+	}
+	if *truncate {
+		*replace = true
+	}
+	if *dryRun && (*follow || *replace) {
+		fail(codeInvalidArgument, "--dry-run cannot be combined with --follow, --replace or --truncate")
+	}
+	if *flushInterval <= 0 {
+		fail(codeInvalidArgument, "flush interval must be positive, got %v", *flushInterval)
+	}
+	if *timeout < 0 {
+		fail(codeInvalidArgument, "timeout cannot be negative, got %v", *timeout)
+	}
+	if *timeout > 0 && (*follow || *mergeSorted) {
+		fail(codeInvalidArgument, "--timeout cannot be combined with --follow or --merge-sorted")
+	}
+	opts := RecordOptions{
+		BatchSize:   *batch,
+		Strict:      *strict,
+		Dedupe:      *dedupe,
+		InputFormat: *inputFormat,
+		Parser:      *parserName,
+		Workers:     *workers,
+		Delimiter:   parseDelimiter(*delimiter),
+
+		EmptyPayload: *emptyPayload,
+		MaxLineSize:  *maxLine,
+		DryRun:       *dryRun,
+		Canonicalize: *canonicalize,
+
+		NormalizeType:  *normalizeType,
+		NoJSONValidate: *noJSONValidate,
+	}
+	opts.Sample, opts.Seed = parseSample(flagSet, *sample, *seed)
+	parseTimeBounds(&opts, *minTimeStr, *maxTimeStr)
+	opts.Schema = loadSchemaFlag(*schemaPath)
+	if err := opts.Validate(); err != nil {
+		fail(codeInvalidArgument, "%v", err)
+	}
+	if opts.InputFormat == InputFormatCSV && (*follow || *mergeSorted) {
+		fail(codeInvalidArgument, "--input-format=csv cannot be combined with --follow or --merge-sorted")
+	}
+	if opts.InputFormat == InputFormatJSON && *mergeSorted {
+		fail(codeInvalidArgument, "--input-format=json cannot be combined with --merge-sorted")
+	}
+	if opts.Parser != "" && opts.Parser != InputFormatPipe && *mergeSorted {
+		fail(codeInvalidArgument, "--parser=%s cannot be combined with --merge-sorted", opts.Parser)
+	}
+
+	// A directory stands for the files in it matching --glob
+	fromDir := ""
+	if len(positional) == 1 && positional[0] != "-" {
+		if info, err := os.Stat(positional[0]); err == nil && info.IsDir() {
+			if *follow {
+				fail(codeInvalidArgument, "--follow needs a file, not a directory")
+			}
+			files, err := listDirFiles(positional[0], *glob)
+			if err != nil {
+				fail(codeInvalidArgument, "listing %s: %v", positional[0], err)
+			}
+			if len(files) == 0 {
+				fail(codeNotFound, "no files matching %s in %s", *glob, positional[0])
+			}
+			fromDir = positional[0]
+			positional = files
+		}
+	}
+
+	// Check if files exist; "-" reads stdin
+	for _, filename := range positional {
+		if filename == "-" {
+			if *follow || *mergeSorted {
+				fail(codeInvalidArgument, "stdin cannot be combined with --follow or --merge-sorted")
+			}
+			continue
+		}
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			fail(codeNotFound, "file %s does not exist", filename)
+		}
 	}
-	
-	fmt.Printf("Recording events from %s...\n", filename)
 	
 	// Initialize store
-	store, err := NewEventStore("events.db")
-	if err != nil {
-		fmt.Printf("Error initializing store: %v\n", err)
-		os.Exit(1)
+	config := storeConfig()
+	config.JournalMode = *journalMode
+	config.Synchronous = *synchronous
+	config.CacheSize = *cacheSize
+	config.MmapSize = *mmapSize
+	config.CompressPayload = *compress
+	var err error
+	store := &EventStore{} // a dry run never opens the database
+	if !opts.DryRun && shellStore != nil && dbPath == MemoryDBPath {
+		// A second connection would open a separate, empty database, so
+		// record into the shell's store with the settings it was opened with
+		flagSet.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "journal-mode", "synchronous", "cache-size", "mmap-size", "compress-payload":
+				fail(codeInvalidArgument, "--%s cannot be changed for an in-memory database", f.Name)
+			}
+		})
+		store = shellStore
+	} else if !opts.DryRun {
+		store, err = NewEventStoreWithConfig(dbPath, config)
+		if err != nil {
+			failOn(err, "initializing store")
+		}
+		defer store.Close()
+	}
+
+	if *replace {
+		existing, err := store.EventCount()
+		if err != nil {
+			failOn(err, "reading store")
+		}
+		if existing > 0 && !*confirm {
+			fail(codeInvalidArgument, "database already holds %d events; pass --confirm to replace them", existing)
+		}
+
+		removed, err := store.Truncate()
+		if err != nil {
+			failOn(err, "replacing events")
+		}
+		logger.Infof("Removed %d existing events", removed)
+	}
+
+	source := strings.Join(positional, ", ")
+	if source == "-" {
+		source = "stdin"
+	}
+	if fromDir != "" {
+		source = fmt.Sprintf("%d files in %s", len(positional), fromDir)
+	}
+	logger.Infof("Recording events from %s...", source)
+
+	if *errorsFile != "" {
+		rejects, err := os.Create(*errorsFile)
+		if err != nil {
+			fail(codeInvalidArgument, "creating errors file: %v", err)
+		}
+		defer rejects.Close()
+		opts.Rejects = rejects
 	}
-	defer store.Close()
 	
+	// Ctrl-C stops recording; the open batch is committed on the way out. A
+	// second Ctrl-C kills the process as usual.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupts:
+			close(stop)
+		case <-done:
+		}
+		signal.Stop(interrupts)
+	}()
+	interrupted := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	}
+
 	// Record events
+	ctx, cancel := withTimeout(*timeout)
+	defer cancel()
 	start := time.Now()
-	count, err := store.Record(filename)
+	var count, skipped int
+	if *follow {
+		opts.FlushInterval = *flushInterval
+		logger.Infof("Following; press Ctrl-C to stop")
+		count, skipped, err = store.Follow(positional[0], opts, stop)
+	} else if *mergeSorted {
+		opts.Stop = stop
+		count, skipped, err = store.RecordMerged(positional, opts)
+	} else if fromDir != "" {
+		// One store session for every file, reporting each as it completes
+		opts.Stop = stop
+		for _, filename := range positional {
+			if interrupted() {
+				break
+			}
+			recorded, invalid, fileErr := store.RecordContext(ctx, filename, opts)
+			count += recorded
+			skipped += invalid
+			if fileErr != nil {
+				err = fmt.Errorf("%s: %w", filename, fileErr)
+				break
+			}
+			logger.Infof("%s: recorded %d events, skipped %d invalid lines", filename, recorded, invalid)
+		}
+	} else {
+		opts.Stop = stop
+		count, skipped, err = store.RecordContext(ctx, positional[0], opts)
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		fail(codeTimeout, "recording timed out after %v; %d events were committed", *timeout, count)
+	}
 	if err != nil {
-		fmt.Printf("Error recording events: %v\n", err)
-		os.Exit(1)
+		failOn(err, "recording events")
 	}
 	
 	duration := time.Since(start)
-	fmt.Printf("Successfully recorded %d events in %v\n", count, duration)
-}
-
-func handleQuery(args []string) {
-	if len(args) < 1 {
-		fmt.Println("Usage: eventlog query <user-id> [--type=<event-type>] [--from=<ISO8601>] [--to=<ISO8601>]")
-		os.Exit(1)
+	if interrupted() && !*follow {
+		fmt.Printf("Interrupted: %d events committed, skipped %d invalid lines in %v; the rest of the input was not recorded\n", count, skipped, duration)
+		exit(130) // the shell convention for death by SIGINT
 	}
-	
-	userID, err := strconv.ParseInt(args[0], 10, 64)
-	if err != nil {
-		fmt.Printf("Error: Invalid user ID: %s\n", args[0])
-		os.Exit(1)
+	if *errorsFile != "" && skipped > 0 {
+		logger.Infof("Wrote %d skipped lines to %s", skipped, *errorsFile)
 	}
-	
+	if opts.DryRun {
+		fmt.Printf("Dry run: would record %d events, skipped %d invalid lines in %v\n", count, skipped, duration)
+		return
+	}
+	if !*noCheckpoint {
+		// The events are committed either way, so a failed checkpoint
+		// only warrants a warning
+		if result, err := store.Checkpoint(); err != nil {
+			logger.Warnf("checkpointing the WAL: %v", err)
+		} else {
+			logCheckpoint(result)
+		}
+	}
+	fmt.Printf("Successfully recorded %d events, skipped %d invalid lines in %v\n", count, skipped, duration)
+}
+
+func handleQuery(dbPath string, args []string) {
 	// Parse flags
-	flagSet := flag.NewFlagSet("query", flag.ExitOnError)
-	eventType := flagSet.String("type", "", "Filter by event type")
-	fromStr := flagSet.String("from", "", "Filter events from this time (ISO8601)")
-	toStr := flagSet.String("to", "", "Filter events to this time (ISO8601)")
+	flagSet := newFlagSet("query")
+	allUsers := flagSet.Bool("all-users", false, "Query every user instead of one (requires --from/--to or --limit unless counting)")
+	userFrom := flagSet.String("user-from", "", "Query the users from this ID through --user-to instead of one")
+	userTo := flagSet.String("user-to", "", "Last user ID of the --user-from range (inclusive)")
+	eventType := flagSet.String("type", "", "Filter by event type (comma-separated for several)")
+	fromStr := flagSet.String("from", "", "Filter events from this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	toStr := flagSet.String("to", "", "Filter events to this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	limit := flagSet.Int("limit", 0, "Maximum number of events to return (0 for no limit)")
+	offset := flagSet.Int("offset", 0, "Number of matching events to skip")
+	order := flagSet.String("order", OrderAsc, "Sort by timestamp, ties by ID: asc or desc")
+	format := flagSet.String("format", FormatText, "Output format: text, json or csv")
+	sortPayload := flagSet.String("sort-payload", "", "Order events by this payload key first, then by timestamp; events lacking it come last")
+	sortDir := flagSet.String("sort-dir", "", "Direction of the payload sort: asc (default) or desc")
+	sortNumeric := flagSet.Bool("sort-numeric", false, "Compare payload sort values as numbers, so \"10\" sorts after \"9\"")
+	flatten := flagSet.Bool("flatten", false, "Merge payload keys into the top-level JSON object (json format only)")
+	pretty := flagSet.Bool("pretty", false, "Indent JSON output for reading (json format only)")
+	fields := flagSet.String("fields", "", "Print only these fields, in order (comma-separated: id, timestamp, user_id, event_type, payload, payload.<key>)")
+	explode := flagSet.String("explode", "", "Add these payload keys as CSV columns after the payload (comma-separated, csv format only)")
+	expandPayload := flagSet.String("expand-payload", "", "Print these payload keys as key=value columns instead of the payload (comma-separated, text format only)")
+	dedupeWindow := flagSet.Duration("dedupe-window", 0, "Suppress repeats of the same type and payload within this window (e.g. 1s); --limit and --offset count what remains")
+	countOnly := flagSet.Bool("count", false, "Print only the number of matching events")
+	distinctTypes := flagSet.Bool("distinct-types", false, "List the event types present instead of events")
+	explain := flagSet.Bool("explain", false, "Print SQLite's query plan instead of running the query")
+	timeZone := flagSet.String("tz", "UTC", "IANA time zone for --from/--to values without an offset and for printed timestamps")
+	since := flagSet.String("since", "", "Filter events from this long ago, such as 30m or 2d (instead of --from)")
+	until := flagSet.String("until", "", "Filter events to this long ago, such as 5m (instead of --to)")
+	timeout := flagSet.Duration("timeout", 0, "Give up on the query after this long (0 for no limit)")
+	eventID := flagSet.Int64("id", 0, "Return only the event with this ID")
+	idRange := flagSet.String("id-range", "", "Return only events with IDs in this inclusive range, such as 100-200")
+	sample := flagSet.Float64("sample", 1, "Return roughly this fraction (0-1] of the matching events, for quick approximate answers")
+	seed := flagSet.Int64("seed", 0, "Seed for --sample, making the sample reproducible (random when unset)")
+	showID := flagSet.Bool("show-id", false, "Include each event's ID in the output")
+	showIngested := flagSet.Bool("show-ingested", false, "Include when each event was recorded in the output")
+	ingestedFromStr := flagSet.String("ingested-from", "", "Filter events recorded from this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	ingestedToStr := flagSet.String("ingested-to", "", "Filter events recorded up to this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	tmpl := flagSet.String("template", "", "Go text/template rendering each event, with .Timestamp, .UserID, .EventType and .Payload")
+	number := flagSet.Bool("number", false, "Prefix each event with its 1-based position in the results, counting --offset")
+	statsJSON := flagSet.Bool("stats-json", false, "Report the event count, duration, filters and indexes used as a JSON object on stderr")
+	readWrite := flagSet.Bool("read-write", false, "Open the database for writing even when it could be opened read-only")
+	bufferSize := flagSet.Int("buffer-size", DefaultOutputBufferSize, "Bytes of output collected before each write (1 writes every event as it comes)")
+	var wherePayload, hasKeys, missingKeys stringListFlag
+	flagSet.Var(&wherePayload, "where-payload", "Payload condition such as price>50 or ip=10.0.0.1 (repeatable)")
+	flagSet.Var(&hasKeys, "has-key", "Only events whose payload has this key, whatever its value (repeatable)")
+	flagSet.Var(&missingKeys, "missing-key", "Only events whose payload lacks this key (repeatable)")
 	
-	flagSet.Parse(args[1:])
+	positional := parseInterspersed(flagSet, args)
+	userRange := *userFrom != "" || *userTo != ""
+	var userID int64
+	switch {
+	case *allUsers && !userRange && len(positional) == 0:
+	case userRange && !*allUsers && len(positional) == 0:
+	case !*allUsers && !userRange && len(positional) == 1:
+		var err error
+		userID, err = strconv.ParseInt(positional[0], 10, 64)
+		if err != nil {
+			fail(codeInvalidArgument, "invalid user ID: %s", positional[0])
+		}
+	default:
+		usage(queryUsage)
+	}
 	
 	filters := QueryFilters{
-		EventType: *eventType,
+		EventTypes: parseEventTypes(*eventType),
+		Limit:      *limit,
+		Offset:     *offset,
+		Order:      *order,
+		AllUsers:   *allUsers,
+
+		DedupeWindow: *dedupeWindow,
+		ID:           *eventID,
+		HasKeys:      hasKeys,
+		MissingKeys:  missingKeys,
+		SortPayload:  *sortPayload,
+		SortDir:      *sortDir,
+		SortNumeric:  *sortNumeric,
 	}
+	parsePayloadConditions(&filters, wherePayload)
+	parseIDRange(&filters, *idRange)
+	parseUserRange(&filters, *userFrom, *userTo)
+	filters.Sample, filters.Seed = parseSample(flagSet, *sample, *seed)
+	
+	location := loadTimeZone(*timeZone)
+	parseTimeFiltersIn(&filters, *fromStr, *toStr, location)
+	parseRelativeTimeFilters(&filters, *since, *until, *fromStr != "", *toStr != "")
+	parseIngestedFilters(&filters, *ingestedFromStr, *ingestedToStr, location)
 	
-	// Parse time filters
-	if *fromStr != "" {
-		filters.From, err = time.Parse(time.RFC3339, *fromStr)
+	if err := filters.Validate(); err != nil {
+		fail(codeInvalidFilter, "invalid filters: %v", err)
+	}
+
+	output := OutputOptions{
+		Format:   *format,
+		Flatten:  *flatten,
+		Location: location,
+		Template: *tmpl,
+		ShowID:   *showID,
+		Pretty:   *pretty,
+
+		BufferSize:   *bufferSize,
+		Number:       *number,
+		ShowIngested: *showIngested,
+	}
+	if *bufferSize < 1 {
+		fail(codeInvalidArgument, "--buffer-size must be at least 1, got %d", *bufferSize)
+	}
+	if *expandPayload != "" {
+		output.ExpandPayload = strings.Split(*expandPayload, ",")
+	}
+	if *fields != "" {
+		output.Fields = strings.Split(*fields, ",")
+	}
+	if *explode != "" {
+		output.Explode = strings.Split(*explode, ",")
+	}
+	if err := output.Validate(); err != nil {
+		fail(codeInvalidArgument, "%v", err)
+	}
+	if *timeout < 0 {
+		fail(codeInvalidArgument, "timeout cannot be negative, got %v", *timeout)
+	}
+	if *statsJSON && (*countOnly || *distinctTypes || *explain) {
+		fail(codeInvalidArgument, "--stats-json cannot be combined with --count, --distinct-types or --explain")
+	}
+	if *timeout > 0 && (*countOnly || *distinctTypes || *explain) {
+		fail(codeInvalidArgument, "--timeout cannot be combined with --count, --distinct-types or --explain")
+	}
+	if filters.AllUsers && !*countOnly && !*distinctTypes && !*explain && !filters.bounded() {
+		fail(codeInvalidFilter, "--all-users needs --from/--to, --id/--id-range or --limit to avoid dumping the whole database")
+	}
+
+	// Initialize store; several databases in --db are queried as one. main
+	// has already checked the paths.
+	paths, _ := databasePaths(dbPath)
+	config := storeConfig()
+	config.ReadOnly = !*readWrite && canQueryReadOnly(paths)
+	var store *EventStore
+	var querier eventQuerier
+	if len(paths) > 1 {
+		if *explain || *distinctTypes {
+			fail(codeInvalidArgument, "--explain and --distinct-types need a single database")
+		}
+		shards, err := OpenMultiStore(paths, config)
 		if err != nil {
-			fmt.Printf("Error: Invalid from time format: %s\n", *fromStr)
-			os.Exit(1)
+			failOn(err, "initializing store")
+		}
+		defer shards.Close()
+		if err := shards.validate(filters, output); err != nil {
+			fail(codeInvalidArgument, "%v", err)
 		}
+		querier = shards
+	} else {
+		var release func()
+		store, release = openStoreWithConfig(dbPath, config)
+		defer release()
+		querier = store
 	}
 	
-	if *toStr != "" {
-		filters.To, err = time.Parse(time.RFC3339, *toStr)
+	if *explain {
+		plan, err := store.ExplainQuery(userID, filters)
 		if err != nil {
-			fmt.Printf("Error: Invalid to time format: %s\n", *toStr)
-			os.Exit(1)
+			failOn(err, "explaining query")
 		}
+		fmt.Print(plan)
+		return
 	}
-	
-	// Initialize store
-	store, err := NewEventStore("events.db")
-	if err != nil {
-		fmt.Printf("Error initializing store: %v\n", err)
-		os.Exit(1)
+
+	if *distinctTypes {
+		if filters.UserRange {
+			fail(codeInvalidArgument, "--distinct-types cannot be combined with --user-from/--user-to")
+		}
+		var types []string
+		var err error
+		if filters.AllUsers {
+			types, err = store.AllDistinctEventTypes()
+		} else {
+			types, err = store.DistinctEventTypes(userID)
+		}
+		if err != nil {
+			failOn(err, "listing event types")
+		}
+		for _, eventType := range types {
+			fmt.Println(eventType)
+		}
+		return
 	}
-	defer store.Close()
-	
+
+	if *countOnly {
+		if filters.DedupeWindow > 0 {
+			fail(codeInvalidArgument, "--count cannot be combined with --dedupe-window")
+		}
+		count, err := querier.Count(userID, filters)
+		if err != nil {
+			failOn(err, "counting events")
+		}
+		fmt.Println(count)
+		return
+	}
+
 	// Query events
+	ctx, cancel := withTimeout(*timeout)
+	defer cancel()
 	start := time.Now()
-	count, err := store.Query(userID, filters)
+	count, err := querier.QueryContext(ctx, userID, filters, output, os.Stdout)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		fail(codeTimeout, "query timed out after %v (%d events written)", *timeout, count)
+	}
 	if err != nil {
-		fmt.Printf("Error querying events: %v\n", err)
-		os.Exit(1)
+		failOn(err, "querying events")
 	}
 	
 	duration := time.Since(start)
-	fmt.Fprintf(os.Stderr, "Query completed: %d events in %v\n", count, duration)
+	if !*statsJSON {
+		logger.Infof("Query completed: %d events in %v", count, duration)
+		return
+	}
+
+	// Shards share the schema, so the first one's plan stands for all
+	planStore := store
+	if shards, ok := querier.(*MultiStore); ok {
+		planStore = shards.stores[0]
+	}
+	plan, err := planStore.ExplainQuery(userID, filters)
+	if err != nil {
+		failOn(err, "explaining query")
+	}
+	indexes := planIndexes(plan)
+	stats, err := json.Marshal(queryStats{
+		Count:      count,
+		DurationMS: float64(duration) / float64(time.Millisecond),
+		Filters:    filters.describe(userID),
+		IndexUsed:  len(indexes) > 0,
+		Indexes:    indexes,
+	})
+	if err != nil {
+		failOn(err, "encoding query stats")
+	}
+	fmt.Fprintln(os.Stderr, string(stats))
 }
 
-func printUsage() {
-	fmt.Println("Usage:")
-	fmt.Println("  eventlog record <file>")
-	fmt.Println("  eventlog query <user-id> [--type=<event-type>] [--from=<ISO8601>] [--to=<ISO8601>]")
-	fmt.Println()
-	fmt.Println("Examples:")
-	fmt.Println("  eventlog record events.txt")
-	fmt.Println("  eventlog query 42")
-	fmt.Println("  eventlog query 42 --type=login")
-	fmt.Println("  eventlog query 42 --from=2023-08-14T12:00:00Z --to=2023-08-14T13:00:00Z")
+// queryStats is the report query --stats-json writes to stderr
+type queryStats struct {
+	Count      int                    `json:"count"`
+	DurationMS float64                `json:"duration_ms"`
+	Filters    map[string]interface{} `json:"filters"`
+	IndexUsed  bool                   `json:"index_used"`
+	Indexes    []string               `json:"indexes"`
+}
+
+// planIndexUse matches the steps of a query plan that read an index
+var planIndexUse = regexp.MustCompile(`USING (?:COVERING )?INDEX (\w+)|USING INTEGER PRIMARY KEY`)
+
+// planIndexes returns the indexes a query plan from ExplainQuery reads, in
+// order of first use; "rowid" stands for lookups by event ID
+func planIndexes(plan string) []string {
+	indexes := []string{}
+	seen := make(map[string]bool)
+	for _, match := range planIndexUse.FindAllStringSubmatch(plan, -1) {
+		index := match[1]
+		if index == "" {
+			index = "rowid"
+		}
+		if !seen[index] {
+			seen[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+func handlePurge(dbPath string, args []string) {
+	flagSet := newFlagSet("purge")
+	olderThan := flagSet.String("older-than", "", "Delete events older than this age, e.g. 90d or 720h")
+	dryRun := flagSet.Bool("dry-run", false, "Only report how many events would be removed")
+
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 0 || *olderThan == "" {
+		usage(purgeUsage)
+	}
+
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		fail(codeInvalidArgument, "invalid --older-than: %v", err)
+	}
+	cutoff := time.Now().UTC().Add(-age)
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	if *dryRun {
+		count, err := store.CountOlderThan(cutoff)
+		if err != nil {
+			failOn(err, "counting events")
+		}
+		fmt.Printf("Would purge %d events older than %s\n", count, cutoff.Format(time.RFC3339))
+		return
+	}
+
+	removed, err := store.PurgeOlderThan(cutoff)
+	if err != nil {
+		failOn(err, "purging events")
+	}
+	fmt.Printf("Purged %d events older than %s\n", removed, cutoff.Format(time.RFC3339))
+	if removed > 0 {
+		logger.Infof("Run VACUUM (sqlite3 %s 'VACUUM') to reclaim the disk space", dbPath)
+	}
+}
+
+func handleMerge(dbPath string, args []string) {
+	flagSet := newFlagSet("merge")
+	from := flagSet.String("from", "", "Event database to copy events from")
+	dedupe := flagSet.Bool("dedupe", false, "Add a unique index if missing and skip events that are already stored")
+	positional := parseInterspersed(flagSet, args)
+
+	if *from == "" || len(positional) > 0 {
+		usage(mergeUsage)
+	}
+	if _, err := os.Stat(*from); os.IsNotExist(err) {
+		fail(codeNotFound, "database %s does not exist", *from)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	if *dedupe {
+		if err := store.CreateDedupeIndex(); err != nil {
+			failOn(err, "creating dedupe index")
+		}
+	}
+
+	start := time.Now()
+	merged, err := store.MergeFrom(*from)
+	if err != nil {
+		failOn(err, "merging events")
+	}
+	fmt.Printf("Merged %d events from %s in %v\n", merged, *from, time.Since(start))
+}
+
+func handleRebuildSummary(dbPath string, args []string) {
+	flagSet := newFlagSet("rebuild-summary")
+	drop := flagSet.Bool("drop", false, "Remove the summary table and stop maintaining it")
+	positional := parseInterspersed(flagSet, args)
+
+	if len(positional) > 0 {
+		usage(summaryUsage)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	if *drop {
+		if err := store.DropSummary(); err != nil {
+			failOn(err, "dropping summary")
+		}
+		fmt.Println("Dropped the summary table")
+		return
+	}
+
+	start := time.Now()
+	pairs, err := store.RebuildSummary()
+	if err != nil {
+		failOn(err, "rebuilding summary")
+	}
+	fmt.Printf("Rebuilt the summary table: %d user and type pairs in %v\n", pairs, time.Since(start))
+}
+
+func handleExport(dbPath string, args []string) {
+	flagSet := newFlagSet("export")
+	eventType := flagSet.String("type", "", "Filter by event type (comma-separated for several)")
+	fromStr := flagSet.String("from", "", "Filter events from this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	toStr := flagSet.String("to", "", "Filter events to this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	outPath := flagSet.String("out", "", "Write events to this file instead of stdout")
+	delimiter := flagSet.String("delimiter", DefaultDelimiter, `Field separator of the written lines (\t for tab)`)
+	timeZone := flagSet.String("tz", "UTC", "IANA time zone for --from/--to values without an offset and for printed timestamps")
+	var wherePayload stringListFlag
+	flagSet.Var(&wherePayload, "where-payload", "Payload condition such as price>50 or ip=10.0.0.1 (repeatable)")
+
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		usage(exportUsage)
+	}
+
+	userID, err := strconv.ParseInt(positional[0], 10, 64)
+	if err != nil {
+		fail(codeInvalidArgument, "invalid user ID: %s", positional[0])
+	}
+
+	location := loadTimeZone(*timeZone)
+	filters := QueryFilters{EventTypes: parseEventTypes(*eventType)}
+	parseTimeFiltersIn(&filters, *fromStr, *toStr, location)
+	parsePayloadConditions(&filters, wherePayload)
+	if err := filters.Validate(); err != nil {
+		fail(codeInvalidFilter, "invalid filters: %v", err)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	out := os.Stdout
+	if *outPath != "" {
+		out, err = os.Create(*outPath)
+		if err != nil {
+			fail(codeInvalidArgument, "creating %s: %v", *outPath, err)
+		}
+		defer out.Close()
+	}
+
+	parser := &Parser{Delimiter: parseDelimiter(*delimiter), Location: location}
+	if err := parser.Validate(); err != nil {
+		fail(codeInvalidArgument, "%v", err)
+	}
+	count, err := store.Export(userID, filters, parser, out)
+	if err != nil {
+		failOn(err, "exporting events")
+	}
+
+	if *outPath != "" {
+		logger.Infof("Exported %d events to %s", count, *outPath)
+	} else {
+		logger.Infof("Exported %d events", count)
+	}
+}
+
+func handleReplay(dbPath string, args []string) {
+	flagSet := newFlagSet("replay")
+	allUsers := flagSet.Bool("all-users", false, "Replay events of every user (requires --from/--to or --limit)")
+	speed := flagSet.Float64("speed", 1, "Replay speed factor: 2 is twice as fast, 0 as fast as possible")
+	eventType := flagSet.String("type", "", "Replay only these event types (comma-separated)")
+	fromStr := flagSet.String("from", "", "Replay events from this time (ISO8601)")
+	toStr := flagSet.String("to", "", "Replay events to this time (ISO8601)")
+	since := flagSet.String("since", "", "Replay events from this long ago, such as 30m or 2d (instead of --from)")
+	until := flagSet.String("until", "", "Replay events to this long ago, such as 5m (instead of --to)")
+	limit := flagSet.Int("limit", 0, "Maximum number of events to replay (0 for no limit)")
+	format := flagSet.String("format", FormatText, "Output format: text, json or csv")
+	timeZone := flagSet.String("tz", "UTC", "IANA time zone for --from/--to values without an offset and for printed timestamps")
+
+	positional := parseInterspersed(flagSet, args)
+	var userID int64
+	switch {
+	case *allUsers && len(positional) == 0:
+	case !*allUsers && len(positional) == 1:
+		var err error
+		userID, err = strconv.ParseInt(positional[0], 10, 64)
+		if err != nil {
+			fail(codeInvalidArgument, "invalid user ID: %s", positional[0])
+		}
+	default:
+		usage(replayUsage)
+	}
+	if *speed < 0 {
+		fail(codeInvalidArgument, "speed cannot be negative, got %v", *speed)
+	}
+
+	filters := QueryFilters{
+		EventTypes: parseEventTypes(*eventType),
+		Limit:      *limit,
+		AllUsers:   *allUsers,
+	}
+	location := loadTimeZone(*timeZone)
+	parseTimeFiltersIn(&filters, *fromStr, *toStr, location)
+	parseRelativeTimeFilters(&filters, *since, *until, *fromStr != "", *toStr != "")
+	if err := filters.Validate(); err != nil {
+		fail(codeInvalidFilter, "invalid filters: %v", err)
+	}
+	if filters.AllUsers && !filters.bounded() {
+		fail(codeInvalidFilter, "--all-users needs --from/--to or --limit to avoid replaying the whole database")
+	}
+
+	output := OutputOptions{Format: *format, Location: location}
+	if err := output.Validate(); err != nil {
+		fail(codeInvalidArgument, "%v", err)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	start := time.Now()
+	count, err := store.Replay(context.Background(), userID, filters, *speed, output, os.Stdout)
+	if err != nil {
+		failOn(err, "replaying events")
+	}
+	logger.Infof("Replayed %d events in %v", count, time.Since(start))
+}
+
+func handleAggregate(dbPath string, args []string) {
+	flagSet := newFlagSet("aggregate")
+	fromStr := flagSet.String("from", "", "Count events from this time (ISO8601)")
+	toStr := flagSet.String("to", "", "Count events to this time (ISO8601)")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+	timeZone := flagSet.String("tz", "UTC", "IANA time zone for --from/--to values without an offset")
+	useSummary := flagSet.Bool("use-summary", false, "Read counts from the summary table instead of scanning events")
+
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		usage(aggregateUsage)
+	}
+	if *useSummary && (*fromStr != "" || *toStr != "") {
+		fail(codeInvalidArgument, "--use-summary cannot be combined with --from or --to")
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+
+	userID, err := strconv.ParseInt(positional[0], 10, 64)
+	if err != nil {
+		fail(codeInvalidArgument, "invalid user ID: %s", positional[0])
+	}
+
+	var filters QueryFilters
+	parseTimeFiltersIn(&filters, *fromStr, *toStr, loadTimeZone(*timeZone))
+	if err := filters.Validate(); err != nil {
+		fail(codeInvalidFilter, "invalid filters: %v", err)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	var counts map[string]int
+	if *useSummary {
+		counts, err = store.SummaryAggregate(userID)
+	} else {
+		counts, err = store.Aggregate(userID, filters)
+	}
+	if err != nil {
+		failOn(err, "aggregating events")
+	}
+
+	if *format == FormatJSON {
+		output, err := json.MarshalIndent(counts, "", "  ")
+		if err != nil {
+			failOn(err, "encoding counts")
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	total := 0
+	for _, eventType := range keysByCount(counts) {
+		fmt.Printf("%-20s %8d\n", eventType, counts[eventType])
+		total += counts[eventType]
+	}
+	fmt.Printf("%-20s %8d\n", "total", total)
+}
+
+func handleDiff(dbPath string, args []string) {
+	flagSet := newFlagSet("diff")
+	aUser := flagSet.String("a-user", "", "User of cohort A (default the B user, or all users)")
+	bUser := flagSet.String("b-user", "", "User of cohort B (default the A user, or all users)")
+	aFrom := flagSet.String("a-from", "", "Count cohort A events from this time (default --b-from)")
+	aTo := flagSet.String("a-to", "", "Count cohort A events to this time (default --b-to)")
+	bFrom := flagSet.String("b-from", "", "Count cohort B events from this time (default --a-from)")
+	bTo := flagSet.String("b-to", "", "Count cohort B events to this time (default --a-to)")
+	timeZone := flagSet.String("tz", "UTC", "IANA time zone for times without an offset")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) > 0 {
+		usage(diffUsage)
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+
+	// A side left unset takes the other side's value, so only what differs
+	// between the cohorts needs to be given
+	inherit := func(a, b *string) {
+		if *a == "" {
+			*a = *b
+		} else if *b == "" {
+			*b = *a
+		}
+	}
+	inherit(aUser, bUser)
+	inherit(aFrom, bFrom)
+	inherit(aTo, bTo)
+	if *aUser == *bUser && *aFrom == *bFrom && *aTo == *bTo {
+		fail(codeInvalidArgument, "cohorts A and B are the same; give a different --a-user/--b-user or time window")
+	}
+
+	loc := loadTimeZone(*timeZone)
+	cohort := func(userStr, fromStr, toStr string) (int64, QueryFilters) {
+		var userID int64
+		var filters QueryFilters
+		if userStr == "" {
+			filters.AllUsers = true
+		} else {
+			var err error
+			userID, err = strconv.ParseInt(userStr, 10, 64)
+			if err != nil {
+				fail(codeInvalidArgument, "invalid user ID: %s", userStr)
+			}
+		}
+		parseTimeFiltersIn(&filters, fromStr, toStr, loc)
+		if err := filters.Validate(); err != nil {
+			fail(codeInvalidFilter, "invalid filters: %v", err)
+		}
+		return userID, filters
+	}
+	aUserID, aFilters := cohort(*aUser, *aFrom, *aTo)
+	bUserID, bFilters := cohort(*bUser, *bFrom, *bTo)
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	aCounts, err := store.Aggregate(aUserID, aFilters)
+	if err != nil {
+		failOn(err, "aggregating cohort A")
+	}
+	bCounts, err := store.Aggregate(bUserID, bFilters)
+	if err != nil {
+		failOn(err, "aggregating cohort B")
+	}
+
+	deltas := DiffTypeCounts(aCounts, bCounts)
+	var aTotal, bTotal int
+	for _, d := range deltas {
+		aTotal += d.A
+		bTotal += d.B
+	}
+	total := typeDelta("total", aTotal, bTotal)
+
+	if *format == FormatJSON {
+		output, err := json.MarshalIndent(struct {
+			Types []TypeDelta `json:"types"`
+			Total TypeDelta   `json:"total"`
+		}{deltas, total}, "", "  ")
+		if err != nil {
+			failOn(err, "encoding diff")
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	fmt.Printf("%-20s %8s %8s %8s %9s\n", "type", "A", "B", "delta", "change")
+	for _, d := range append(deltas, total) {
+		change := "new"
+		if d.Change != nil {
+			change = fmt.Sprintf("%+.1f%%", *d.Change)
+		}
+		fmt.Printf("%-20s %8d %8d %+8d %9s\n", d.EventType, d.A, d.B, d.Delta, change)
+	}
+}
+
+func handleHistogram(dbPath string, args []string) {
+	flagSet := newFlagSet("histogram")
+	allUsers := flagSet.Bool("all-users", false, "Count events of every user instead of one")
+	bucket := flagSet.String("bucket", BucketHour, "Bucket size: minute, hour or day")
+	eventType := flagSet.String("type", "", "Filter by event type (comma-separated for several)")
+	fromStr := flagSet.String("from", "", "Count events from this time (ISO8601)")
+	toStr := flagSet.String("to", "", "Count events to this time (ISO8601)")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+	var wherePayload stringListFlag
+	flagSet.Var(&wherePayload, "where-payload", "Payload condition such as price>50 or ip=10.0.0.1 (repeatable)")
+
+	positional := parseInterspersed(flagSet, args)
+	var userID int64
+	switch {
+	case *allUsers && len(positional) == 0:
+	case !*allUsers && len(positional) == 1:
+		var err error
+		userID, err = strconv.ParseInt(positional[0], 10, 64)
+		if err != nil {
+			fail(codeInvalidArgument, "invalid user ID: %s", positional[0])
+		}
+	default:
+		usage(histogramUsage)
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+	if _, ok := bucketFormats[*bucket]; !ok {
+		fail(codeInvalidArgument, "unknown bucket %q (expected minute, hour or day)", *bucket)
+	}
+
+	filters := QueryFilters{
+		EventTypes: parseEventTypes(*eventType),
+		AllUsers:   *allUsers,
+	}
+	parsePayloadConditions(&filters, wherePayload)
+	parseTimeFilters(&filters, *fromStr, *toStr)
+	if err := filters.Validate(); err != nil {
+		fail(codeInvalidFilter, "invalid filters: %v", err)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	buckets, err := store.Histogram(userID, filters, *bucket)
+	if err != nil {
+		failOn(err, "building histogram")
+	}
+
+	if *format == FormatJSON {
+		if buckets == nil {
+			buckets = []Bucket{}
+		}
+		output, err := json.MarshalIndent(buckets, "", "  ")
+		if err != nil {
+			failOn(err, "encoding buckets")
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	for _, b := range buckets {
+		fmt.Printf("%-20s %8d\n", b.Start.Format(time.RFC3339), b.Count)
+	}
+}
+
+func handleTopUsers(dbPath string, args []string) {
+	flagSet := newFlagSet("top-users")
+	limit := flagSet.Int("limit", 10, "Number of users to list")
+	eventType := flagSet.String("type", "", "Count only these event types (comma-separated)")
+	fromStr := flagSet.String("from", "", "Count events from this time (ISO8601)")
+	toStr := flagSet.String("to", "", "Count events to this time (ISO8601)")
+	since := flagSet.String("since", "", "Count events from this long ago, such as 30m or 2d (instead of --from)")
+	until := flagSet.String("until", "", "Count events to this long ago, such as 5m (instead of --to)")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+	positional := parseInterspersed(flagSet, args)
+
+	if len(positional) > 0 {
+		usage(topUsersUsage)
+	}
+	if *limit <= 0 {
+		fail(codeInvalidArgument, "--limit must be positive")
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+
+	filters := QueryFilters{EventTypes: parseEventTypes(*eventType)}
+	parseTimeFilters(&filters, *fromStr, *toStr)
+	parseRelativeTimeFilters(&filters, *since, *until, *fromStr != "", *toStr != "")
+	if err := filters.Validate(); err != nil {
+		fail(codeInvalidFilter, "invalid filters: %v", err)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	users, err := store.TopUsers(filters, *limit)
+	if err != nil {
+		failOn(err, "ranking users")
+	}
+
+	if *format == FormatJSON {
+		if users == nil {
+			users = []UserCount{}
+		}
+		output, err := json.MarshalIndent(users, "", "  ")
+		if err != nil {
+			failOn(err, "encoding users")
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	for _, user := range users {
+		fmt.Printf("%-20d %8d\n", user.UserID, user.Events)
+	}
+}
+
+func handleCheckpoint(dbPath string, args []string) {
+	flagSet := newFlagSet("checkpoint")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+	positional := parseInterspersed(flagSet, args)
+
+	if len(positional) > 0 {
+		usage(checkpointUsage)
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	result, err := store.Checkpoint()
+	if err != nil {
+		failOn(err, "checkpointing")
+	}
+
+	if *format == FormatJSON {
+		output, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			failOn(err, "encoding result")
+		}
+		fmt.Println(string(output))
+		return
+	}
+	switch {
+	case !result.WAL:
+		fmt.Println("The database is not in WAL mode; there is nothing to checkpoint")
+	case result.Busy:
+		fmt.Printf("Checkpointed %d of %d WAL frames; busy connections kept the WAL from being truncated\n", result.Checkpointed, result.LogFrames)
+	default:
+		fmt.Printf("Checkpointed %d WAL frames and truncated the WAL\n", result.Checkpointed)
+	}
+}
+
+func handleCheck(dbPath string, args []string) {
+	flagSet := newFlagSet("check")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+	positional := parseInterspersed(flagSet, args)
+
+	if len(positional) > 0 {
+		usage(checkUsage)
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+	// Opening a missing file would create an empty, healthy database
+	if dbPath != MemoryDBPath && shellStore == nil {
+		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+			fail(codeNotFound, "database %s does not exist", dbPath)
+		}
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	ok, issues, err := store.IntegrityCheck()
+	if err != nil {
+		failOn(err, "checking database")
+	}
+
+	if *format == FormatJSON {
+		output, err := json.MarshalIndent(struct {
+			OK     bool     `json:"ok"`
+			Issues []string `json:"issues"`
+		}{ok, append([]string{}, issues...)}, "", "  ")
+		if err != nil {
+			failOn(err, "encoding result")
+		}
+		fmt.Println(string(output))
+	} else if ok {
+		fmt.Println("ok")
+	} else {
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+	}
+	if !ok {
+		exit(1)
+	}
+}
+
+// logCheckpoint reports the checkpoint run after recording
+func logCheckpoint(result *CheckpointResult) {
+	switch {
+	case !result.WAL:
+	case result.Busy:
+		logger.Warnf("checkpointed %d of %d WAL frames; busy connections kept the WAL from being truncated", result.Checkpointed, result.LogFrames)
+	default:
+		logger.Infof("Checkpointed %d WAL frames", result.Checkpointed)
+	}
+}
+
+func handleRecent(dbPath string, args []string) {
+	flagSet := newFlagSet("recent")
+	limit := flagSet.Int("limit", 50, "Number of most recent events to print")
+	chronological := flagSet.Bool("chronological", false, "Print the events oldest first instead of newest first")
+	format := flagSet.String("format", FormatText, "Output format: text, json or csv")
+	timeZone := flagSet.String("tz", "UTC", "IANA time zone for printed timestamps")
+
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		usage(recentUsage)
+	}
+	userID, err := strconv.ParseInt(positional[0], 10, 64)
+	if err != nil {
+		fail(codeInvalidArgument, "invalid user ID: %s", positional[0])
+	}
+	if *limit < 1 {
+		fail(codeInvalidArgument, "limit must be at least 1, got %d", *limit)
+	}
+
+	output := OutputOptions{Format: *format, Location: loadTimeZone(*timeZone)}
+	if err := output.Validate(); err != nil {
+		fail(codeInvalidArgument, "%v", err)
+	}
+	header, err := output.header()
+	if err != nil {
+		fail(codeInvalidArgument, "%v", err)
+	}
+	render, err := output.renderer()
+	if err != nil {
+		fail(codeInvalidArgument, "%v", err)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	events, err := store.RecentEvents(userID, *limit)
+	if err != nil {
+		failOn(err, "reading recent events")
+	}
+
+	_, err = writeEventStream(os.Stdout, 0, header, render, func(fn func(*Event) error) error {
+		for i := range events {
+			event := events[i]
+			if *chronological {
+				event = events[len(events)-1-i]
+			}
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		failOn(err, "writing events")
+	}
+}
+
+func handleUserRange(dbPath string, args []string) {
+	flagSet := newFlagSet("user-range")
+	allUsers := flagSet.Bool("all-users", false, "List every user instead of one")
+	limit := flagSet.Int("limit", 0, "Maximum number of users to list with --all-users (0 for all)")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+
+	positional := parseInterspersed(flagSet, args)
+	var userID int64
+	switch {
+	case *allUsers && len(positional) == 0:
+	case !*allUsers && len(positional) == 1:
+		var err error
+		userID, err = strconv.ParseInt(positional[0], 10, 64)
+		if err != nil {
+			fail(codeInvalidArgument, "invalid user ID: %s", positional[0])
+		}
+	default:
+		usage(userRangeUsage)
+	}
+	if *limit < 0 {
+		fail(codeInvalidArgument, "limit cannot be negative, got %d", *limit)
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	var ranges []UserRange
+	if *allUsers {
+		var err error
+		ranges, err = store.UserActivityRanges(*limit)
+		if err != nil {
+			failOn(err, "reading user ranges")
+		}
+	} else {
+		first, last, count, err := store.UserActivityRange(userID)
+		if err != nil {
+			failOn(err, "reading user range")
+		}
+		if count == 0 {
+			fail(codeNotFound, "no events for user %d", userID)
+		}
+		ranges = []UserRange{{UserID: userID, First: first, Last: last, Events: count}}
+	}
+
+	if *format == FormatJSON {
+		if ranges == nil {
+			ranges = []UserRange{}
+		}
+		var output []byte
+		var err error
+		if *allUsers {
+			output, err = json.MarshalIndent(ranges, "", "  ")
+		} else {
+			output, err = json.MarshalIndent(ranges[0], "", "  ")
+		}
+		if err != nil {
+			failOn(err, "encoding user ranges")
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	for _, r := range ranges {
+		fmt.Printf("%-20d %s  %s %8d\n", r.UserID, r.First.Format(time.RFC3339Nano), r.Last.Format(time.RFC3339Nano), r.Events)
+	}
+}
+
+func handleFindDuplicates(dbPath string, args []string) {
+	flagSet := newFlagSet("find-duplicates")
+	limit := flagSet.Int("limit", 100, "Maximum number of duplicate groups to list (0 for all)")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+	positional := parseInterspersed(flagSet, args)
+
+	if len(positional) > 0 {
+		usage(duplicatesUsage)
+	}
+	if *limit < 0 {
+		fail(codeInvalidArgument, "--limit cannot be negative")
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	groups, err := store.FindDuplicates(*limit)
+	if err != nil {
+		failOn(err, "finding duplicates")
+	}
+
+	if *format == FormatJSON {
+		if groups == nil {
+			groups = []DuplicateGroup{}
+		}
+		output, err := json.MarshalIndent(groups, "", "  ")
+		if err != nil {
+			failOn(err, "encoding duplicates")
+		}
+		fmt.Println(string(output))
+		return
+	}
+
+	for _, group := range groups {
+		fmt.Printf("%s | %d | %s: %d copies\n", group.Timestamp.Format(time.RFC3339Nano), group.UserID, group.EventType, group.Count)
+	}
+	logger.Infof("Found %d duplicate groups", len(groups))
+}
+
+func handleDelete(dbPath string, args []string) {
+	flagSet := newFlagSet("delete")
+	eventType := flagSet.String("type", "", "Only delete these event types (comma-separated)")
+	fromStr := flagSet.String("from", "", "Delete events from this time (ISO8601)")
+	toStr := flagSet.String("to", "", "Delete events to this time (ISO8601)")
+	confirm := flagSet.Bool("confirm", false, "Actually delete; without it only report how many events would be removed")
+
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		usage(deleteUsage)
+	}
+
+	userID, err := strconv.ParseInt(positional[0], 10, 64)
+	if err != nil {
+		fail(codeInvalidArgument, "invalid user ID: %s", positional[0])
+	}
+
+	filters := QueryFilters{EventTypes: parseEventTypes(*eventType)}
+	parseTimeFilters(&filters, *fromStr, *toStr)
+	if err := filters.Validate(); err != nil {
+		fail(codeInvalidFilter, "invalid filters: %v", err)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	if !*confirm {
+		count, err := store.Count(userID, filters)
+		if err != nil {
+			failOn(err, "counting events")
+		}
+		fmt.Printf("Would delete %d events for user %d (pass --confirm to delete)\n", count, userID)
+		return
+	}
+
+	removed, err := store.Delete(userID, filters)
+	if err != nil {
+		failOn(err, "deleting events")
+	}
+	fmt.Printf("Deleted %d events for user %d\n", removed, userID)
+}
+
+func handleStats(dbPath string, args []string) {
+	flagSet := newFlagSet("stats")
+	format := flagSet.String("format", FormatText, "Output format: text, json or prometheus")
+	useSummary := flagSet.Bool("use-summary", false, "Read counts from the summary table instead of scanning events")
+	positional := parseInterspersed(flagSet, args)
+
+	if len(positional) > 0 {
+		usage(statsUsage)
+	}
+	if *format != FormatText && *format != FormatJSON && *format != FormatPrometheus {
+		fail(codeInvalidArgument, "unknown output format %q (expected text, json or prometheus)", *format)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	var stats map[string]interface{}
+	var err error
+	if *useSummary {
+		stats, err = store.SummaryStats()
+	} else {
+		stats, err = store.GetStats()
+	}
+	if err != nil {
+		failOn(err, "reading stats")
+	}
+
+	if *format == FormatJSON {
+		output, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			failOn(err, "encoding stats")
+		}
+		fmt.Println(string(output))
+		return
+	}
+	if *format == FormatPrometheus {
+		fmt.Print(formatPrometheusStats(stats))
+		return
+	}
+
+	fmt.Printf("Total events: %d\n", stats["total_events"])
+	fmt.Printf("Unique users: %d\n", stats["unique_users"])
+	timeRange := stats["time_range"].(map[string]string)
+	if timeRange["from"] == "" {
+		fmt.Println("Time range:   (no events)")
+	} else {
+		fmt.Printf("Time range:   %s to %s\n", timeRange["from"], timeRange["to"])
+	}
+
+	byType := stats["by_type"].(map[string]TypeStats)
+	if len(byType) == 0 {
+		return
+	}
+	counts := make(map[string]int, len(byType))
+	for eventType, typeStats := range byType {
+		counts[eventType] = typeStats.Events
+	}
+	fmt.Println()
+	fmt.Printf("%-20s %8s %8s\n", "type", "events", "users")
+	for _, eventType := range keysByCount(counts) {
+		fmt.Printf("%-20s %8d %8d\n", eventType, byType[eventType].Events, byType[eventType].UniqueUsers)
+	}
+}
+
+func handleCardinality(dbPath string, args []string) {
+	flagSet := newFlagSet("cardinality")
+	field := flagSet.String("field", "", "Payload field to analyse (e.g. payload.page)")
+	eventType := flagSet.String("type", "", "Filter by event type (comma-separated for several)")
+	fromStr := flagSet.String("from", "", "Filter events from this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	toStr := flagSet.String("to", "", "Filter events to this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	approx := flagSet.Bool("approx", false, "Estimate with HyperLogLog instead of an exact count")
+	positional := parseInterspersed(flagSet, args)
+
+	if *field == "" || len(positional) > 0 {
+		usage(cardinalityUsage)
+	}
+	if _, err := payloadPath(*field); err != nil {
+		fail(codeInvalidArgument, "%v", err)
+	}
+
+	filters := QueryFilters{EventTypes: parseEventTypes(*eventType)}
+	parseTimeFilters(&filters, *fromStr, *toStr)
+	if err := filters.Validate(); err != nil {
+		fail(codeInvalidFilter, "invalid filters: %v", err)
+	}
+
+	store, release := openStore(dbPath)
+	defer release()
+
+	if *approx {
+		estimate, err := store.EstimateDistinctPayloadValues(*field, filters)
+		if err != nil {
+			failOn(err, "estimating cardinality")
+		}
+		fmt.Printf("Distinct values of %s: ~%d (approximate)\n", *field, estimate)
+		return
+	}
+
+	count, err := store.DistinctPayloadValues(*field, filters)
+	if err != nil {
+		failOn(err, "counting distinct values")
+	}
+	fmt.Printf("Distinct values of %s: %d\n", *field, count)
+}
+
+func handleBench(args []string) {
+	flagSet := newFlagSet("bench")
+	events := flagSet.Int("events", 100000, "Number of synthetic events to record")
+	seed := flagSet.Int64("seed", 1, "Generator seed; the same seed benchmarks the same events")
+	runs := flagSet.Int("runs", 5, "Times each query is run; the median latency is reported")
+	batch := flagSet.Int("batch", DefaultBatchSize, "Events per transaction")
+	workers := flagSet.Int("workers", runtime.NumCPU(), "Number of goroutines parsing lines in parallel")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+
+	defaults := DefaultStoreConfig()
+	journalMode := flagSet.String("journal-mode", defaults.JournalMode, "SQLite journal mode (DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF)")
+	synchronous := flagSet.String("synchronous", defaults.Synchronous, "SQLite synchronous level (OFF, NORMAL, FULL, EXTRA)")
+	cacheSize := flagSet.Int("cache-size", defaults.CacheSize, "SQLite page cache size (pages, or KiB if negative)")
+	mmapSize := flagSet.Int64("mmap-size", defaults.MmapSize, "Bytes of memory-mapped I/O (0 disables)")
+	compress := flagSet.Bool("compress-payload", false, "Store payloads compressed")
+	positional := parseInterspersed(flagSet, args)
+
+	if len(positional) > 0 {
+		usage(benchUsage)
+	}
+	if *events < 1 || *runs < 1 || *batch < 1 || *workers < 1 {
+		fail(codeInvalidArgument, "--events, --runs, --batch and --workers must be at least 1")
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+
+	config := storeConfig()
+	config.JournalMode = *journalMode
+	config.Synchronous = *synchronous
+	config.CacheSize = *cacheSize
+	config.MmapSize = *mmapSize
+	config.CompressPayload = *compress
+	if err := config.Validate(); err != nil {
+		fail(codeInvalidArgument, "%v", err)
+	}
+
+	result, err := Bench(BenchOptions{
+		Events: *events,
+		Seed:   *seed,
+		Runs:   *runs,
+		Config: config,
+		Record: RecordOptions{BatchSize: *batch, Workers: *workers},
+	})
+	if err != nil {
+		failOn(err, "benchmark failed")
+	}
+
+	if *format == FormatJSON {
+		output, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			failOn(err, "encoding results")
+		}
+		fmt.Println(string(output))
+		return
+	}
+	fmt.Print(formatBenchResult(result))
+}
+
+func handleSchema(args []string) {
+	flagSet := newFlagSet("schema")
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 0 {
+		usage(schemaUsage)
+	}
+
+	schema, err := EventJSONSchema()
+	if err != nil {
+		fail(codeInvalidArgument, "building event schema: %v", err)
+	}
+	output, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		fail(codeInvalidArgument, "encoding event schema: %v", err)
+	}
+	fmt.Println(string(output))
+}
+
+func handleLint(args []string) {
+	flagSet := newFlagSet("lint")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		usage(lintUsage)
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+
+	filename := positional[0]
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		fail(codeNotFound, "file %s does not exist", filename)
+	}
+
+	report, err := LintFile(filename)
+	if err != nil {
+		fail(codeInvalidArgument, "linting %s: %v", filename, err)
+	}
+
+	if *format == FormatJSON {
+		output, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fail(codeInvalidArgument, "encoding report: %v", err)
+		}
+		fmt.Println(string(output))
+	} else {
+		printLintReport(report)
+	}
+
+	// A non-zero exit lets pipelines gate on clean input
+	if report.Invalid > 0 {
+		exit(1)
+	}
+}
+
+func handleValidate(args []string) {
+	flagSet := newFlagSet("validate")
+	maxErrors := flagSet.Int("max-errors", 0, "Number of invalid lines tolerated before exiting non-zero")
+	format := flagSet.String("format", FormatText, "Output format: text or json")
+	inputFormat := flagSet.String("input-format", InputFormatPipe, "Input format: pipe, csv (timestamp,user_id,event_type,payload) or json (one event object per line)")
+	delimiter := flagSet.String("delimiter", DefaultDelimiter, `Field separator of pipe-format lines (\t for tab)`)
+	emptyPayload := flagSet.String("empty-payload", EmptyPayloadNull, "Accept empty payloads (null or {}) or reject them")
+	maxLine := flagSet.Int("max-line", DefaultMaxLineSize, "Longest accepted line in bytes")
+	minTimeStr := flagSet.String("min-time", "", "Reject events before this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	maxTimeStr := flagSet.String("max-time", "", "Reject events after this time (ISO8601, '2006-01-02 15:04:05' or epoch seconds)")
+	schemaPath := flagSet.String("schema", "", "JSON file mapping event types to required payload keys and kinds")
+
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		usage(validateUsage)
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fail(codeInvalidArgument, "unknown output format %q (expected text or json)", *format)
+	}
+	if *maxErrors < 0 {
+		fail(codeInvalidArgument, "max errors cannot be negative, got %d", *maxErrors)
+	}
+	if *maxLine < 1 {
+		fail(codeInvalidArgument, "max line must be at least 1, got %d", *maxLine)
+	}
+
+	opts := RecordOptions{
+		InputFormat:  *inputFormat,
+		Delimiter:    parseDelimiter(*delimiter),
+		EmptyPayload: *emptyPayload,
+		MaxLineSize:  *maxLine,
+	}
+	parseTimeBounds(&opts, *minTimeStr, *maxTimeStr)
+	opts.Schema = loadSchemaFlag(*schemaPath)
+
+	filename := positional[0]
+	if filename != "-" {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			fail(codeNotFound, "file %s does not exist", filename)
+		}
+	}
+
+	report, err := ValidateFile(filename, opts)
+	if err != nil {
+		fail(codeInvalidArgument, "validating %s: %v", filename, err)
+	}
+
+	if *format == FormatJSON {
+		output, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fail(codeInvalidArgument, "encoding report: %v", err)
+		}
+		fmt.Println(string(output))
+	} else {
+		for _, invalid := range report.Errors {
+			fmt.Printf("%s: %s\n", invalid.Position, invalid.Reason)
+		}
+		fmt.Printf("Valid:   %d\n", report.Valid)
+		fmt.Printf("Invalid: %d\n", report.Invalid)
+	}
+
+	if report.Invalid > *maxErrors {
+		exit(1)
+	}
+}
+
+// printLintReport prints a LintReport as a readable summary
+func printLintReport(report *LintReport) {
+	fmt.Printf("Lines:   %d\n", report.Lines)
+	fmt.Printf("Valid:   %d\n", report.Valid)
+	fmt.Printf("Invalid: %d\n", report.Invalid)
+
+	if len(report.ErrorsByKind) > 0 {
+		fmt.Println("Errors by kind:")
+		for _, kind := range sortedKeys(report.ErrorsByKind) {
+			fmt.Printf("  %-18s %d\n", kind, report.ErrorsByKind[kind])
+		}
+	}
+
+	if len(report.EventTypes) > 0 {
+		fmt.Println("Event types:")
+		for _, eventType := range sortedKeys(report.EventTypes) {
+			fmt.Printf("  %-18s %d\n", eventType, report.EventTypes[eventType])
+		}
+	}
+
+	if report.MinTimestamp != "" {
+		fmt.Printf("Time range: %s to %s\n", report.MinTimestamp, report.MaxTimestamp)
+	}
+	fmt.Printf("Payload keys: %s\n", strings.Join(report.PayloadKeys, ", "))
+}
+
+// sortedKeys returns the keys of a count map in alphabetical order
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// stringListFlag collects the values of a repeatable string flag
+type stringListFlag []string
+
+func (sl *stringListFlag) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringListFlag) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+// parsePayloadConditions parses --where-payload expressions into filters and
+// exits on malformed input
+func parsePayloadConditions(filters *QueryFilters, exprs []string) {
+	for _, expr := range exprs {
+		condition, err := ParsePayloadCondition(expr)
+		if err != nil {
+			fail(codeInvalidFilter, "%v", err)
+		}
+		filters.PayloadConditions = append(filters.PayloadConditions, condition)
+	}
+}
+
+// parseEventTypes splits a comma-separated --type value into event types.
+// Empty entries are kept so Validate can reject them.
+func parseEventTypes(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	types := strings.Split(value, ",")
+	for i, eventType := range types {
+		types[i] = strings.TrimSpace(eventType)
+	}
+	return types
+}
+
+// keysByCount returns the keys of a count map ordered by descending count,
+// breaking ties alphabetically
+func keysByCount(counts map[string]int) []string {
+	keys := sortedKeys(counts)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return counts[keys[i]] > counts[keys[j]]
+	})
+	return keys
+}
+
+// parseTimeFilters parses the --from/--to flag values into filters and exits
+// on malformed input. Any format accepted by parseFlexibleTime works.
+func parseTimeFilters(filters *QueryFilters, fromStr, toStr string) {
+	parseTimeFiltersIn(filters, fromStr, toStr, time.UTC)
+}
+
+// parseTimeFiltersIn is parseTimeFilters reading --from/--to values without
+// a zone as local time in loc
+func parseTimeFiltersIn(filters *QueryFilters, fromStr, toStr string, loc *time.Location) {
+	var err error
+	if fromStr != "" {
+		filters.From, err = parseTimeIn(fromStr, loc)
+		if err != nil {
+			fail(codeInvalidFilter, "invalid from time format: %s", fromStr)
+		}
+	}
+
+	if toStr != "" {
+		filters.To, err = parseTimeIn(toStr, loc)
+		if err != nil {
+			fail(codeInvalidFilter, "invalid to time format: %s", toStr)
+		}
+	}
+}
+
+// parseIngestedFilters parses the --ingested-from/--ingested-to flag values
+// into filters, reading times without an offset in loc, and exits on
+// malformed input
+func parseIngestedFilters(filters *QueryFilters, fromStr, toStr string, loc *time.Location) {
+	var err error
+	if fromStr != "" {
+		filters.IngestedFrom, err = parseTimeIn(fromStr, loc)
+		if err != nil {
+			fail(codeInvalidFilter, "invalid ingested from time format: %s", fromStr)
+		}
+	}
+	if toStr != "" {
+		filters.IngestedTo, err = parseTimeIn(toStr, loc)
+		if err != nil {
+			fail(codeInvalidFilter, "invalid ingested to time format: %s", toStr)
+		}
+	}
+}
+
+// fail reports a command failure in the selected error format and exits.
+// JSON errors are written to stderr as {"error": "...", "code": "..."}.
+func fail(code string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if errorFormat == "json" {
+		encoder := json.NewEncoder(os.Stderr)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(map[string]string{
+			"error": message,
+			"code":  code,
+		})
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", message)
+	}
+	exit(1)
+}
+
+// errorCode derives the code a command failure is reported with from the
+// type of the error behind it
+func errorCode(err error) string {
+	var filterErr *FilterError
+	var parseErr *ParseError
+	switch {
+	case errors.As(err, &filterErr):
+		return codeInvalidFilter
+	case errors.As(err, &parseErr):
+		return codeInvalidInput
+	case errors.Is(err, context.DeadlineExceeded):
+		return codeTimeout
+	default:
+		return codeStoreError
+	}
+}
+
+// failOn reports err, prefixed with what the command was doing, with the code
+// errorCode derives from it, and exits
+func failOn(err error, doing string) {
+	fail(errorCode(err), "%s: %v", doing, err)
+}
+
+// usage reports a command line usage failure and exits
+func usage(line string) {
+	if errorFormat == "json" {
+		fail(codeUsage, "usage: %s", line)
+	}
+	fmt.Fprintf(os.Stderr, "Usage: %s\n", line)
+	exit(1)
+}
+
+// openStore opens the event store for a command. Inside the shell it hands
+// out the shell's open store instead. Call release when done with it.
+func openStore(dbPath string) (store *EventStore, release func()) {
+	return openStoreWithConfig(dbPath, storeConfig())
+}
+
+// openStoreWithConfig is openStore with the given configuration, which the
+// shell's store ignores
+func openStoreWithConfig(dbPath string, config StoreConfig) (store *EventStore, release func()) {
+	if shellStore != nil {
+		return shellStore, func() {}
+	}
+	store, err := NewEventStoreWithConfig(dbPath, config)
+	if err != nil {
+		failOn(err, "initializing store")
+	}
+	return store, func() { store.Close() }
+}
+
+// canQueryReadOnly reports whether query can open every one of paths
+// read-only, as it prefers to since queries never write: each must be an
+// existing database already at this binary's schema version. Anything
+// else, such as :memory:, a missing file or an older database, is opened
+// for writing as before, so it is created or migrated on the way.
+func canQueryReadOnly(paths []string) bool {
+	for _, path := range paths {
+		if path == MemoryDBPath {
+			return false
+		}
+		if version, err := storedSchemaVersion(path); err != nil || version != schemaVersion {
+			return false
+		}
+	}
+	return len(paths) > 0
+}
+
+// eventQuerier is what query needs of a store: an EventStore, or a
+// MultiStore spanning several databases
+type eventQuerier interface {
+	Count(userID int64, filters QueryFilters) (int, error)
+	QueryContext(ctx context.Context, userID int64, filters QueryFilters, output OutputOptions, out io.Writer) (int, error)
+}
+
+// databasePaths expands --db into the databases it names. Several paths are
+// separated by commas, and a path with glob characters, as in
+// 'shards/2023-*.db', names every existing file it matches, in name order.
+func databasePaths(dbPath string) ([]string, error) {
+	var paths []string
+	for _, path := range strings.Split(dbPath, ",") {
+		if !strings.ContainsAny(path, "*?[") {
+			paths = append(paths, path)
+			continue
+		}
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database pattern %q: %v", path, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no databases match %s", path)
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) > 1 {
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				return nil, fmt.Errorf("database %s does not exist", path)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// storeConfig returns the default store configuration with the global
+// --busy-timeout applied
+func storeConfig() StoreConfig {
+	config := DefaultStoreConfig()
+	config.BusyTimeout = busyTimeout
+	return config
+}
+
+// newFlagSet creates a command's flag set. Inside the shell a bad flag ends
+// only the current command rather than the process.
+func newFlagSet(name string) *flag.FlagSet {
+	if shellStore != nil {
+		return flag.NewFlagSet(name, flag.PanicOnError)
+	}
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+// parseRelativeTimeFilters sets the filter time range from --since/--until
+// durations counted back from now, and exits on malformed input or when
+// --from/--to is given as well
+func parseRelativeTimeFilters(filters *QueryFilters, since, until string, hasFrom, hasTo bool) {
+	now := time.Now().UTC()
+	if since != "" {
+		if hasFrom {
+			fail(codeInvalidFilter, "--since cannot be combined with --from")
+		}
+		age, err := parseAge(since)
+		if err != nil {
+			fail(codeInvalidFilter, "invalid --since: %v", err)
+		}
+		filters.From = now.Add(-age)
+	}
+	if until != "" {
+		if hasTo {
+			fail(codeInvalidFilter, "--until cannot be combined with --to")
+		}
+		age, err := parseAge(until)
+		if err != nil {
+			fail(codeInvalidFilter, "invalid --until: %v", err)
+		}
+		filters.To = now.Add(-age)
+	}
+}
+
+// withTimeout returns a context that expires after timeout, or never when
+// timeout is zero
+func withTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// parseSample checks a --sample fraction and returns it with the seed to
+// use: --seed when given, otherwise a random one. A fraction of 1 keeps
+// everything and is returned as 0, meaning no sampling.
+func parseSample(flagSet *flag.FlagSet, fraction float64, seed int64) (float64, int64) {
+	if fraction <= 0 || fraction > 1 {
+		fail(codeInvalidArgument, "sample must be above 0 and at most 1, got %v", fraction)
+	}
+	seeded := false
+	flagSet.Visit(func(f *flag.Flag) {
+		seeded = seeded || f.Name == "seed"
+	})
+	if !seeded {
+		seed = time.Now().UnixNano()
+	}
+	if fraction == 1 {
+		return 0, seed
+	}
+	return fraction, seed
+}
+
+// parseIDRange sets the filter ID range from an --id-range value such as
+// 100-200 and exits on malformed input
+func parseIDRange(filters *QueryFilters, value string) {
+	if value == "" {
+		return
+	}
+	from, to, ok := strings.Cut(value, "-")
+	fromID, fromErr := strconv.ParseInt(from, 10, 64)
+	toID, toErr := strconv.ParseInt(to, 10, 64)
+	if !ok || fromErr != nil || toErr != nil || fromID < 1 || toID < 1 {
+		fail(codeInvalidFilter, "invalid --id-range %q (expected <first>-<last>, such as 100-200)", value)
+	}
+	filters.FromID = fromID
+	filters.ToID = toID
+}
+
+// parseUserRange sets the filter user range from --user-from and --user-to
+// values and exits on malformed input. Both bounds are needed.
+func parseUserRange(filters *QueryFilters, fromStr, toStr string) {
+	if fromStr == "" && toStr == "" {
+		return
+	}
+	if fromStr == "" || toStr == "" {
+		fail(codeInvalidFilter, "--user-from and --user-to must be given together")
+	}
+	from, err := strconv.ParseInt(fromStr, 10, 64)
+	if err != nil {
+		fail(codeInvalidFilter, "invalid --user-from: %s", fromStr)
+	}
+	to, err := strconv.ParseInt(toStr, 10, 64)
+	if err != nil {
+		fail(codeInvalidFilter, "invalid --user-to: %s", toStr)
+	}
+	filters.UserRange = true
+	filters.FromUser = from
+	filters.ToUser = to
+}
+
+// parseTimeBounds parses the --min-time/--max-time flag values into opts and
+// exits on malformed input
+func parseTimeBounds(opts *RecordOptions, minTimeStr, maxTimeStr string) {
+	var err error
+	if minTimeStr != "" {
+		if opts.MinTime, err = parseFlexibleTime(minTimeStr); err != nil {
+			fail(codeInvalidArgument, "invalid min time format: %s", minTimeStr)
+		}
+	}
+	if maxTimeStr != "" {
+		if opts.MaxTime, err = parseFlexibleTime(maxTimeStr); err != nil {
+			fail(codeInvalidArgument, "invalid max time format: %s", maxTimeStr)
+		}
+	}
+}
+
+// loadSchemaFlag loads the --schema file, if one is given, and exits if it
+// cannot be used
+func loadSchemaFlag(filename string) *Schema {
+	if filename == "" {
+		return nil
+	}
+	schema, err := LoadSchema(filename)
+	if err != nil {
+		fail(codeInvalidArgument, "%v", err)
+	}
+	return schema
+}
+
+// loadTimeZone loads the IANA time zone named by a --tz flag and exits if it
+// is unknown
+func loadTimeZone(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		fail(codeInvalidArgument, "unknown time zone %q: %v", name, err)
+	}
+	return loc
+}
+
+// listDirFiles returns the regular files in dir whose names match pattern,
+// sorted by name so hourly or daily files are ingested in order
+func listDirFiles(dir, pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if matched, _ := filepath.Match(pattern, entry.Name()); matched {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// parseAge parses a positive duration that may also be given in days, such
+// as 90d, in addition to the units accepted by time.ParseDuration
+func parseAge(value string) (time.Duration, error) {
+	var age time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", days)
+		}
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if age, err = time.ParseDuration(value); err != nil {
+			return 0, err
+		}
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("age must be positive, got %s", value)
+	}
+	return age, nil
+}
+
+// parseDelimiter turns the escape sequence \t in a --delimiter value into a
+// tab, which is awkward to pass on a command line otherwise
+func parseDelimiter(value string) string {
+	return strings.ReplaceAll(value, `\t`, "\t")
+}
+
+// parseInterspersed parses flags that may appear before, between or after
+// positional arguments and returns the positional arguments in order.
+func parseInterspersed(flagSet *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flagSet.Parse(args)
+		args = flagSet.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func printUsage() {
+	fmt.Println("Usage:")
+	fmt.Println("  eventlog [--db=<path>[,<path>...]] [--error-format=text|json] [--quiet|--verbose] [--busy-timeout=<duration>] <command> [arguments]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  " + recordUsage)
+	fmt.Println("  " + queryUsage)
+	fmt.Println("  " + statsUsage)
+	fmt.Println("  " + cardinalityUsage)
+	fmt.Println("  " + exportUsage)
+	fmt.Println("  " + replayUsage)
+	fmt.Println("  " + aggregateUsage)
+	fmt.Println("  " + diffUsage)
+	fmt.Println("  " + histogramUsage)
+	fmt.Println("  " + topUsersUsage)
+	fmt.Println("  " + recentUsage)
+	fmt.Println("  " + userRangeUsage)
+	fmt.Println("  " + duplicatesUsage)
+	fmt.Println("  " + deleteUsage)
+	fmt.Println("  " + purgeUsage)
+	fmt.Println("  " + mergeUsage)
+	fmt.Println("  " + summaryUsage)
+	fmt.Println("  " + checkpointUsage)
+	fmt.Println("  " + checkUsage)
+	fmt.Println("  " + lintUsage)
+	fmt.Println("  " + validateUsage)
+	fmt.Println("  " + schemaUsage)
+	fmt.Println("  " + shellUsage)
+	fmt.Println("  " + benchUsage)
+	fmt.Println()
+	fmt.Println("Examples:")
+	fmt.Println("  eventlog record events.txt")
+	fmt.Println("  eventlog record events.txt --replace --confirm")
+	fmt.Println("  go run data/generate_test_data.go - 1000 | eventlog record -")
+	fmt.Println("  eventlog record --merge-sorted day1.txt day2.txt day3.txt")
+	fmt.Println("  eventlog record /var/log/events --glob='*.log*'")
+	fmt.Println("  eventlog record events.txt --mmap-size=0 --cache-size=-65536")
+	fmt.Println("  eventlog record live.log --follow --flush-interval=5s")
+	fmt.Println("  eventlog record feed.csv --input-format=csv")
+	fmt.Println("  eventlog record feed.ndjson --input-format=json")
+	fmt.Println("  eventlog record live.csv --parser=csv --follow")
+	fmt.Println("  eventlog record events.txt --schema=schema.json --strict")
+	fmt.Println("  eventlog record new-feed.txt --dry-run")
+	fmt.Println("  eventlog record huge.txt --sample=0.01 --seed=1")
+	fmt.Println("  eventlog record events.txt --errors-file=rejects.jsonl")
+	fmt.Println("  eventlog record mixed-case.txt --normalize-type")
+	fmt.Println("  eventlog record free-text.txt --no-json-validate")
+	fmt.Println(`  eventlog record feed.tsv --delimiter='\t'`)
+	fmt.Println("  eventlog query 42")
+	fmt.Println("  eventlog query 42 --type=login")
+	fmt.Println("  eventlog recent 42 --limit=20 --chronological")
+	fmt.Println("  eventlog query 42 --type=login,logout")
+	fmt.Println("  eventlog query 42 --from=2023-08-14T12:00:00Z --to=2023-08-14T13:00:00Z")
+	fmt.Println("  eventlog query 42 --from='2023-08-14 09:00:00' --tz=Europe/Berlin")
+	fmt.Println("  eventlog query --all-users --type=error --since=30m")
+	fmt.Println("  eventlog query 42 --limit=100 --offset=200")
+	fmt.Println("  eventlog query 42 --limit=100 --offset=200 --number")
+	fmt.Println("  eventlog query 42 --order=desc --limit=10")
+	fmt.Println("  eventlog query --all-users --type=purchase --since=1d --sort-payload=price --sort-dir=desc --limit=10")
+	fmt.Println("  eventlog query 42 --format=json | jq .payload")
+	fmt.Println("  eventlog query 42 --format=json --pretty")
+	fmt.Println("  eventlog query 42 --type=login --expand-payload=ip,device")
+	fmt.Println("  eventlog query 42 --fields=timestamp,event_type,payload.ip --format=csv")
+	fmt.Println("  eventlog query 42 --format=csv > events.csv")
+	fmt.Println("  eventlog query --all-users --type=purchase --since=7d --format=csv --explode=item,price > purchases.csv")
+	fmt.Println("  eventlog query 42 --template='{{.UserID}}: {{.EventType}}'")
+	fmt.Println("  eventlog query --all-users --type=error --limit=1000 --timeout=30s")
+	fmt.Println("  eventlog query 42 --since=1d --stats-json > events.txt 2> stats.json")
+	fmt.Println("  eventlog query --all-users --id-range=1000-1999 --show-id")
+	fmt.Println("  eventlog query --all-users --ingested-from=2023-09-01T00:00:00Z --show-ingested --format=json")
+	fmt.Println("  eventlog query --user-from=1000 --user-to=1999 --format=csv > tenant.csv")
+	fmt.Println("  eventlog query 42 --distinct-types")
+	fmt.Println("  eventlog query 42 --type=login --from=2023-08-14T12:00:00Z --explain")
+	fmt.Println("  eventlog query --all-users --type=error --from=2023-08-14T10:00:00Z --to=2023-08-14T11:00:00Z --count")
+	fmt.Println("  eventlog query 42 --type=purchase --count")
+	fmt.Println("  eventlog query --all-users --type=purchase --since=1d --sample=0.1 --count")
+	fmt.Println("  eventlog query 42 --type=purchase --where-payload='price>50'")
+	fmt.Println("  eventlog query --all-users --type=login --missing-key=device --count")
+	fmt.Println("  eventlog aggregate 42 --from=2023-08-14T00:00:00Z")
+	fmt.Println("  eventlog diff --a-user=42 --b-user=43")
+	fmt.Println("  eventlog diff --a-from=2023-08-14T09:00:00Z --a-to=2023-08-14T10:00:00Z --b-from=2023-08-14T10:00:00Z --b-to=2023-08-14T11:00:00Z")
+	fmt.Println("  eventlog delete 42 --confirm")
+	fmt.Println("  eventlog stats --format=json")
+	fmt.Println("  eventlog stats --format=prometheus > /var/lib/node_exporter/eventlog.prom")
+	fmt.Println("  eventlog rebuild-summary && eventlog stats --use-summary")
+	fmt.Println("  eventlog checkpoint")
+	fmt.Println("  eventlog --db=copy.db check")
+	fmt.Println("  eventlog purge --older-than=90d --dry-run")
+	fmt.Println("  eventlog --db=all.db merge --from=shard1.db --dedupe")
+	fmt.Println("  eventlog histogram --all-users --type=error --bucket=minute --from=2023-08-14T10:00:00Z")
+	fmt.Println("  eventlog top-users --limit=20 --since=7d")
+	fmt.Println("  eventlog user-range --all-users --format=json")
+	fmt.Println("  eventlog find-duplicates --limit=20")
+	fmt.Println("  eventlog cardinality --field=payload.page --type=page_view")
+	fmt.Println("  eventlog export 42 --type=login --out=login.txt")
+	fmt.Println("  eventlog replay --all-users --from=2023-08-14T10:00:00Z --to=2023-08-14T11:00:00Z --speed=60")
+	fmt.Println("  eventlog lint events.txt")
+	fmt.Println("  eventlog validate events.txt --max-errors=10")
+	fmt.Println("  eventlog schema > event.schema.json")
+	fmt.Println("  printf '42 --type=login\\nstats\\n' | eventlog shell")
+	fmt.Println("  eventlog bench --events=200000 --synchronous=OFF")
+	fmt.Println("  eventlog --db=staging.db query 42")
+	fmt.Println("  eventlog --db='shards/2023-*.db' query 42 --from=2023-08-25T00:00:00Z --to=2023-09-05T00:00:00Z")
+	fmt.Println("  eventlog --quiet query 42 --format=json > events.json")
+	fmt.Println()
+	fmt.Println("The database defaults to $EVENTLOG_DB, or events.db when unset.")
 }
\ No newline at end of file
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// runEventlog starts the test binary again to run the command itself
+	if os.Getenv("EVENTLOG_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	// Keep ingest progress and timings out of the test output
+	logger.level = LogQuiet
+	os.Exit(m.Run())
+}
+
+// runEventlog runs the eventlog command line with args in a child process
+// and returns its stdout, stderr and exit code
+func runEventlog(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "EVENTLOG_TEST_MAIN=1", "EVENTLOG_DB=")
+	cmd.Dir = t.TempDir()
+	var out, errOut bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("running eventlog: %v", err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+// jsonErrorCode returns the code of the --error-format=json error, the last
+// line on stderr
+func jsonErrorCode(t *testing.T, stderr string) string {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	var reported struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &reported); err != nil {
+		t.Fatalf("stderr is not a JSON error: %q", stderr)
+	}
+	return reported.Code
+}
+
+func TestErrorCode(t *testing.T) {
+	store := newTestStore(t)
+	_, filterErr := store.Count(1, QueryFilters{Limit: -1})
+	_, parseErr := ParseEvent("not an event")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"filters refused by the store", filterErr, codeInvalidFilter},
+		{"wrapped filter error", fmt.Errorf("shard 2: %w", filterErr), codeInvalidFilter},
+		{"parse error", parseErr, codeInvalidInput},
+		{"located parse error", fmt.Errorf("a.txt: line 3: %w", lineError(parseErr, 3)), codeInvalidInput},
+		{"deadline", fmt.Errorf("query: %w", ctx.Err()), codeTimeout},
+		{"store error", &StoreError{Op: "insert event", Err: errors.New("disk I/O error")}, codeStoreError},
+		{"read-only store", (&EventStore{config: StoreConfig{ReadOnly: true}}).writable("merge"), codeStoreError},
+		{"untyped", errors.New("something else"), codeStoreError},
+	}
+	for _, tt := range tests {
+		if tt.err == nil {
+			t.Fatalf("%s: no error to classify", tt.name)
+		}
+		if got := errorCode(tt.err); got != tt.want {
+			t.Errorf("%s: errorCode(%v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRecordSeveralFilesReportsInvalidInput(t *testing.T) {
+	// Each file of a directory is recorded in turn, and the failing one is
+	// named in the error
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	if err := os.Mkdir(input, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.txt": "2023-08-14T10:00:00Z | 1 | login | {}\n",
+		"b.txt": "2023-08-14T10:00:00Z | 1 | login | {broken\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(input, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, stderr, code := runEventlog(t, "--error-format=json", "--db="+filepath.Join(dir, "events.db"), "record", input, "--strict")
+	if code != 1 {
+		t.Fatalf("exit code %d, want 1", code)
+	}
+	if got := jsonErrorCode(t, stderr); got != codeInvalidInput {
+		t.Errorf("code %s, want %s; stderr %q", got, codeInvalidInput, stderr)
+	}
+}
+
+func TestQueryWithoutReadOnlyDatabase(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	old := createOldDatabase(t, "2023-08-14T10:00:00Z")
+
+	tests := []struct {
+		name   string
+		db     string
+		events int
+	}{
+		{"missing file", missing, 0},
+		{"older schema", old, 1},
+		{"in memory", MemoryDBPath, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runEventlog(t, "--db="+tt.db, "query", "1")
+			if code != 0 {
+				t.Fatalf("query exited with %d: %s", code, stderr)
+			}
+			if lines := strings.Count(stdout, "\n"); lines != tt.events {
+				t.Errorf("query printed %d events, want %d: %q", lines, tt.events, stdout)
+			}
+		})
+	}
+
+	if version, err := storedSchemaVersion(old); err != nil || version != schemaVersion {
+		t.Errorf("old database at schema version %d after query, want %d: %v", version, schemaVersion, err)
+	}
+}
+
+func TestCanQueryReadOnly(t *testing.T) {
+	current := filepath.Join(t.TempDir(), "current.db")
+	store, err := NewEventStore(current)
+	if err != nil {
+		t.Fatalf("NewEventStore: %v", err)
+	}
+	store.Close()
+	old := createOldDatabase(t)
+	missing := filepath.Join(t.TempDir(), "missing.db")
+
+	tests := []struct {
+		paths []string
+		want  bool
+	}{
+		{[]string{current}, true},
+		{[]string{current, current}, true},
+		{[]string{old}, false},
+		{[]string{missing}, false},
+		{[]string{MemoryDBPath}, false},
+		{[]string{current, old}, false},
+	}
+	for _, tt := range tests {
+		if got := canQueryReadOnly(tt.paths); got != tt.want {
+			t.Errorf("canQueryReadOnly(%q) = %v, want %v", tt.paths, got, tt.want)
+		}
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("checking a missing database created it: %v", err)
+	}
+}
+
+func TestCommandsRefuseStrayArguments(t *testing.T) {
+	// Flags after the stray argument are parsed too, so it is the argument,
+	// not a flag silently dropped, that is reported
+	commands := [][]string{
+		{"top-users", "stray", "--limit=3"},
+		{"checkpoint", "stray", "--format=json"},
+		{"check", "stray", "--format=json"},
+		{"find-duplicates", "stray", "--limit=3"},
+		{"stats", "stray", "--format=json"},
+		{"cardinality", "--field=payload.page", "stray", "--approx"},
+		{"merge", "stray", "--from=other.db"},
+		{"rebuild-summary", "stray", "--drop"},
+		{"bench", "stray", "--events=10"},
+	}
+	for _, args := range commands {
+		db := filepath.Join(t.TempDir(), "events.db")
+		_, stderr, code := runEventlog(t, append([]string{"--db=" + db, "--error-format=json"}, args...)...)
+		if code == 0 {
+			t.Errorf("%s: exited 0, want a usage error", strings.Join(args, " "))
+			continue
+		}
+		if got := jsonErrorCode(t, stderr); got != codeUsage {
+			t.Errorf("%s: error code %q, want %q", strings.Join(args, " "), got, codeUsage)
+		}
+	}
+
+	stdout, stderr, code := runEventlog(t, "--db=:memory:", "top-users", "--format=json", "--limit=3")
+	if code != 0 || strings.TrimSpace(stdout) == "" {
+		t.Errorf("top-users with flags exited %d: %q %s", code, stdout, stderr)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// mergeInput is one time-sorted file taking part in a k-way merge
+type mergeInput struct {
+	name      string
+	delimiter string
+	index     int // position on the command line, breaks timestamp ties
+	file      io.ReadCloser
+	scanner   *lineReader
+
+	line      string
+	lineErr   error // from the line reader, e.g. line too long
+	timestamp time.Time
+	lineNum   int
+	warned    bool
+}
+
+// advance reads the next non-empty line. Lines whose timestamp cannot be
+// parsed keep the previous timestamp so they flow through in file order and
+// are reported by the parser later.
+func (mi *mergeInput) advance() (bool, error) {
+	for mi.scanner.Scan() {
+		mi.lineNum++
+		line := mi.scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		mi.line = line
+		mi.lineErr = mi.scanner.LineErr()
+		if mi.lineErr != nil {
+			return true, nil
+		}
+		leading, _, _ := strings.Cut(line, mi.delimiter)
+		timestamp, err := parseFlexibleTime(strings.TrimSpace(leading))
+		if err != nil {
+			return true, nil
+		}
+
+		if timestamp.Before(mi.timestamp) && !mi.warned {
+			logger.Warnf("%s is not sorted by timestamp (line %d); merged order will not be global", mi.name, mi.lineNum)
+			mi.warned = true
+		}
+		mi.timestamp = timestamp
+		return true, nil
+	}
+	return false, mi.scanner.Err()
+}
+
+// mergeHeap orders inputs by the timestamp of their current line
+type mergeHeap []*mergeInput
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].timestamp.Equal(h[j].timestamp) {
+		return h[i].index < h[j].index
+	}
+	return h[i].timestamp.Before(h[j].timestamp)
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeInput)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// sortedMerge is a lineSource yielding lines from several time-sorted files
+// in global timestamp order
+type sortedMerge struct {
+	inputs  []*mergeInput
+	heap    mergeHeap
+	line    string
+	lineErr error
+	err     error
+
+	// origin of the current line, for Position
+	lineFile string
+	lineNum  int
+}
+
+// newSortedMerge opens every file and primes the merge heap. The delimiter
+// locates each line's leading timestamp; lines longer than maxLine bytes
+// are reported through LineErr.
+func newSortedMerge(filenames []string, delimiter string, maxLine int) (*sortedMerge, error) {
+	merge := &sortedMerge{}
+	for i, name := range filenames {
+		file, err := openInput(name)
+		if err != nil {
+			merge.Close()
+			return nil, err
+		}
+
+		input := &mergeInput{
+			name:      name,
+			delimiter: delimiter,
+			index:     i,
+			file:      file,
+			scanner:   newLineReader(file, maxLine),
+		}
+		merge.inputs = append(merge.inputs, input)
+
+		ok, err := input.advance()
+		if err != nil {
+			merge.Close()
+			return nil, fmt.Errorf("error reading %s: %v", name, err)
+		}
+		if ok {
+			merge.heap = append(merge.heap, input)
+		}
+	}
+
+	heap.Init(&merge.heap)
+	return merge, nil
+}
+
+// Scan moves to the earliest pending line across all inputs
+func (sm *sortedMerge) Scan() bool {
+	if sm.err != nil || sm.heap.Len() == 0 {
+		return false
+	}
+
+	input := sm.heap[0]
+	sm.line = input.line
+	sm.lineErr = input.lineErr
+	sm.lineFile = input.name
+	sm.lineNum = input.lineNum
+
+	ok, err := input.advance()
+	if err != nil {
+		sm.err = fmt.Errorf("error reading %s: %v", input.name, err)
+		return false
+	}
+	if ok {
+		heap.Fix(&sm.heap, 0)
+	} else {
+		heap.Pop(&sm.heap)
+	}
+	return true
+}
+
+// Text returns the line selected by the last call to Scan
+func (sm *sortedMerge) Text() string {
+	return sm.line
+}
+
+// LineErr reports why the current line cannot be used, if it cannot
+func (sm *sortedMerge) LineErr() error {
+	return sm.lineErr
+}
+
+// Position describes the file and line number of the current line
+func (sm *sortedMerge) Position() string {
+	return fmt.Sprintf("%s line %d", sm.lineFile, sm.lineNum)
+}
+
+// Err returns the first read error encountered
+func (sm *sortedMerge) Err() error {
+	return sm.err
+}
+
+// Close closes all underlying files
+func (sm *sortedMerge) Close() {
+	for _, input := range sm.inputs {
+		input.file.Close()
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// migration is one step of the schema history. Step i of migrations brings
+// a database from version i to version i+1; the version is kept in SQLite's
+// PRAGMA user_version.
+type migration struct {
+	description string
+	statements  []string
+}
+
+// migrations is the ordered schema history. Only ever append to it: opened
+// databases record how many steps they have applied.
+var migrations = []migration{
+	{
+		// IF NOT EXISTS lets databases created before versioning, which
+		// report version 0, adopt the history without changes
+		description: "create events table and indexes",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS events (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				timestamp TEXT NOT NULL,
+				event_type TEXT NOT NULL,
+				payload TEXT NOT NULL
+			)`,
+			"CREATE INDEX IF NOT EXISTS idx_user_timestamp ON events(user_id, timestamp)",
+			"CREATE INDEX IF NOT EXISTS idx_user_type_timestamp ON events(user_id, event_type, timestamp)",
+			"CREATE INDEX IF NOT EXISTS idx_type_timestamp ON events(event_type, timestamp)", // all-users queries
+		},
+	},
+	{
+		// Earlier releases could store offsets such as +02:00 or
+		// fractional seconds, which break text comparison. Text SQLite
+		// cannot read as a time is left alone.
+		description: "normalize timestamps to UTC",
+		statements: []string{
+			`UPDATE events SET timestamp = strftime('%Y-%m-%dT%H:%M:%SZ', timestamp)
+			WHERE timestamp NOT GLOB '[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]T[0-9][0-9]:[0-9][0-9]:[0-9][0-9]Z'
+			AND strftime('%Y-%m-%dT%H:%M:%SZ', timestamp) IS NOT NULL`,
+		},
+	},
+	{
+		// Timestamps keep nanoseconds now. Whole seconds gain nine zero
+		// digits so that old and new values still compare as text.
+		description: "store timestamps with nanoseconds",
+		statements: []string{
+			`UPDATE events SET timestamp = ` + storedTimeSQL + `
+			WHERE timestamp NOT GLOB '` + storedTimeGlob + `'
+			AND ` + storedTimeSQL + ` IS NOT NULL`,
+		},
+	},
+	{
+		// What a database keeps about itself, such as whether its event
+		// types are normalized
+		description: "create settings table",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS settings (
+				key TEXT PRIMARY KEY,
+				value TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		// When each event was recorded, apart from when it happened.
+		// SQLite cannot add a column defaulting to the current time, so
+		// inserts set it and older events are left NULL, as unknown.
+		description: "add ingested_at column",
+		statements: []string{
+			"ALTER TABLE events ADD COLUMN ingested_at TEXT",
+		},
+	},
+}
+
+// schemaVersion is the schema version this binary expects
+var schemaVersion = len(migrations)
+
+// migrate applies the migrations a database is missing, each in its own
+// transaction together with the version bump, and refuses databases written
+// by a newer binary
+func migrate(db *sql.DB) error {
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d); upgrade eventlog", version, schemaVersion)
+	}
+
+	for ; version < schemaVersion; version++ {
+		step := migrations[version]
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration: %v", err)
+		}
+		for _, statement := range step.statements {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s) failed: %v", version+1, step.description, err)
+			}
+		}
+		// PRAGMA does not take parameters; version is an int
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %v", version+1, step.description, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %v", version+1, err)
+		}
+	}
+	return nil
+}
+
+// checkSchemaVersion refuses a database that is not at this binary's schema
+// version, for stores that cannot migrate it
+func checkSchemaVersion(db *sql.DB) error {
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d); upgrade eventlog", version, schemaVersion)
+	}
+	if version < schemaVersion {
+		return fmt.Errorf("database schema version %d needs migrating to %d, which cannot be done read-only; open it for writing once, as query --read-write does", version, schemaVersion)
+	}
+	return nil
+}
+
+// readSchemaVersion returns the number of migrations applied to a database
+func readSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// storedSchemaVersion opens dbPath read-only just long enough to read its
+// schema version. Unlike opening a store, it never creates the file.
+func storedSchemaVersion(dbPath string) (int, error) {
+	dsn := fileURI(dbPath)
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open(driverName, dsn+separator+"mode=ro")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	return readSchemaVersion(db)
+}
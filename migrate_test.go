@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// createOldDatabase creates a database at schema version 0 holding the
+// given timestamps for user 1, as releases before migrations wrote them
+func createOldDatabase(t *testing.T, timestamps ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open(driverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	statements := []string{
+		`CREATE TABLE events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			timestamp TEXT NOT NULL,
+			event_type TEXT NOT NULL,
+			payload TEXT NOT NULL
+		)`,
+		"CREATE INDEX idx_user_timestamp ON events(user_id, timestamp)",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, timestamp := range timestamps {
+		if _, err := db.Exec("INSERT INTO events (user_id, timestamp, event_type, payload) VALUES (1, ?, 'login', '{}')", timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// storedTimestamps returns the timestamp column as stored, in ID order
+func storedTimestamps(t *testing.T, store *EventStore) []string {
+	t.Helper()
+	rows, err := store.db.Query("SELECT timestamp FROM events ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var timestamps []string
+	for rows.Next() {
+		var timestamp string
+		if err := rows.Scan(&timestamp); err != nil {
+			t.Fatal(err)
+		}
+		timestamps = append(timestamps, timestamp)
+	}
+	return timestamps
+}
+
+func TestMigrateNormalizesTimestampsToUTC(t *testing.T) {
+	path := createOldDatabase(t,
+		"2023-08-14T12:00:00+02:00",
+		"2023-08-14T10:00:00+00:00",
+		"2023-08-14T10:00:00Z",
+		"2023-08-14T05:30:00-04:30",
+		"not a time",
+	)
+
+	store, err := NewEventStore(path)
+	if err != nil {
+		t.Fatalf("NewEventStore: %v", err)
+	}
+	defer store.Close()
+
+	version, err := readSchemaVersion(store.db)
+	if err != nil || version != schemaVersion {
+		t.Fatalf("schema version %d, %v; want %d", version, err, schemaVersion)
+	}
+	want := []string{
+		"2023-08-14T10:00:00.000000000Z",
+		"2023-08-14T10:00:00.000000000Z",
+		"2023-08-14T10:00:00.000000000Z",
+		"2023-08-14T10:00:00.000000000Z",
+		"not a time", // left alone rather than lost
+	}
+	got := storedTimestamps(t, store)
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: stored %q, want %q", i+1, got[i], want[i])
+		}
+	}
+
+	// Every form of the same instant now matches one time filter
+	count, err := store.Count(1, QueryFilters{From: testBase, To: testBase})
+	if err != nil || count != 4 {
+		t.Errorf("Count at the instant: %d, %v; want 4", count, err)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	path := createOldDatabase(t, "2023-08-14T12:00:00+02:00")
+	for i := 0; i < 2; i++ {
+		store, err := NewEventStore(path)
+		if err != nil {
+			t.Fatalf("open %d: %v", i+1, err)
+		}
+		got := storedTimestamps(t, store)
+		store.Close()
+		if len(got) != 1 || got[0] != "2023-08-14T10:00:00.000000000Z" {
+			t.Fatalf("open %d: stored %q", i+1, got)
+		}
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	path := createOldDatabase(t)
+	db, err := sql.Open(driverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("PRAGMA user_version = 1000"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if store, err := NewEventStore(path); err == nil {
+		store.Close()
+		t.Error("a database from a newer release was opened")
+	}
+}
+
+func TestMigrateAddsNanoseconds(t *testing.T) {
+	// Version 2 stored whole seconds in UTC
+	path := createOldDatabase(t, "2023-08-14T10:00:01Z", "2023-08-14T10:00:00Z")
+	db, err := sql.Open(driverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("PRAGMA user_version = 2"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := NewEventStore(path)
+	if err != nil {
+		t.Fatalf("NewEventStore: %v", err)
+	}
+	defer store.Close()
+	got := storedTimestamps(t, store)
+	want := []string{"2023-08-14T10:00:01.000000000Z", "2023-08-14T10:00:00.000000000Z"}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("stored %q, want %q", got, want)
+	}
+
+	// A sub-second event recorded afterwards sorts between the old ones
+	input := writeTestInput(t, "2023-08-14T10:00:00.5Z | 1 | logout | {}")
+	if _, _, err := store.Record(input, RecordOptions{}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	events, err := store.QueryEvents(1, QueryFilters{})
+	if err != nil || len(events) != 3 {
+		t.Fatalf("QueryEvents: %d events, %v", len(events), err)
+	}
+	if events[1].EventType != "logout" {
+		t.Errorf("the half-second event sorted at %v, want second", events[1].Timestamp)
+	}
+}
@@ -1,68 +1,482 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // single event struct in the system
 type Event struct {
+	ID        int64           `json:"id,omitempty"` // row ID, set on events read from the store
 	Timestamp time.Time       `json:"timestamp"`
 	UserID    int64           `json:"user_id"`
 	EventType string          `json:"event_type"`
 	Payload   json.RawMessage `json:"payload"`
+
+	// IngestedAt is when the event was recorded, set on events read from
+	// the store with OutputOptions.ShowIngested; zero if unknown
+	IngestedAt time.Time `json:"-"`
+
+	extracted []string // payload values selected in SQL, see QueryFilters.extract
 }
 
 // filters for querying events
 type QueryFilters struct {
-	EventType string
-	From      time.Time
-	To        time.Time
+	EventTypes []string // match any of these types; empty matches all
+	From       time.Time
+	To         time.Time
+	Limit      int    // maximum number of events to return, 0 means no limit
+	Offset     int    // number of matching events to skip
+	Order      string // OrderAsc (default when empty) or OrderDesc
+
+	// DedupeWindow suppresses repeats of the same user, type and payload
+	// that occur within this duration of the last emitted occurrence
+	DedupeWindow time.Duration
+
+	// PayloadConditions must all hold for an event to match
+	PayloadConditions []PayloadCondition
+
+	// HasKeys and MissingKeys are payload keys (optionally prefixed with
+	// "payload.") that must be present, whatever their value, or absent
+	HasKeys     []string
+	MissingKeys []string
+
+	// AllUsers drops the user condition so events of every user match; the
+	// user ID passed alongside the filters is ignored
+	AllUsers bool
+
+	// UserRange replaces the user condition with the inclusive range of
+	// user IDs FromUser to ToUser; the user ID passed alongside the filters
+	// is ignored
+	UserRange bool
+	FromUser  int64
+	ToUser    int64
+
+	// ID selects the event with this row ID; FromID and ToID select an
+	// inclusive range of row IDs. Zero leaves the bound open.
+	ID     int64
+	FromID int64
+	ToID   int64
+
+	// SortPayload orders events by this payload key, in SortDir order
+	// (OrderAsc when empty), before the timestamp order. SortNumeric
+	// compares the values as numbers, so "10" sorts after "9".
+	SortPayload string
+	SortDir     string
+	SortNumeric bool
+
+	// Sample, when between 0 and 1, keeps roughly that fraction of the
+	// matching events, picked by hashing each ID with Seed so that the same
+	// seed picks the same events. Zero keeps every event.
+	Sample float64
+	Seed   int64
+
+	// IngestedFrom and IngestedTo bound when events were recorded rather
+	// than when they happened. Events recorded before ingest times were
+	// kept have none and never match.
+	IngestedFrom time.Time
+	IngestedTo   time.Time
+
+	// ingested also selects the ingested_at column into Event.IngestedAt
+	ingested bool
+
+	// omitPayload selects NULL instead of the payload, for output that
+	// never shows it
+	omitPayload bool
+
+	// rawPayloads guards the SQL JSON functions against payloads that are
+	// not JSON, set for stores holding payloads recorded without validation
+	rawPayloads bool
+
+	// extract selects these payload paths with json_extract as extra
+	// columns, read into Event.extracted with NULL as ""
+	extract []string
+}
+
+// sort orders for QueryFilters.Order
+const (
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+// PayloadCondition compares a payload field with a value, e.g. price>50
+type PayloadCondition struct {
+	Field string      // payload key, optionally prefixed with "payload."
+	Op    string      // one of =, >, <, >=, <=
+	Value interface{} // float64 for numeric comparisons, otherwise string
+}
+
+// payloadOperators lists the supported comparison operators, longest first
+// so that ">=" is not read as ">"
+var payloadOperators = []string{">=", "<=", "=", ">", "<"}
+
+// ParsePayloadCondition parses expressions such as "ip=10.0.0.1" or
+// "price>50". Values that parse as numbers are compared numerically.
+func ParsePayloadCondition(expr string) (PayloadCondition, error) {
+	index := strings.IndexAny(expr, "=<>")
+	if index <= 0 {
+		return PayloadCondition{}, fmt.Errorf("invalid payload condition %q: expected <key><op><value>", expr)
+	}
+
+	field := strings.TrimSpace(expr[:index])
+	rest := expr[index:]
+	for _, op := range payloadOperators {
+		if strings.HasPrefix(rest, op) {
+			raw := strings.TrimSpace(rest[len(op):])
+			condition := PayloadCondition{Field: field, Op: op, Value: raw}
+			if number, err := strconv.ParseFloat(raw, 64); err == nil {
+				condition.Value = number
+			}
+			return condition, condition.Validate()
+		}
+	}
+	return PayloadCondition{}, fmt.Errorf("invalid payload condition %q: unknown operator", expr)
+}
+
+// Validate checks the field name and operator
+func (pc *PayloadCondition) Validate() error {
+	if _, err := payloadPath(pc.Field); err != nil {
+		return err
+	}
+	for _, op := range payloadOperators {
+		if pc.Op == op {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported payload operator %q", pc.Op)
 }
 
 // returns the event in the required output format
 func (e *Event) String() string {
-	return fmt.Sprintf("%s | %d | %s | %s",
-		e.Timestamp.Format(time.RFC3339),
-		e.UserID,
-		e.EventType,
-		string(e.Payload))
+	return defaultParser.Format(e)
+}
+
+// output formats accepted by Event.MarshalLine
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// MarshalLine renders the event as a single output line without a trailing
+// newline. Text uses the pipe-delimited input format, json a compact object
+// with an RFC3339 timestamp and the payload embedded as JSON, and csv one
+// quoted CSVRecord row.
+func (e *Event) MarshalLine(format string) ([]byte, error) {
+	switch format {
+	case FormatText, "":
+		return []byte(e.String()), nil
+	case FormatJSON:
+		return json.Marshal(struct {
+			ID        int64           `json:"id,omitempty"`
+			Timestamp string          `json:"timestamp"`
+			UserID    int64           `json:"user_id"`
+			EventType string          `json:"event_type"`
+			Payload   json.RawMessage `json:"payload"`
+		}{
+			ID:        e.ID,
+			Timestamp: e.Timestamp.Format(time.RFC3339Nano),
+			UserID:    e.UserID,
+			EventType: e.EventType,
+			Payload:   e.payloadJSON(),
+		})
+	case FormatCSV:
+		return marshalCSVLine(e.CSVRecord())
+	default:
+		return nil, fmt.Errorf("unknown output format: %s", format)
+	}
 }
 
 // parses a line from the input file into an Event
 func ParseEvent(line string) (*Event, error) {
-	// Split by " | "
-	parts := strings.Split(line, " | ")
+	return defaultParser.Parse(line)
+}
+
+// DefaultDelimiter separates the fields of the line format
+const DefaultDelimiter = " | "
+
+// Parser reads and writes the line format
+// (timestamp, user ID, event type, payload) with a configurable delimiter.
+// An empty Delimiter means DefaultDelimiter.
+type Parser struct {
+	Delimiter string
+
+	// EmptyPayload decides what happens to lines whose payload is empty or
+	// only whitespace: EmptyPayloadNull (the default when empty) stores JSON
+	// null, EmptyPayloadObject stores {} and EmptyPayloadReject makes the
+	// line invalid
+	EmptyPayload string
+
+	// RawPayload keeps the payload text as given, trimmed, without checking
+	// that it is JSON
+	RawPayload bool
+
+	// Location is the zone Format writes timestamps in; nil means UTC
+	Location *time.Location
+}
+
+// values for Parser.EmptyPayload
+const (
+	EmptyPayloadNull   = "null"
+	EmptyPayloadObject = "{}"
+	EmptyPayloadReject = "reject"
+)
+
+var defaultParser = &Parser{Delimiter: DefaultDelimiter}
+
+// Validate checks that the delimiter can be used in the line format
+func (p *Parser) Validate() error {
+	if strings.ContainsAny(p.Delimiter, "\r\n") {
+		return fmt.Errorf("delimiter cannot contain a newline")
+	}
+	switch p.EmptyPayload {
+	case EmptyPayloadNull, EmptyPayloadObject, EmptyPayloadReject, "":
+	default:
+		return fmt.Errorf("invalid empty payload handling %q (expected null, {} or reject)", p.EmptyPayload)
+	}
+	return nil
+}
+
+func (p *Parser) delimiter() string {
+	if p.Delimiter == "" {
+		return DefaultDelimiter
+	}
+	return p.Delimiter
+}
+
+// Parse parses one line into an Event
+func (p *Parser) Parse(line string) (*Event, error) {
+	// Split on the first three delimiters only, so the payload may contain it
+	parts := strings.SplitN(line, p.delimiter(), 4)
 	if len(parts) != 4 {
-		return nil, fmt.Errorf("invalid format: expected 4 parts, got %d", len(parts))
+		return nil, parseErrorf(ErrInvalidFormat, "invalid format: expected 4 parts, got %d", len(parts))
 	}
-	
+	return parseEventFields(parts, p.EmptyPayload, p.RawPayload)
+}
+
+// Format renders the event as one line that Parse reads back. A missing
+// payload is written as null.
+func (p *Parser) Format(e *Event) string {
+	delimiter := p.delimiter()
+	timestamp := e.Timestamp
+	if p.Location != nil {
+		timestamp = timestamp.In(p.Location)
+	}
+	return timestamp.Format(time.RFC3339Nano) + delimiter +
+		strconv.FormatInt(e.UserID, 10) + delimiter +
+		e.EventType + delimiter +
+		e.payloadString()
+}
+
+// Validate checks that an event built in code, rather than parsed, can be
+// stored. A missing payload is stored as null.
+func (e *Event) Validate() error {
+	if e.Timestamp.IsZero() {
+		return fmt.Errorf("missing timestamp")
+	}
+	if strings.TrimSpace(e.EventType) == "" {
+		return fmt.Errorf("empty event type")
+	}
+	if len(e.Payload) > 0 && !json.Valid(e.Payload) {
+		return fmt.Errorf("invalid JSON payload")
+	}
+	return nil
+}
+
+// payloadString returns the payload JSON, or null if there is none
+func (e *Event) payloadString() string {
+	if len(e.Payload) == 0 {
+		return EmptyPayloadNull
+	}
+	return string(e.Payload)
+}
+
+// payloadJSON returns the payload for embedding in JSON output. A payload
+// recorded without JSON validation that is not JSON becomes a JSON string.
+func (e *Event) payloadJSON() json.RawMessage {
+	if len(e.Payload) == 0 {
+		return json.RawMessage(EmptyPayloadNull)
+	}
+	if !json.Valid(e.Payload) {
+		quoted, _ := json.Marshal(string(e.Payload))
+		return quoted
+	}
+	return e.Payload
+}
+
+// ParseEventCSV parses a CSV record (timestamp,user_id,event_type,payload)
+// into an Event. The payload field must hold the JSON document, quoted as
+// needed by the CSV encoding; it is compacted since quoted fields may span
+// several lines. An empty payload is stored as null.
+func ParseEventCSV(record []string) (*Event, error) {
+	return defaultParser.ParseCSV(record)
+}
+
+// ParseCSV is ParseEventCSV with the parser's empty payload handling. The
+// delimiter does not apply, and the payload must always be JSON.
+func (p *Parser) ParseCSV(record []string) (*Event, error) {
+	if len(record) != 4 {
+		return nil, parseErrorf(ErrInvalidFormat, "invalid format: expected 4 fields, got %d", len(record))
+	}
+	event, err := parseEventFields(record, p.EmptyPayload, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, event.Payload); err != nil {
+		return nil, parseErrorf(ErrInvalidPayload, "invalid JSON payload: %v", err)
+	}
+	event.Payload = compact.Bytes()
+	return event, nil
+}
+
+// ParseEventJSON parses one NDJSON line holding an event in the shape
+// MarshalLine writes with FormatJSON. timestamp, user_id and event_type are
+// required; a missing payload is stored as null. The payload is compacted.
+func ParseEventJSON(line []byte) (*Event, error) {
+	if !utf8.Valid(line) {
+		return nil, parseErrorf(errInvalidUTF8, "invalid UTF-8 in line")
+	}
+
+	var fields struct {
+		Timestamp *string         `json:"timestamp"`
+		UserID    *int64          `json:"user_id"`
+		EventType *string         `json:"event_type"`
+		Payload   json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			if typeErr.Field == "" {
+				return nil, parseErrorf(ErrInvalidFormat, "invalid format: got %s, expected an event object", typeErr.Value)
+			}
+			return nil, parseErrorf(jsonFieldErrors[typeErr.Field], "invalid %s: got %s, expected %s", typeErr.Field, typeErr.Value, jsonFieldKinds[typeErr.Field])
+		}
+		return nil, parseErrorf(ErrInvalidFormat, "invalid JSON: %v", err)
+	}
+
+	switch {
+	case fields.Timestamp == nil:
+		return nil, parseErrorf(ErrInvalidTimestamp, "missing timestamp")
+	case fields.UserID == nil:
+		return nil, parseErrorf(ErrInvalidUserID, "missing user_id")
+	case fields.EventType == nil:
+		return nil, parseErrorf(ErrInvalidEventType, "missing event_type")
+	}
+
+	timestamp, err := parseFlexibleTime(strings.TrimSpace(*fields.Timestamp))
+	if err != nil {
+		return nil, parseErrorf(ErrInvalidTimestamp, "invalid timestamp: %v", err)
+	}
+	eventType := strings.TrimSpace(*fields.EventType)
+	if eventType == "" {
+		return nil, parseErrorf(ErrInvalidEventType, "empty event type")
+	}
+
+	payload := json.RawMessage(EmptyPayloadNull)
+	if len(fields.Payload) > 0 {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, fields.Payload); err != nil {
+			return nil, parseErrorf(ErrInvalidPayload, "invalid JSON payload: %v", err)
+		}
+		payload = compact.Bytes()
+	}
+
+	return &Event{
+		Timestamp: timestamp,
+		UserID:    *fields.UserID,
+		EventType: eventType,
+		Payload:   payload,
+	}, nil
+}
+
+// canonicalizeJSON rewrites a JSON document in a canonical form: object
+// keys sorted, no insignificant whitespace and no HTML escaping. Numbers
+// keep their original text.
+func canonicalizeJSON(raw json.RawMessage) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, parseErrorf(ErrInvalidPayload, "invalid JSON payload: %v", err)
+	}
+
+	// encoding/json writes map keys in sorted order
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, fmt.Errorf("failed to canonicalize payload: %v", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// jsonFieldKinds describes the value each typed NDJSON field needs, for
+// error messages
+var jsonFieldKinds = map[string]string{
+	"timestamp":  "a string",
+	"user_id":    "an integer",
+	"event_type": "a string",
+}
+
+// jsonFieldErrors is the parse error reason for a mistyped NDJSON field
+var jsonFieldErrors = map[string]error{
+	"timestamp":  ErrInvalidTimestamp,
+	"user_id":    ErrInvalidUserID,
+	"event_type": ErrInvalidEventType,
+}
+
+// parseEventFields validates the four raw fields of an event shared by all
+// input formats. An empty payload is handled as described for
+// Parser.EmptyPayload and rawPayload skips the JSON check as for
+// Parser.RawPayload.
+func parseEventFields(parts []string, emptyPayload string, rawPayload bool) (*Event, error) {
+	for _, part := range parts {
+		if !utf8.ValidString(part) {
+			return nil, parseErrorf(errInvalidUTF8, "invalid UTF-8 in line")
+		}
+	}
+
 	// Parse timestamp
-	timestamp, err := time.Parse(time.RFC3339, strings.TrimSpace(parts[0]))
+	timestamp, err := parseFlexibleTime(strings.TrimSpace(parts[0]))
 	if err != nil {
-		return nil, fmt.Errorf("invalid timestamp: %v", err)
+		return nil, parseErrorf(ErrInvalidTimestamp, "invalid timestamp: %v", err)
 	}
 	
 	// Parse user ID
 	userID, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("invalid user ID: %v", err)
+		return nil, parseErrorf(ErrInvalidUserID, "invalid user ID: %v", err)
 	}
 	
 	// Event type
 	eventType := strings.TrimSpace(parts[2])
 	if eventType == "" {
-		return nil, fmt.Errorf("empty event type")
+		return nil, parseErrorf(ErrInvalidEventType, "empty event type")
 	}
 	
 	// Parse payload JSON
 	payloadStr := strings.TrimSpace(parts[3])
+	if payloadStr == "" {
+		switch emptyPayload {
+		case EmptyPayloadReject:
+			return nil, parseErrorf(fmt.Errorf("%w: %w", ErrInvalidPayload, ErrEmptyPayload), "invalid JSON payload: empty payload")
+		case EmptyPayloadObject:
+			payloadStr = EmptyPayloadObject
+		default:
+			payloadStr = EmptyPayloadNull
+		}
+	}
 	var payload json.RawMessage
-	if err := json.Unmarshal([]byte(payloadStr), &payload); err != nil {
-		return nil, fmt.Errorf("invalid JSON payload: %v", err)
+	if rawPayload {
+		payload = json.RawMessage(payloadStr)
+	} else if err := json.Unmarshal([]byte(payloadStr), &payload); err != nil {
+		return nil, parseErrorf(ErrInvalidPayload, "invalid JSON payload: %v", err)
 	}
 	
 	return &Event{
@@ -73,15 +487,298 @@ func ParseEvent(line string) (*Event, error) {
 	}, nil
 }
 
+// payloadPath converts a payload field reference such as "page",
+// "payload.page" or "payload.meta.id" into a SQLite JSON path ("$.page").
+// Each segment must be a simple identifier so it is safe in a JSON path.
+func payloadPath(field string) (string, error) {
+	name := strings.TrimPrefix(field, "payload.")
+	if name == "" {
+		return "", fmt.Errorf("empty payload field")
+	}
+
+	for _, segment := range strings.Split(name, ".") {
+		if !isIdentifier(segment) {
+			return "", fmt.Errorf("invalid payload field %q: segments must be letters, digits or underscores", field)
+		}
+	}
+	return "$." + name, nil
+}
+
+// isIdentifier reports whether s is a non-empty run of letters, digits and
+// underscores that does not start with a digit
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// flexibleTimeLayouts are tried in order by parseFlexibleTime. Layouts
+// without a zone are interpreted as UTC, or in the zone given to
+// parseTimeIn.
+var flexibleTimeLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// parseFlexibleTime parses RFC3339 (with or without fractional seconds),
+// "2006-01-02 15:04:05" and all-digit Unix epoch seconds, returning UTC
+func parseFlexibleTime(s string) (time.Time, error) {
+	return parseTimeIn(s, time.UTC)
+}
+
+// parseTimeIn is parseFlexibleTime reading times without a zone, such as
+// "2006-01-02 15:04:05", as local time in loc. The result is still UTC.
+func parseTimeIn(s string, loc *time.Location) (time.Time, error) {
+	if s != "" && strings.Trim(s, "0123456789") == "" {
+		seconds, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch seconds %q: %v", s, err)
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+
+	for _, layout := range flexibleTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time format %q", s)
+}
+
 // IsEmpty checks if QueryFilters has any active filters
 func (qf *QueryFilters) IsEmpty() bool {
-	return qf.EventType == "" && qf.From.IsZero() && qf.To.IsZero()
+	return len(qf.EventTypes) == 0 && qf.From.IsZero() && qf.To.IsZero() &&
+		len(qf.PayloadConditions) == 0 && len(qf.HasKeys) == 0 && len(qf.MissingKeys) == 0
+}
+
+// bounded reports whether the filters limit how many events of all users
+// can match: a time or ingest time range, an event ID or ID range, or a
+// limit
+func (qf *QueryFilters) bounded() bool {
+	return !qf.From.IsZero() || !qf.To.IsZero() || qf.Limit > 0 ||
+		!qf.IngestedFrom.IsZero() || !qf.IngestedTo.IsZero() ||
+		qf.ID != 0 || (qf.FromID != 0 && qf.ToID != 0)
+}
+
+// describe returns the filters that are set, keyed by the name of their
+// query flag, for machine-readable reports. userID is included unless the
+// filters select all users or a user range.
+func (qf *QueryFilters) describe(userID int64) map[string]interface{} {
+	described := make(map[string]interface{})
+	switch {
+	case qf.AllUsers:
+		described["all_users"] = true
+	case qf.UserRange:
+		described["user_from"] = qf.FromUser
+		described["user_to"] = qf.ToUser
+	default:
+		described["user_id"] = userID
+	}
+	if len(qf.EventTypes) > 0 {
+		described["type"] = qf.EventTypes
+	}
+	if !qf.From.IsZero() {
+		described["from"] = qf.From.UTC().Format(time.RFC3339Nano)
+	}
+	if !qf.To.IsZero() {
+		described["to"] = qf.To.UTC().Format(time.RFC3339Nano)
+	}
+	if !qf.IngestedFrom.IsZero() {
+		described["ingested_from"] = qf.IngestedFrom.UTC().Format(time.RFC3339Nano)
+	}
+	if !qf.IngestedTo.IsZero() {
+		described["ingested_to"] = qf.IngestedTo.UTC().Format(time.RFC3339Nano)
+	}
+	if qf.Limit > 0 {
+		described["limit"] = qf.Limit
+	}
+	if qf.Offset > 0 {
+		described["offset"] = qf.Offset
+	}
+	described["order"] = OrderAsc
+	if qf.Order == OrderDesc {
+		described["order"] = OrderDesc
+	}
+	if qf.DedupeWindow > 0 {
+		described["dedupe_window"] = qf.DedupeWindow.String()
+	}
+	if len(qf.PayloadConditions) > 0 {
+		conditions := make([]string, len(qf.PayloadConditions))
+		for i, condition := range qf.PayloadConditions {
+			conditions[i] = fmt.Sprintf("%s%s%v", condition.Field, condition.Op, condition.Value)
+		}
+		described["where_payload"] = conditions
+	}
+	if len(qf.HasKeys) > 0 {
+		described["has_key"] = qf.HasKeys
+	}
+	if len(qf.MissingKeys) > 0 {
+		described["missing_key"] = qf.MissingKeys
+	}
+	if qf.ID != 0 {
+		described["id"] = qf.ID
+	}
+	if qf.FromID != 0 || qf.ToID != 0 {
+		described["id_range"] = fmt.Sprintf("%d-%d", qf.FromID, qf.ToID)
+	}
+	if qf.SortPayload != "" {
+		described["sort_payload"] = qf.SortPayload
+		described["sort_dir"] = OrderAsc
+		if qf.SortDir == OrderDesc {
+			described["sort_dir"] = OrderDesc
+		}
+		described["sort_numeric"] = qf.SortNumeric
+	}
+	if qf.Sample > 0 {
+		described["sample"] = qf.Sample
+		described["seed"] = qf.Seed
+	}
+	return described
 }
 
 // Validate checks if the query filters are valid
 func (qf *QueryFilters) Validate() error {
+	for _, eventType := range qf.EventTypes {
+		if strings.TrimSpace(eventType) == "" {
+			return fmt.Errorf("event type cannot be empty")
+		}
+	}
 	if !qf.From.IsZero() && !qf.To.IsZero() && qf.From.After(qf.To) {
 		return fmt.Errorf("from time cannot be after to time")
 	}
+	if !qf.IngestedFrom.IsZero() && !qf.IngestedTo.IsZero() && qf.IngestedFrom.After(qf.IngestedTo) {
+		return fmt.Errorf("ingested from time cannot be after ingested to time")
+	}
+	if qf.UserRange && qf.AllUsers {
+		return fmt.Errorf("a user range cannot be combined with all users")
+	}
+	if qf.UserRange && qf.FromUser > qf.ToUser {
+		return fmt.Errorf("user range start cannot be after its end")
+	}
+	if qf.ID < 0 || qf.FromID < 0 || qf.ToID < 0 {
+		return fmt.Errorf("event IDs cannot be negative")
+	}
+	if qf.ID != 0 && (qf.FromID != 0 || qf.ToID != 0) {
+		return fmt.Errorf("an event ID cannot be combined with an ID range")
+	}
+	if qf.FromID != 0 && qf.ToID != 0 && qf.FromID > qf.ToID {
+		return fmt.Errorf("ID range start cannot be after its end")
+	}
+	if qf.Limit < 0 {
+		return fmt.Errorf("limit cannot be negative")
+	}
+	if qf.Offset < 0 {
+		return fmt.Errorf("offset cannot be negative")
+	}
+	if qf.Order != "" && qf.Order != OrderAsc && qf.Order != OrderDesc {
+		return fmt.Errorf("invalid order %q (expected asc or desc)", qf.Order)
+	}
+	if qf.DedupeWindow < 0 {
+		return fmt.Errorf("dedupe window cannot be negative")
+	}
+	if qf.SortPayload != "" {
+		if _, err := payloadPath(qf.SortPayload); err != nil {
+			return err
+		}
+		if qf.DedupeWindow > 0 {
+			return fmt.Errorf("a dedupe window needs timestamp order and cannot be combined with a payload sort")
+		}
+	}
+	if qf.Sample < 0 || qf.Sample > 1 {
+		return fmt.Errorf("sample must be between 0 and 1, got %v", qf.Sample)
+	}
+	if qf.SortDir != "" && qf.SortDir != OrderAsc && qf.SortDir != OrderDesc {
+		return fmt.Errorf("invalid sort direction %q (expected asc or desc)", qf.SortDir)
+	}
+	if qf.SortPayload == "" && (qf.SortDir != "" || qf.SortNumeric) {
+		return fmt.Errorf("a sort direction or numeric sort needs a payload sort key")
+	}
+	for _, condition := range qf.PayloadConditions {
+		if err := condition.Validate(); err != nil {
+			return err
+		}
+	}
+	required := make(map[string]bool)
+	for _, key := range qf.HasKeys {
+		path, err := payloadPath(key)
+		if err != nil {
+			return err
+		}
+		required[path] = true
+	}
+	for _, key := range qf.MissingKeys {
+		path, err := payloadPath(key)
+		if err != nil {
+			return err
+		}
+		if required[path] {
+			return fmt.Errorf("payload key %q cannot be both required and missing", key)
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// dedupeFilter drops near-duplicate events from an ordered stream. An event
+// is suppressed when the last emitted event with the same user, type and
+// payload is closer than the window. Emitted events fall out of lastSeen
+// once the stream has moved a full window past them.
+type dedupeFilter struct {
+	window     time.Duration
+	lastSeen   map[string]time.Time
+	emitted    []dedupeEntry // emitted events in stream order, oldest first
+	suppressed int
+}
+
+type dedupeEntry struct {
+	key       string
+	timestamp time.Time
+}
+
+func newDedupeFilter(window time.Duration) *dedupeFilter {
+	return &dedupeFilter{
+		window:   window,
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+// allow reports whether the event should be emitted and remembers it if so
+func (df *dedupeFilter) allow(e *Event) bool {
+	df.evict(e.Timestamp)
+	key := fmt.Sprintf("%d|%s|%s", e.UserID, e.EventType, e.Payload)
+	if _, ok := df.lastSeen[key]; ok {
+		df.suppressed++
+		return false
+	}
+	df.lastSeen[key] = e.Timestamp
+	df.emitted = append(df.emitted, dedupeEntry{key: key, timestamp: e.Timestamp})
+	return true
+}
+
+// evict forgets emitted events at least a window away from now. The stream
+// runs in timestamp order, either way, so those can never suppress a later
+// event and whatever remains in lastSeen is inside the window.
+func (df *dedupeFilter) evict(now time.Time) {
+	for len(df.emitted) > 0 {
+		oldest := df.emitted[0]
+		gap := now.Sub(oldest.timestamp)
+		if gap < 0 {
+			gap = -gap
+		}
+		if gap < df.window {
+			break
+		}
+		delete(df.lastSeen, oldest.key)
+		df.emitted = df.emitted[1:]
+	}
+}
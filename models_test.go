@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParsePayloadContainingDelimiter(t *testing.T) {
+	tests := []struct {
+		name    string
+		parser  *Parser
+		line    string
+		payload string
+	}{
+		{"pipe in string", defaultParser, `2023-08-14T10:00:00Z | 1 | search | {"q":"a | b"}`, `{"q":"a | b"}`},
+		{"several pipes", defaultParser, `2023-08-14T10:00:00Z | 1 | search | {"q":" | a | b | "}`, `{"q":" | a | b | "}`},
+		{"pipe in key", defaultParser, `2023-08-14T10:00:00Z | 1 | search | {"a | b":1}`, `{"a | b":1}`},
+		{"spaces around payload", defaultParser, `2023-08-14T10:00:00Z | 1 | search |   {"q":"x | y"}   `, `{"q":"x | y"}`},
+		{"pipe in array", defaultParser, `2023-08-14T10:00:00Z | 1 | search | [" | ", "|"]`, `[" | ", "|"]`},
+		{"custom delimiter", &Parser{Delimiter: "\t"}, "2023-08-14T10:00:00Z\t1\tsearch\t{\"q\":\"a\\tb | c\"}", `{"q":"a\tb | c"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := tt.parser.Parse(tt.line)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if event.UserID != 1 || event.EventType != "search" {
+				t.Errorf("got user %d, type %q; want 1, search", event.UserID, event.EventType)
+			}
+			if string(event.Payload) != tt.payload {
+				t.Errorf("payload = %s, want %s", event.Payload, tt.payload)
+			}
+
+			// Formatting gives a line that parses back the same
+			again, err := tt.parser.Parse(tt.parser.Format(event))
+			if err != nil || string(again.Payload) != tt.payload {
+				t.Errorf("round trip: payload %s, %v", again.Payload, err)
+			}
+		})
+	}
+}
+
+func TestParseTooFewFields(t *testing.T) {
+	for _, line := range []string{
+		`2023-08-14T10:00:00Z | 1 | {"q":"a | b"}`,
+		`2023-08-14T10:00:00Z|1|search|{}`,
+	} {
+		if _, err := ParseEvent(line); err == nil {
+			t.Errorf("ParseEvent(%q) succeeded, want an invalid format error", line)
+		}
+	}
+}
+
+func TestEmptyPayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		policy  string
+		want    string // "" when the line is rejected
+	}{
+		{"empty", "", "", "null"},
+		{"empty as null", "", EmptyPayloadNull, "null"},
+		{"empty as object", "", EmptyPayloadObject, "{}"},
+		{"empty rejected", "", EmptyPayloadReject, ""},
+		{"whitespace", "   \t", "", "null"},
+		{"whitespace as object", "   \t", EmptyPayloadObject, "{}"},
+		{"whitespace rejected", "   \t", EmptyPayloadReject, ""},
+		{"literal null", "null", "", "null"},
+		{"literal null kept as object policy", "null", EmptyPayloadObject, "null"},
+		{"literal null not rejected", "null", EmptyPayloadReject, "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := &Parser{EmptyPayload: tt.policy}
+			event, err := parser.Parse("2023-08-14T10:00:00Z | 1 | logout | " + tt.payload)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("payload %q was accepted, want it rejected", tt.payload)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if string(event.Payload) != tt.want {
+				t.Errorf("payload = %s, want %s", event.Payload, tt.want)
+			}
+			if got, want := event.String(), "2023-08-14T10:00:00Z | 1 | logout | "+tt.want; got != want {
+				t.Errorf("String() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseCSVEmptyPayloads(t *testing.T) {
+	tests := []struct {
+		payload string
+		policy  string
+		want    string // "" when the record is rejected
+	}{
+		{"", "", "null"},
+		{"", EmptyPayloadObject, "{}"},
+		{"", EmptyPayloadReject, ""},
+		{"  ", EmptyPayloadObject, "{}"},
+		{"null", EmptyPayloadReject, "null"},
+	}
+	for _, tt := range tests {
+		parser := &Parser{EmptyPayload: tt.policy}
+		event, err := parser.ParseCSV([]string{"2023-08-14T10:00:00Z", "1", "logout", tt.payload})
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("policy %q: payload %q was accepted, want it rejected", tt.policy, tt.payload)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("policy %q: ParseCSV(%q): %v", tt.policy, tt.payload, err)
+			continue
+		}
+		if string(event.Payload) != tt.want {
+			t.Errorf("policy %q: payload %q parsed as %s, want %s", tt.policy, tt.payload, event.Payload, tt.want)
+		}
+	}
+}
+
+func TestMissingPayloadFormatsAsNull(t *testing.T) {
+	event := &Event{Timestamp: testBase, UserID: 1, EventType: "logout"}
+	if got, want := event.String(), "2023-08-14T10:00:00Z | 1 | logout | null"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	line, err := event.MarshalLine(FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(line), `{"timestamp":"2023-08-14T10:00:00Z","user_id":1,"event_type":"logout","payload":null}`; got != want {
+		t.Errorf("MarshalLine = %s, want %s", got, want)
+	}
+}
+
+func TestParseEventJSON(t *testing.T) {
+	event, err := ParseEventJSON([]byte(`{"timestamp":"2023-08-14T12:00:00+02:00","user_id":42,"event_type":" login ","payload":{ "ip": "10.0.0.1" }}`))
+	if err != nil {
+		t.Fatalf("ParseEventJSON: %v", err)
+	}
+	if !event.Timestamp.Equal(testBase) || event.UserID != 42 || event.EventType != "login" {
+		t.Errorf("got %v, %d, %q", event.Timestamp, event.UserID, event.EventType)
+	}
+	if string(event.Payload) != `{"ip":"10.0.0.1"}` {
+		t.Errorf("payload = %s, want it compacted", event.Payload)
+	}
+
+	event, err = ParseEventJSON([]byte(`{"timestamp":"2023-08-14T10:00:00Z","user_id":1,"event_type":"logout"}`))
+	if err != nil || string(event.Payload) != "null" {
+		t.Errorf("missing payload: %v, %v; want null", event, err)
+	}
+}
+
+func TestParseEventJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want error
+	}{
+		{"missing timestamp", `{"user_id":1,"event_type":"login"}`, ErrInvalidTimestamp},
+		{"missing user_id", `{"timestamp":"2023-08-14T10:00:00Z","event_type":"login"}`, ErrInvalidUserID},
+		{"missing event_type", `{"timestamp":"2023-08-14T10:00:00Z","user_id":1}`, ErrInvalidEventType},
+		{"empty event_type", `{"timestamp":"2023-08-14T10:00:00Z","user_id":1,"event_type":" "}`, ErrInvalidEventType},
+		{"timestamp is a number", `{"timestamp":1692007200,"user_id":1,"event_type":"login"}`, ErrInvalidTimestamp},
+		{"bad timestamp", `{"timestamp":"yesterday","user_id":1,"event_type":"login"}`, ErrInvalidTimestamp},
+		{"user_id is a string", `{"timestamp":"2023-08-14T10:00:00Z","user_id":"1","event_type":"login"}`, ErrInvalidUserID},
+		{"user_id is fractional", `{"timestamp":"2023-08-14T10:00:00Z","user_id":1.5,"event_type":"login"}`, ErrInvalidUserID},
+		{"event_type is a number", `{"timestamp":"2023-08-14T10:00:00Z","user_id":1,"event_type":3}`, ErrInvalidEventType},
+		{"not an object", `["2023-08-14T10:00:00Z",1,"login"]`, ErrInvalidFormat},
+		{"not JSON", `2023-08-14T10:00:00Z | 1 | login | {}`, ErrInvalidFormat},
+		{"invalid UTF-8", "{\"timestamp\":\"\xff\"}", ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseEventJSON([]byte(tt.line))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want errors.Is %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEventJSONReadsMarshalLine(t *testing.T) {
+	event := &Event{Timestamp: testBase.Add(1500), UserID: 3, EventType: "search", Payload: []byte(`{"q":"a | b"}`)}
+	line, err := event.MarshalLine(FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseEventJSON(line)
+	if err != nil {
+		t.Fatalf("ParseEventJSON(%s): %v", line, err)
+	}
+	if !parsed.Timestamp.Equal(event.Timestamp) || parsed.UserID != 3 || parsed.EventType != "search" || string(parsed.Payload) != string(event.Payload) {
+		t.Errorf("got %s back, want %s", parsed, event)
+	}
+}
+
+func TestOffsetFormsAreOneInstant(t *testing.T) {
+	forms := []string{
+		"2023-08-14T10:00:00Z",
+		"2023-08-14T10:00:00+00:00",
+		"2023-08-14T12:00:00+02:00",
+		"2023-08-14T05:30:00-04:30",
+	}
+	for _, form := range forms {
+		event, err := ParseEvent(form + " | 1 | login | {}")
+		if err != nil {
+			t.Fatalf("ParseEvent(%s): %v", form, err)
+		}
+		if got := storedTime(event.Timestamp); got != "2023-08-14T10:00:00.000000000Z" {
+			t.Errorf("%s is stored as %s", form, got)
+		}
+	}
+}
+
+func TestDedupeFilterForgetsEventsOutsideWindow(t *testing.T) {
+	df := newDedupeFilter(time.Minute)
+	base := time.Date(2023, 8, 14, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 10000; i++ {
+		event := &Event{
+			Timestamp: base.Add(time.Duration(i) * time.Second),
+			UserID:    int64(i),
+			EventType: "login",
+		}
+		if !df.allow(event) {
+			t.Fatalf("event %d suppressed, want every user's first event emitted", i)
+		}
+	}
+	if len(df.lastSeen) > 60 || len(df.emitted) > 60 {
+		t.Errorf("filter remembers %d keys and %d events, want at most a window's worth", len(df.lastSeen), len(df.emitted))
+	}
+
+	// A repeat inside the window is still suppressed, one outside is not
+	last := base.Add(9999 * time.Second)
+	if df.allow(&Event{Timestamp: last.Add(30 * time.Second), UserID: 9999, EventType: "login"}) {
+		t.Error("repeat inside the window was emitted")
+	}
+	if !df.allow(&Event{Timestamp: last.Add(2 * time.Minute), UserID: 9999, EventType: "login"}) {
+		t.Error("repeat outside the window was suppressed")
+	}
+}
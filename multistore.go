@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MultiStore queries several event databases as one, such as monthly
+// shards. Each database is queried on its own and the results are merged in
+// timestamp order. Event IDs are only unique within a database, so filters
+// and output that rely on them are refused.
+type MultiStore struct {
+	paths  []string
+	stores []*EventStore
+}
+
+// OpenMultiStore opens every database in paths with the given configuration
+func OpenMultiStore(paths []string, cfg StoreConfig) (*MultiStore, error) {
+	ms := &MultiStore{paths: paths}
+	for _, path := range paths {
+		store, err := NewEventStoreWithConfig(path, cfg)
+		if err != nil {
+			ms.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		ms.stores = append(ms.stores, store)
+	}
+	return ms, nil
+}
+
+// Close closes every database
+func (ms *MultiStore) Close() error {
+	var firstErr error
+	for _, store := range ms.stores {
+		if err := store.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// validate refuses filters and output that cannot span databases
+func (ms *MultiStore) validate(filters QueryFilters, output OutputOptions) error {
+	if err := filters.Validate(); err != nil {
+		return &FilterError{Err: err}
+	}
+	if filters.ID != 0 || filters.FromID != 0 || filters.ToID != 0 {
+		return fmt.Errorf("event IDs are per database and cannot select events across several")
+	}
+	if filters.DedupeWindow > 0 {
+		return fmt.Errorf("dedupe windows cannot span several databases")
+	}
+	if filters.SortPayload != "" {
+		return fmt.Errorf("events from several databases are merged by timestamp and cannot be sorted by payload")
+	}
+	if output.ShowID {
+		return fmt.Errorf("event IDs are per database and cannot be shown across several")
+	}
+	for _, field := range output.Fields {
+		if field == "id" {
+			return fmt.Errorf("event IDs are per database and cannot be shown across several")
+		}
+	}
+	return nil
+}
+
+// Count returns the number of matching events in all databases
+func (ms *MultiStore) Count(userID int64, filters QueryFilters) (int, error) {
+	if err := ms.validate(filters, OutputOptions{}); err != nil {
+		return 0, err
+	}
+	total := 0
+	for i, store := range ms.stores {
+		count, err := store.Count(userID, filters)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", ms.paths[i], err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// QueryContext writes the matching events of all databases to out like
+// EventStore.QueryContext, merged by timestamp. Events with equal
+// timestamps keep the order of the databases in paths, reversed for
+// descending order. Limit and Offset apply to the merged stream.
+func (ms *MultiStore) QueryContext(ctx context.Context, userID int64, filters QueryFilters, output OutputOptions, out io.Writer) (int, error) {
+	if err := ms.validate(filters, output); err != nil {
+		return 0, err
+	}
+	if err := output.Validate(); err != nil {
+		return 0, fmt.Errorf("invalid output options: %v", err)
+	}
+	header, err := output.header()
+	if err != nil {
+		return 0, fmt.Errorf("failed to format header: %v", err)
+	}
+	render, err := output.renderer()
+	if err != nil {
+		return 0, fmt.Errorf("invalid output options: %v", err)
+	}
+	if output.Number {
+		render = output.numbered(render, filters.Offset)
+	}
+	filters = output.queryFilters(filters)
+
+	return writeEventStream(out, output.BufferSize, header, render, func(fn func(*Event) error) error {
+		return ms.eachEvent(ctx, userID, filters, fn)
+	})
+}
+
+// shardBuffer is how many events each database may read ahead of the merge
+const shardBuffer = 256
+
+// eachEvent calls fn for the matching events of all databases in merged
+// order. Each database streams its events from its own goroutine.
+func (ms *MultiStore) eachEvent(ctx context.Context, userID int64, filters QueryFilters, fn func(*Event) error) error {
+	// Every database may hold the whole merged page, so each reads up to
+	// Limit+Offset events and the merge skips and limits
+	shardFilters := filters
+	shardFilters.Offset = 0
+	if filters.Limit > 0 {
+		shardFilters.Limit = filters.Limit + filters.Offset
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	streams := make([]chan *Event, len(ms.stores))
+	errs := make([]error, len(ms.stores))
+	for i, store := range ms.stores {
+		streams[i] = make(chan *Event, shardBuffer)
+		wg.Add(1)
+		go func(i int, store *EventStore) {
+			defer wg.Done()
+			defer close(streams[i])
+			store.mu.RLock()
+			defer store.mu.RUnlock()
+			_, errs[i] = store.eachEvent(ctx, userID, shardFilters, func(event *Event) error {
+				select {
+				case streams[i] <- event:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}(i, store)
+	}
+
+	// heads holds each database's next event, nil once it is exhausted.
+	// A stream is closed only after its error is set.
+	heads := make([]*Event, len(ms.stores))
+	advance := func(i int) error {
+		heads[i] = <-streams[i]
+		if heads[i] == nil && errs[i] != nil {
+			return fmt.Errorf("%s: %v", ms.paths[i], errs[i])
+		}
+		return nil
+	}
+	for i := range heads {
+		if err := advance(i); err != nil {
+			return err
+		}
+	}
+
+	descending := filters.Order == OrderDesc
+	skipped, emitted := 0, 0
+	for filters.Limit == 0 || emitted < filters.Limit {
+		next := -1
+		for i, head := range heads {
+			if head == nil {
+				continue
+			}
+			if next == -1 ||
+				(!descending && head.Timestamp.Before(heads[next].Timestamp)) ||
+				(descending && !head.Timestamp.Before(heads[next].Timestamp)) {
+				next = i
+			}
+		}
+		if next == -1 {
+			break
+		}
+
+		event := heads[next]
+		if skipped < filters.Offset {
+			skipped++
+		} else {
+			if err := fn(event); err != nil {
+				return err
+			}
+			emitted++
+		}
+		if err := advance(next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LineParser parses one line of input into an Event. Parse is called from
+// several goroutines at once, so it must not modify the parser.
+type LineParser interface {
+	Parse(line string) (*Event, error)
+}
+
+// lineParsers maps the names accepted by RecordOptions.Parser to
+// constructors, which receive the record options for settings such as the
+// delimiter
+var lineParsers = make(map[string]func(opts *RecordOptions) LineParser)
+
+// RegisterLineParser makes a line parser available under name. It panics if
+// the name is taken, as registering twice is a programming error.
+func RegisterLineParser(name string, newParser func(opts *RecordOptions) LineParser) {
+	if newParser == nil {
+		panic("eventlog: RegisterLineParser constructor is nil")
+	}
+	if _, taken := lineParsers[name]; taken {
+		panic("eventlog: RegisterLineParser called twice for " + name)
+	}
+	lineParsers[name] = newParser
+}
+
+// lineParserNames returns the registered parser names in order
+func lineParserNames() []string {
+	names := make([]string, 0, len(lineParsers))
+	for name := range lineParsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterLineParser(InputFormatPipe, func(opts *RecordOptions) LineParser {
+		return opts.parser()
+	})
+	RegisterLineParser(InputFormatCSV, func(opts *RecordOptions) LineParser {
+		return csvLineParser{parser: opts.parser()}
+	})
+	RegisterLineParser(InputFormatJSON, func(*RecordOptions) LineParser {
+		return jsonLineParser{}
+	})
+}
+
+// csvLineParser reads each line as one CSV record. Unlike
+// InputFormatCSV, a payload cannot span lines and a header line is invalid.
+type csvLineParser struct {
+	parser *Parser
+}
+
+func (cp csvLineParser) Parse(line string) (*Event, error) {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.FieldsPerRecord = -1 // field count is checked by ParseCSV
+	record, err := reader.Read()
+	if err != nil {
+		return nil, parseErrorf(ErrInvalidFormat, "invalid format: %v", err)
+	}
+	return cp.parser.ParseCSV(record)
+}
+
+// jsonLineParser reads each line as one JSON event object
+type jsonLineParser struct{}
+
+func (jsonLineParser) Parse(line string) (*Event, error) {
+	return ParseEventJSON([]byte(line))
+}
+
+// lineParser returns the registered parser named by opts.Parser, or by the
+// input format if none is set
+func (opts *RecordOptions) lineParser() (LineParser, error) {
+	name := opts.Parser
+	if name == "" {
+		name = opts.InputFormat
+	}
+	if name == "" {
+		name = InputFormatPipe
+	}
+	newParser, ok := lineParsers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown parser %q (expected one of %s)", name, strings.Join(lineParserNames(), ", "))
+	}
+	return newParser(opts), nil
+}
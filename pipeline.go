@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sync"
+)
+
+// parseChunkSize is the number of lines handed to a parse worker at once
+const parseChunkSize = 1024
+
+// parsedLine is one non-empty input line after parsing
+type parsedLine struct {
+	text     string
+	lineNum  int
+	position string // from a linePositioner, empty otherwise
+	event    *Event
+	err      error
+	parsed   bool // already parsed by the source's recordParser
+}
+
+// parseChunk is a run of consecutive lines. results is closed by the worker
+// once every line is parsed.
+type parseChunk struct {
+	lines   []parsedLine
+	results chan struct{}
+}
+
+// parsePipeline reads lines from a source on one goroutine and parses them
+// on several workers while preserving input order: chunks are delivered on
+// ordered in the order they were read, each one ready once its results
+// channel is closed. Empty lines are dropped but, when flushOnIdle is set,
+// cut the current chunk short so follow-mode idle polls reach the consumer.
+type parsePipeline struct {
+	ordered chan *parseChunk
+	done    chan struct{}
+	readErr error
+	wg      sync.WaitGroup
+}
+
+func newParsePipeline(source lineSource, parse func(string) (*Event, error), workers int, flushOnIdle bool) *parsePipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	pp := &parsePipeline{
+		ordered: make(chan *parseChunk, workers*2),
+		done:    make(chan struct{}),
+	}
+	work := make(chan *parseChunk, workers*2)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for chunk := range work {
+				for j := range chunk.lines {
+					line := &chunk.lines[j]
+					if !line.parsed {
+						line.event, line.err = parse(line.text)
+					}
+				}
+				close(chunk.results)
+			}
+		}()
+	}
+
+	pp.wg.Add(1)
+	go func() {
+		defer pp.wg.Done()
+		defer close(pp.ordered)
+		defer close(work)
+		pp.readErr = pp.read(source, work, flushOnIdle)
+	}()
+
+	return pp
+}
+
+// read scans the source and dispatches chunks until it is exhausted or the
+// consumer stops the pipeline
+func (pp *parsePipeline) read(source lineSource, work chan<- *parseChunk, flushOnIdle bool) error {
+	positioner, _ := source.(linePositioner)
+	sourceParser, _ := source.(recordParser)
+	validator, _ := source.(lineValidator)
+
+	chunk := &parseChunk{results: make(chan struct{})}
+	send := func() bool {
+		select {
+		case work <- chunk:
+		case <-pp.done:
+			return false
+		}
+		select {
+		case pp.ordered <- chunk:
+		case <-pp.done:
+			return false
+		}
+		chunk = &parseChunk{results: make(chan struct{})}
+		return true
+	}
+
+	lineNum := 0
+	for source.Scan() {
+		lineNum++
+		text := source.Text()
+		if text == "" {
+			if flushOnIdle && !send() {
+				return nil
+			}
+			continue // Skip empty lines
+		}
+
+		line := parsedLine{text: text, lineNum: lineNum}
+		if positioner != nil {
+			line.position = positioner.Position()
+		}
+		if validator != nil {
+			if err := validator.LineErr(); err != nil {
+				line.err = err
+				line.parsed = true
+			}
+		}
+		if sourceParser != nil && !line.parsed {
+			// The source parses its own current record, so it must happen
+			// before the next Scan
+			line.event, line.err = sourceParser.ParseRecord()
+			line.parsed = true
+		}
+		chunk.lines = append(chunk.lines, line)
+
+		if len(chunk.lines) >= parseChunkSize && !send() {
+			return nil
+		}
+	}
+
+	if len(chunk.lines) > 0 && !send() {
+		return nil
+	}
+	return source.Err()
+}
+
+// Stop tells the reader to give up early and waits for it to exit
+func (pp *parsePipeline) Stop() {
+	close(pp.done)
+	pp.wg.Wait()
+}
+
+// Err returns the source's read error once ordered has been drained
+func (pp *parsePipeline) Err() error {
+	pp.wg.Wait()
+	return pp.readErr
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// progressInterval is how often the progress line is redrawn
+const progressInterval = time.Second
+
+// progressReporter redraws a single ingest progress line in place on a
+// terminal. It stays silent when the output is not a terminal, where ingest
+// prints a line per committed batch instead.
+type progressReporter struct {
+	out         io.Writer
+	interactive bool
+	now         func() time.Time // replaceable clock
+
+	start time.Time
+	last  time.Time
+	drawn bool // a progress line is on screen
+}
+
+// newProgressReporter reports to f when it is a terminal and --quiet is not
+// set
+func newProgressReporter(f *os.File) *progressReporter {
+	info, err := f.Stat()
+	interactive := err == nil && info.Mode()&os.ModeCharDevice != 0 && logger.enabled(LogNormal)
+
+	pr := &progressReporter{out: f, interactive: interactive, now: time.Now}
+	pr.start = pr.now()
+	pr.last = pr.start
+	return pr
+}
+
+// Update redraws the progress line if progressInterval has passed since the
+// last redraw
+func (pr *progressReporter) Update(count int) {
+	if !pr.interactive {
+		return
+	}
+	now := pr.now()
+	if now.Sub(pr.last) < progressInterval {
+		return
+	}
+	pr.last = now
+	fmt.Fprintf(pr.out, "\r\033[K%s", formatProgress(count, now.Sub(pr.start)))
+	pr.drawn = true
+}
+
+// Clear erases the progress line so other output starts on a clean line
+func (pr *progressReporter) Clear() {
+	if pr.drawn {
+		fmt.Fprint(pr.out, "\r\033[K")
+		pr.drawn = false
+	}
+}
+
+// ingestRate returns events per second, or 0 before any time has passed
+func ingestRate(count int, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) / elapsed.Seconds()
+}
+
+// formatProgress describes how far an ingest has got
+func formatProgress(count int, elapsed time.Duration) string {
+	return fmt.Sprintf("Processed %d events (%.0f events/s, %v elapsed)",
+		count, ingestRate(count, elapsed), elapsed.Round(time.Second))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for progressReporter that moves only when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestProgress(interactive bool) (*progressReporter, *fakeClock, *bytes.Buffer) {
+	clock := &fakeClock{now: testBase}
+	out := &bytes.Buffer{}
+	pr := &progressReporter{out: out, interactive: interactive, now: clock.Now}
+	pr.start = pr.now()
+	pr.last = pr.start
+	return pr, clock, out
+}
+
+func TestProgressRedrawsEverySecond(t *testing.T) {
+	pr, clock, out := newTestProgress(true)
+
+	clock.Advance(500 * time.Millisecond)
+	pr.Update(1000)
+	if out.Len() != 0 {
+		t.Fatalf("redrawn before the interval: %q", out.String())
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	pr.Update(2000)
+	if got, want := out.String(), "\r\033[KProcessed 2000 events (2000 events/s, 1s elapsed)"; got != want {
+		t.Errorf("first line %q, want %q", got, want)
+	}
+
+	out.Reset()
+	clock.Advance(1500 * time.Millisecond)
+	pr.Update(10000)
+	if got, want := out.String(), "\r\033[KProcessed 10000 events (4000 events/s, 3s elapsed)"; got != want {
+		t.Errorf("second line %q, want %q", got, want)
+	}
+
+	out.Reset()
+	pr.Clear()
+	if got := out.String(); got != "\r\033[K" {
+		t.Errorf("Clear wrote %q, want the line erased", got)
+	}
+	out.Reset()
+	pr.Clear()
+	if out.Len() != 0 {
+		t.Errorf("a second Clear wrote %q", out.String())
+	}
+}
+
+func TestProgressSilentWhenNotInteractive(t *testing.T) {
+	pr, clock, out := newTestProgress(false)
+	clock.Advance(5 * time.Second)
+	pr.Update(100)
+	pr.Clear()
+	if out.Len() != 0 {
+		t.Errorf("wrote %q to a non-terminal", out.String())
+	}
+}
+
+func TestIngestRate(t *testing.T) {
+	tests := []struct {
+		count   int
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 0, 0},
+		{100, 0, 0},
+		{100, -time.Second, 0},
+		{100, 2 * time.Second, 50},
+		{1500, 500 * time.Millisecond, 3000},
+	}
+	for _, tt := range tests {
+		if got := ingestRate(tt.count, tt.elapsed); got != tt.want {
+			t.Errorf("ingestRate(%d, %v) = %v, want %v", tt.count, tt.elapsed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FormatPrometheus selects the Prometheus text exposition format for stats
+const FormatPrometheus = "prometheus"
+
+// formatPrometheusStats renders a stats map, as returned by GetStats or
+// SummaryStats, in the Prometheus text exposition format for a textfile
+// collector. Every metric is a gauge; types are sorted for stable output.
+func formatPrometheusStats(stats map[string]interface{}) string {
+	var out strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("eventlog_total_events", "Number of stored events.")
+	fmt.Fprintf(&out, "eventlog_total_events %d\n", stats["total_events"])
+	gauge("eventlog_unique_users", "Number of users with at least one event.")
+	fmt.Fprintf(&out, "eventlog_unique_users %d\n", stats["unique_users"])
+
+	byType := stats["by_type"].(map[string]TypeStats)
+	types := make([]string, 0, len(byType))
+	for eventType := range byType {
+		types = append(types, eventType)
+	}
+	sort.Strings(types)
+	gauge("eventlog_events_by_type", "Number of stored events per event type.")
+	for _, eventType := range types {
+		fmt.Fprintf(&out, "eventlog_events_by_type{type=\"%s\"} %d\n", escapeLabel(eventType), byType[eventType].Events)
+	}
+	gauge("eventlog_users_by_type", "Number of users with events of each event type.")
+	for _, eventType := range types {
+		fmt.Fprintf(&out, "eventlog_users_by_type{type=\"%s\"} %d\n", escapeLabel(eventType), byType[eventType].UniqueUsers)
+	}
+
+	// An empty database has no time range, so these are left out
+	timeRange := stats["time_range"].(map[string]string)
+	if first, err := time.Parse(time.RFC3339, timeRange["from"]); err == nil {
+		gauge("eventlog_first_event_timestamp_seconds", "Unix time of the earliest stored event.")
+		fmt.Fprintf(&out, "eventlog_first_event_timestamp_seconds %d\n", first.Unix())
+	}
+	if last, err := time.Parse(time.RFC3339, timeRange["to"]); err == nil {
+		gauge("eventlog_last_event_timestamp_seconds", "Unix time of the latest stored event.")
+		fmt.Fprintf(&out, "eventlog_last_event_timestamp_seconds %d\n", last.Unix())
+	}
+	return out.String()
+}
+
+// escapeLabel escapes a label value as the exposition format requires
+var escapeLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Replay writes the events matching the filters to out in timestamp order,
+// pausing between events for their original gap divided by speed, so 2
+// replays twice as fast. Speed 0 writes them without pausing. Each event is
+// written as soon as it is due. Replay stops early with ctx's error when ctx
+// is done.
+func (es *EventStore) Replay(ctx context.Context, userID int64, filters QueryFilters, speed float64, output OutputOptions, out io.Writer) (int, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if speed < 0 {
+		return 0, fmt.Errorf("speed cannot be negative")
+	}
+	if filters.Order == OrderDesc || filters.SortPayload != "" {
+		return 0, fmt.Errorf("replay needs ascending timestamp order")
+	}
+	if err := output.Validate(); err != nil {
+		return 0, fmt.Errorf("invalid output options: %v", err)
+	}
+	header, err := output.header()
+	if err != nil {
+		return 0, fmt.Errorf("failed to format header: %v", err)
+	}
+	render, err := output.renderer()
+	if err != nil {
+		return 0, fmt.Errorf("invalid output options: %v", err)
+	}
+	if header != nil {
+		if _, err := out.Write(append(header, '\n')); err != nil {
+			return 0, fmt.Errorf("failed to write header: %v", err)
+		}
+	}
+
+	// Delays are measured from the start so rendering and writing time does
+	// not accumulate as drift
+	var first time.Time
+	start := time.Now()
+	count := 0
+	_, err = es.eachEvent(ctx, userID, filters, func(event *Event) error {
+		if speed > 0 {
+			if first.IsZero() {
+				first = event.Timestamp
+			}
+			due := start.Add(time.Duration(float64(event.Timestamp.Sub(first)) / speed))
+			timer := time.NewTimer(time.Until(due))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+
+		line, err := render(event)
+		if err != nil {
+			return fmt.Errorf("failed to format event: %v", err)
+		}
+		if _, err := out.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("failed to write event: %v", err)
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
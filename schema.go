@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Payload value kinds a Schema can require
+const (
+	KindString  = "string"
+	KindNumber  = "number"
+	KindBoolean = "boolean"
+	KindObject  = "object"
+	KindArray   = "array"
+	KindAny     = "any" // present, any value including null
+)
+
+// Schema maps event types to the payload keys their events must carry and
+// the kind of each key's value, for example
+//
+//	{"types": {"purchase": {"item": "string", "price": "number"}}}
+//
+// Event types not listed pass unless Closed is set.
+type Schema struct {
+	Closed bool                         `json:"closed"`
+	Types  map[string]map[string]string `json:"types"`
+}
+
+// LoadSchema reads a Schema from a JSON file
+func LoadSchema(filename string) (*Schema, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %v", err)
+	}
+
+	var schema Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", filename, err)
+	}
+	if err := schema.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", filename, err)
+	}
+	return &schema, nil
+}
+
+// Validate checks that every required key names a known kind
+func (s *Schema) Validate() error {
+	for eventType, keys := range s.Types {
+		for key, kind := range keys {
+			switch kind {
+			case KindString, KindNumber, KindBoolean, KindObject, KindArray, KindAny:
+			default:
+				return fmt.Errorf("%s.%s: unknown kind %q (expected string, number, boolean, object, array or any)", eventType, key, kind)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidatePayload checks that a payload carries every key the schema
+// requires for the event type, each with a value of the required kind
+func ValidatePayload(eventType string, payload json.RawMessage, schema Schema) error {
+	required, ok := schema.Types[eventType]
+	if !ok {
+		if schema.Closed {
+			return fmt.Errorf("schema violation: event type %q is not in the schema", eventType)
+		}
+		return nil
+	}
+	if len(required) == 0 {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil || fields == nil {
+		return fmt.Errorf("schema violation: %s payload must be an object", eventType)
+	}
+
+	// Check keys in a stable order so the reported violation is predictable
+	keys := make([]string, 0, len(required))
+	for key := range required {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("schema violation: %s payload is missing %q", eventType, key)
+		}
+		kind := required[key]
+		if actual := jsonKind(value); kind != KindAny && actual != kind {
+			return fmt.Errorf("schema violation: %s payload key %q is %s, expected %s", eventType, key, actual, kind)
+		}
+	}
+	return nil
+}
+
+// jsonKind names the kind of a JSON value by its first character
+func jsonKind(value json.RawMessage) string {
+	if len(value) == 0 {
+		return "null"
+	}
+	switch value[0] {
+	case '"':
+		return KindString
+	case 't', 'f':
+		return KindBoolean
+	case '{':
+		return KindObject
+	case '[':
+		return KindArray
+	case 'n':
+		return "null"
+	default:
+		return KindNumber
+	}
+}
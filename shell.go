@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+// shellStore is the store held open by the shell command. While it is set,
+// handlers share it and a failing command ends only itself.
+var shellStore *EventStore
+
+// shellAbort is panicked by exit inside the shell to unwind the current
+// command after its error has been reported
+type shellAbort struct{}
+
+// exit ends the process with code, or only the current command when running
+// inside the shell
+func exit(code int) {
+	if shellStore != nil {
+		panic(shellAbort{})
+	}
+	os.Exit(code)
+}
+
+// handleShell opens the store once and runs commands read from stdin, one
+// per line, until EOF or quit. A line starting with a user ID or a flag is a
+// query.
+func handleShell(dbPath string, args []string) {
+	if len(args) > 0 {
+		usage(shellUsage)
+	}
+	if shellStore != nil {
+		fail(codeUsage, "already in a shell")
+	}
+
+	store, err := NewEventStoreWithConfig(dbPath, storeConfig())
+	if err != nil {
+		failOn(err, "initializing store")
+	}
+	shellStore = store
+	defer func() {
+		shellStore = nil
+		store.Close()
+	}()
+
+	info, err := os.Stdin.Stat()
+	interactive := err == nil && info.Mode()&os.ModeCharDevice != 0
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		if interactive {
+			fmt.Print("eventlog> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "quit" || line == "exit" {
+			return
+		}
+		if line == "help" {
+			printUsage()
+			continue
+		}
+
+		words, err := splitCommandLine(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			continue
+		}
+		if startsQuery(words[0]) {
+			words = append([]string{"query"}, words...)
+		}
+		runShellCommand(dbPath, words)
+	}
+	if interactive {
+		fmt.Println()
+	}
+	if err := scanner.Err(); err != nil {
+		fail(codeInvalidArgument, "reading commands: %v", err)
+	}
+}
+
+// runShellCommand runs one shell command, recovering from its failure so the
+// shell can carry on
+func runShellCommand(dbPath string, args []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			// Flag sets panic with the error they have already printed;
+			// anything else is a genuine bug
+			if _, ok := r.(shellAbort); ok {
+				return
+			}
+			if _, ok := r.(runtime.Error); !ok {
+				if _, ok := r.(error); ok {
+					return
+				}
+			}
+			panic(r)
+		}
+	}()
+	runCommand(dbPath, args)
+}
+
+// startsQuery reports whether a shell line's first word is a user ID or a
+// flag, making the line a query
+func startsQuery(word string) bool {
+	if strings.HasPrefix(word, "-") {
+		return true
+	}
+	for _, r := range word {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitCommandLine splits a shell line into words on whitespace. Single or
+// double quotes group text containing spaces, as in --where-payload='a = b'.
+func splitCommandLine(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -2,250 +2,1999 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 // EventStore manages event storage and retrieval
 type EventStore struct {
+	// mu guards db and insertStmt: operations hold the read lock while
+	// recycling takes the write lock to swap in a fresh connection
+	mu         sync.RWMutex
+	path       string
+	config     StoreConfig
 	db         *sql.DB
 	insertStmt *sql.Stmt
+
+	// normalizeTypes is set once event types are recorded normalized; see
+	// RecordOptions.NormalizeType
+	normalizeTypes atomic.Bool
+
+	// rawPayloads is set once payloads are recorded without JSON
+	// validation; see RecordOptions.NoJSONValidate
+	rawPayloads atomic.Bool
+
+	stopRecycle chan struct{}
+	recycleDone chan struct{}
+}
+
+// StoreConfig configures the SQLite connection and optional EventStore
+// behaviour. Zero values leave SQLite's own defaults in place; start from
+// DefaultStoreConfig for the tuned settings NewEventStore uses.
+type StoreConfig struct {
+	JournalMode string // DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF
+	Synchronous string // OFF, NORMAL, FULL or EXTRA
+	CacheSize   int    // PRAGMA cache_size: pages if positive, KiB if negative
+	MmapSize    int64  // bytes of memory-mapped I/O, 0 disables it
+
+	// CompressPayload stores new payloads DEFLATE-compressed as BLOBs.
+	// Compressed and plain rows can be mixed and are read transparently.
+	CompressPayload bool
+
+	// RecycleInterval periodically closes and reopens the database
+	// connection, releasing memory-mapped regions and checkpointing the WAL.
+	// Useful for long-running embeddings; zero disables recycling.
+	RecycleInterval time.Duration
+
+	// BusyTimeout is how long a connection waits for another process's
+	// lock before failing with "database is locked". Zero keeps the
+	// driver's default of 5 seconds.
+	BusyTimeout time.Duration
+
+	// ReadOnly opens an existing database for reading only: nothing is
+	// created or migrated, and every write fails with ErrReadOnly. The
+	// journal mode and synchronous level are left as the database has them.
+	ReadOnly bool
+}
+
+// DefaultBusyTimeout is the busy timeout of DefaultStoreConfig
+const DefaultBusyTimeout = 5 * time.Second
+
+// DefaultStoreConfig returns the settings used by NewEventStore, tuned for
+// bulk ingestion on a typical workstation
+func DefaultStoreConfig() StoreConfig {
+	return StoreConfig{
+		JournalMode: "WAL",     // Write-ahead logging for better concurrency
+		Synchronous: "NORMAL",  // Balance safety and performance
+		CacheSize:   10000,     // 10000 pages
+		MmapSize:    268435456, // 256MB memory-mapped I/O
+		BusyTimeout: DefaultBusyTimeout,
+	}
+}
+
+// Validate checks that the config only holds values that are safe to place
+// in PRAGMA statements
+func (cfg *StoreConfig) Validate() error {
+	journalModes := []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	if cfg.JournalMode != "" && !containsFold(journalModes, cfg.JournalMode) {
+		return fmt.Errorf("invalid journal mode %q", cfg.JournalMode)
+	}
+	synchronousLevels := []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+	if cfg.Synchronous != "" && !containsFold(synchronousLevels, cfg.Synchronous) {
+		return fmt.Errorf("invalid synchronous level %q", cfg.Synchronous)
+	}
+	if cfg.MmapSize < 0 {
+		return fmt.Errorf("mmap size cannot be negative")
+	}
+	if cfg.RecycleInterval < 0 {
+		return fmt.Errorf("recycle interval cannot be negative")
+	}
+	if cfg.BusyTimeout < 0 {
+		return fmt.Errorf("busy timeout cannot be negative")
+	}
+	return nil
+}
+
+// pragmas returns the PRAGMA statements applying the config
+func (cfg *StoreConfig) pragmas() []string {
+	var pragmas []string
+	if cfg.JournalMode != "" && !cfg.ReadOnly {
+		pragmas = append(pragmas, "PRAGMA journal_mode = "+strings.ToUpper(cfg.JournalMode))
+	}
+	if cfg.Synchronous != "" && !cfg.ReadOnly {
+		pragmas = append(pragmas, "PRAGMA synchronous = "+strings.ToUpper(cfg.Synchronous))
+	}
+	if cfg.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size = %d", cfg.CacheSize))
+	}
+	pragmas = append(pragmas, "PRAGMA temp_store = MEMORY") // Use memory for temporary tables
+	pragmas = append(pragmas, fmt.Sprintf("PRAGMA mmap_size = %d", cfg.MmapSize))
+	return pragmas
+}
+
+// containsFold reports whether values contains s, ignoring case
+func containsFold(values []string, s string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryDBPath opens a database held in memory only, which is discarded when
+// the store is closed
+const MemoryDBPath = ":memory:"
+
+// NewEventStore creates a new EventStore with SQLite backend
+func NewEventStore(dbPath string) (*EventStore, error) {
+	return NewEventStoreWithConfig(dbPath, DefaultStoreConfig())
+}
+
+// NewEventStoreWithConfig creates a new EventStore with SQLite backend and
+// the given configuration
+func NewEventStoreWithConfig(dbPath string, cfg StoreConfig) (*EventStore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid store config: %v", err)
+	}
+	if dbPath == MemoryDBPath && cfg.RecycleInterval > 0 {
+		return nil, fmt.Errorf("an in-memory database cannot be recycled: reopening it would lose every event")
+	}
+	if dbPath == MemoryDBPath && cfg.ReadOnly {
+		return nil, fmt.Errorf("an in-memory database cannot be opened read-only: it starts empty")
+	}
+
+	db, insertStmt, err := openDatabase(dbPath, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	es := &EventStore{
+		path:       dbPath,
+		config:     cfg,
+		db:         db,
+		insertStmt: insertStmt,
+	}
+	normalized, err := es.setting(settingNormalizeTypes)
+	if err != nil {
+		es.Close()
+		return nil, err
+	}
+	es.normalizeTypes.Store(normalized == "true")
+	raw, err := es.setting(settingRawPayloads)
+	if err != nil {
+		es.Close()
+		return nil, err
+	}
+	es.rawPayloads.Store(raw == "true")
+
+	if cfg.RecycleInterval > 0 {
+		es.stopRecycle = make(chan struct{})
+		es.recycleDone = make(chan struct{})
+		go es.recycleLoop(cfg.RecycleInterval)
+	}
+
+	return es, nil
+}
+
+// openDatabase opens and configures the SQLite database, brings its schema
+// up to date and prepares the insert statement
+func openDatabase(dbPath string, cfg StoreConfig) (*sql.DB, *sql.Stmt, error) {
+	// The busy timeout is per connection, so it goes in the DSN rather than
+	// a PRAGMA run on whichever connection is free. Immediate transactions
+	// take the write lock at BEGIN, where the busy timeout applies, instead
+	// of failing outright when a read turns into a write mid-transaction.
+	params := "_txlock=immediate"
+	if cfg.ReadOnly {
+		params = "_txlock=deferred&mode=ro"
+	}
+	if cfg.BusyTimeout > 0 {
+		params += fmt.Sprintf("&_busy_timeout=%d", cfg.BusyTimeout.Milliseconds())
+	}
+	dsn := dbPath
+	if cfg.ReadOnly {
+		dsn = fileURI(dbPath)
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+
+	// Open SQLite database
+	db, err := sql.Open(driverName, dsn+separator+params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if cfg.ReadOnly {
+		// Opening is lazy; fail here on a missing file rather than on the
+		// first pragma
+		if err := db.Ping(); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("failed to open database read-only: %v", err)
+		}
+	}
+
+	// Every connection to :memory: gets its own empty database, so keep
+	// exactly one open for the life of the store
+	if dbPath == MemoryDBPath {
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(0)
+		db.SetConnMaxIdleTime(0)
+	}
+
+	for _, pragma := range cfg.pragmas() {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("failed to set pragma: %v", err)
+		}
+	}
+
+	if cfg.ReadOnly {
+		if err := checkSchemaVersion(db); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return db, nil, nil
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	// Prepare insert statement
+	insertStmt, err := db.Prepare("INSERT" + insertSQL)
+	if err != nil {
+		db.Close()
+		return nil, nil, &StoreError{Op: "prepare insert statement", Err: err}
+	}
+
+	return db, insertStmt, nil
+}
+
+// fileURI returns dbPath as an SQLite file: URI, which the driver needs to
+// pass on options such as mode=ro. Any query string is kept.
+func fileURI(dbPath string) string {
+	if strings.HasPrefix(dbPath, "file:") {
+		return dbPath
+	}
+	path, query, hasQuery := strings.Cut(dbPath, "?")
+	path = strings.NewReplacer("%", "%25", "#", "%23").Replace(path)
+	if hasQuery {
+		return "file:" + path + "?" + query
+	}
+	return "file:" + path
+}
+
+// writable returns an error wrapping ErrReadOnly if the store was opened
+// read-only, so that writes fail before reaching SQLite
+func (es *EventStore) writable(op string) error {
+	if es.config.ReadOnly {
+		return &StoreError{Op: op, Err: ErrReadOnly}
+	}
+	return nil
+}
+
+// insertSQL follows INSERT or INSERT OR IGNORE in the insert statements
+const insertSQL = " INTO events (user_id, timestamp, event_type, payload, ingested_at) VALUES (?, ?, ?, ?, " + ingestedNowSQL + ")"
+
+// dedupeIndexSQL makes identical events unique. It is only created when
+// recording with RecordOptions.Dedupe; once present, every later ingest
+// skips duplicates with INSERT OR IGNORE.
+const dedupeIndexSQL = "CREATE UNIQUE INDEX IF NOT EXISTS idx_events_unique ON events(user_id, timestamp, event_type, payload)"
+
+// settingNormalizeTypes is "true" in a database whose event types are
+// recorded normalized
+const settingNormalizeTypes = "normalize_types"
+
+// settingRawPayloads is "true" in a database that may hold payloads that
+// are not JSON
+const settingRawPayloads = "raw_payloads"
+
+// setting returns the value of a key in the settings table, or "" if unset
+func (es *EventStore) setting(key string) (string, error) {
+	var value string
+	err := es.db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", &StoreError{Op: "read setting " + key, Err: err}
+	}
+	return value, nil
+}
+
+// setSetting stores the value of a key in the settings table
+func (es *EventStore) setSetting(ctx context.Context, key, value string) error {
+	_, err := es.db.ExecContext(ctx, "INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value)
+	if err != nil {
+		return &StoreError{Op: "store setting " + key, Err: err}
+	}
+	return nil
+}
+
+// normalizeEventType trims and lowercases an event type, so that Login,
+// login and " LOGIN" are one type
+func normalizeEventType(eventType string) string {
+	return strings.ToLower(strings.TrimSpace(eventType))
+}
+
+// TypesNormalized reports whether the store's event types are recorded
+// normalized, in which case type filters are normalized as well
+func (es *EventStore) TypesNormalized() bool {
+	return es.normalizeTypes.Load()
+}
+
+// storeFilters adapts filters to how the store records events: event
+// types are normalized when the store's types are, and payload functions
+// are guarded when it holds payloads recorded without JSON validation
+func (es *EventStore) storeFilters(filters QueryFilters) QueryFilters {
+	filters.rawPayloads = es.rawPayloads.Load()
+	if !es.normalizeTypes.Load() || len(filters.EventTypes) == 0 {
+		return filters
+	}
+	types := make([]string, len(filters.EventTypes))
+	for i, eventType := range filters.EventTypes {
+		types[i] = normalizeEventType(eventType)
+	}
+	filters.EventTypes = types
+	return filters
+}
+
+// hasDedupeIndex reports whether the unique index from dedupeIndexSQL exists
+func (es *EventStore) hasDedupeIndex() (bool, error) {
+	var count int
+	err := es.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_events_unique'").Scan(&count)
+	if err != nil {
+		return false, &StoreError{Op: "inspect indexes", Err: err}
+	}
+	return count > 0, nil
+}
+
+// CreateDedupeIndex adds the unique index that makes every later ingest and
+// merge skip events already stored. It fails if the database already holds
+// duplicates.
+func (es *EventStore) CreateDedupeIndex() error {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.writable("create dedupe index"); err != nil {
+		return err
+	}
+
+	return es.createDedupeIndex(context.Background())
+}
+
+func (es *EventStore) createDedupeIndex(ctx context.Context) error {
+	if _, err := es.db.ExecContext(ctx, dedupeIndexSQL); err != nil {
+		return &StoreError{Op: "create unique index (remove existing duplicates first)", Err: err}
+	}
+	return nil
+}
+
+// MergeFrom copies every event of another event database into this one in a
+// single transaction and returns the number of events added. IDs are
+// assigned afresh, so they cannot collide. When the dedupe index exists,
+// events already stored are skipped.
+func (es *EventStore) MergeFrom(path string) (int64, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.writable("merge"); err != nil {
+		return 0, err
+	}
+
+	// ATTACH would silently create a missing file
+	source, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open source database: %v", err)
+	}
+	if target, err := os.Stat(es.path); err == nil && os.SameFile(source, target) {
+		return 0, fmt.Errorf("cannot merge a database into itself")
+	}
+
+	dedupe, err := es.hasDedupeIndex()
+	if err != nil {
+		return 0, err
+	}
+	insert := "INSERT"
+	if dedupe {
+		insert = "INSERT OR IGNORE"
+	}
+
+	// The attachment only exists on one connection, so pin it
+	ctx := context.Background()
+	conn, err := es.db.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get connection: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS merge_source", path); err != nil {
+		return 0, fmt.Errorf("failed to attach %s: %v", path, err)
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE merge_source")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	eventType := "event_type"
+	if es.normalizeTypes.Load() {
+		eventType = "normalize_type(event_type)"
+	}
+
+	// The source may predate timestamp normalization; text that is not a
+	// readable time is copied as is
+	result, err := tx.Exec(insert + ` INTO events (user_id, timestamp, event_type, payload, ingested_at)
+		SELECT user_id, COALESCE(` + storedTimeSQL + `, timestamp) AS normalized, ` + eventType + `, payload, ` + ingestedNowSQL + `
+		FROM merge_source.events
+		ORDER BY normalized, id`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to merge events: %v", err)
+	}
+	merged, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read affected rows: %v", err)
+	}
+
+	// Payloads recorded without JSON validation keep their marker. Sources
+	// older than the settings table cannot hold any.
+	var raw string
+	var hasSettings int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM merge_source.sqlite_master WHERE type = 'table' AND name = 'settings'").Scan(&hasSettings); err != nil {
+		return 0, fmt.Errorf("failed to read source schema: %v", err)
+	}
+	if hasSettings > 0 {
+		err := tx.QueryRow("SELECT value FROM merge_source.settings WHERE key = ?", settingRawPayloads).Scan(&raw)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, fmt.Errorf("failed to read source settings: %v", err)
+		}
+	}
+	if raw == "true" {
+		if _, err := tx.Exec("INSERT INTO settings (key, value) VALUES (?, 'true') ON CONFLICT (key) DO UPDATE SET value = excluded.value", settingRawPayloads); err != nil {
+			return 0, fmt.Errorf("failed to store setting: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit merge: %v", err)
+	}
+	if raw == "true" {
+		es.rawPayloads.Store(true)
+	}
+	return merged, nil
+}
+
+// insertStatement returns the statement inserting one event: the prepared
+// INSERT, or INSERT OR IGNORE when the dedupe index exists. Call release when
+// done with it.
+func (es *EventStore) insertStatement(dedupe bool) (stmt *sql.Stmt, release func(), err error) {
+	if !dedupe {
+		return es.insertStmt, func() {}, nil
+	}
+	stmt, err = es.db.Prepare("INSERT OR IGNORE" + insertSQL)
+	if err != nil {
+		return nil, nil, &StoreError{Op: "prepare insert statement", Err: err}
+	}
+	return stmt, func() { stmt.Close() }, nil
+}
+
+// storedTimeLayout is the one layout timestamps are stored in: UTC, nine
+// fractional digits even when they are zero, Z suffix. Values in it compare
+// correctly as text, which the time filters and the timestamp indexes rely
+// on; RFC3339Nano drops trailing zeros and would not.
+const storedTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// storedTimeGlob matches text already in storedTimeLayout
+const storedTimeGlob = "[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]T[0-9][0-9]:[0-9][0-9]:[0-9][0-9].[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]Z"
+
+// storedTimeSQL converts the timestamp column to storedTimeLayout in SQL,
+// giving NULL for text SQLite cannot read as a time. SQLite keeps only
+// milliseconds, so values not already in the layout lose finer precision.
+const storedTimeSQL = "CASE WHEN timestamp GLOB '" + storedTimeGlob + "' THEN timestamp " +
+	"ELSE strftime('%Y-%m-%dT%H:%M:%f', timestamp) || '000000Z' END"
+
+// ingestedNowSQL is the current time in storedTimeLayout in SQL, with
+// SQLite's millisecond precision, stored as each event's ingested_at
+const ingestedNowSQL = "strftime('%Y-%m-%dT%H:%M:%f', 'now') || '000000Z'"
+
+// storedTime formats t for storage, or for comparison with stored values
+func storedTime(t time.Time) string {
+	return t.UTC().Format(storedTimeLayout)
+}
+
+// displayTime reformats a stored timestamp as RFC3339Nano, without the zero
+// fraction padding, leaving text that is not a time as it is
+func displayTime(stored string) string {
+	t, err := time.Parse(time.RFC3339Nano, stored)
+	if err != nil {
+		return stored
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// insertArgs returns the insert statement arguments for an event, formatted
+// the same way on every ingest path
+func (es *EventStore) insertArgs(event *Event) []interface{} {
+	var payload interface{} = event.payloadString()
+	if es.config.CompressPayload {
+		payload = compressPayload([]byte(event.payloadString()))
+	}
+	return []interface{}{
+		event.UserID,
+		storedTime(event.Timestamp),
+		event.EventType,
+		payload,
+	}
+}
+
+// compactEvent validates an event built in code and returns a copy whose
+// payload is compacted onto one line, as parsed events are. On a store
+// normalizing event types, the copy's type is normalized as Record would.
+func (es *EventStore) compactEvent(event *Event) (*Event, error) {
+	if err := event.Validate(); err != nil {
+		return nil, err
+	}
+	compacted := *event
+	if es.normalizeTypes.Load() {
+		compacted.EventType = normalizeEventType(event.EventType)
+	}
+	if len(event.Payload) > 0 {
+		var buf bytes.Buffer
+		json.Compact(&buf, event.Payload)
+		compacted.Payload = buf.Bytes()
+	}
+	return &compacted, nil
+}
+
+// Insert stores a single event outside any batch, for services embedding
+// the store. If the dedupe index exists, a duplicate is silently ignored.
+func (es *EventStore) Insert(event *Event) error {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.writable("insert event"); err != nil {
+		return err
+	}
+
+	event, err := es.compactEvent(event)
+	if err != nil {
+		return fmt.Errorf("invalid event: %v", err)
+	}
+
+	dedupe, err := es.hasDedupeIndex()
+	if err != nil {
+		return err
+	}
+	stmt, release, err := es.insertStatement(dedupe)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if _, err := stmt.Exec(es.insertArgs(event)...); err != nil {
+		return fmt.Errorf("failed to insert event: %v", err)
+	}
+	return nil
+}
+
+// InsertBatch stores events in one transaction and returns the number
+// inserted. Nothing is stored if any event is invalid or an insert fails.
+// Duplicates ignored because of the dedupe index are not counted.
+func (es *EventStore) InsertBatch(events []*Event) (int, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.writable("insert events"); err != nil {
+		return 0, err
+	}
+
+	compacted := make([]*Event, len(events))
+	for i, event := range events {
+		var err error
+		if compacted[i], err = es.compactEvent(event); err != nil {
+			return 0, fmt.Errorf("invalid event %d: %v", i, err)
+		}
+	}
+
+	dedupe, err := es.hasDedupeIndex()
+	if err != nil {
+		return 0, err
+	}
+	insertStmt, release, err := es.insertStatement(dedupe)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	tx, err := es.beginWrite(context.Background())
+	if err != nil {
+		return 0, &StoreError{Op: "begin transaction", Err: err}
+	}
+	defer tx.Rollback()
+
+	stmt := tx.Stmt(insertStmt)
+	defer stmt.Close()
+
+	count := 0
+	for i, event := range compacted {
+		result, err := stmt.Exec(es.insertArgs(event)...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to insert event %d: %v", i, err)
+		}
+		if inserted, _ := result.RowsAffected(); inserted > 0 {
+			count++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit events: %v", err)
+	}
+	return count, nil
+}
+
+// recycleLoop recycles the connection every interval until Close is called
+func (es *EventStore) recycleLoop(interval time.Duration) {
+	defer close(es.recycleDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-es.stopRecycle:
+			return
+		case <-ticker.C:
+			if err := es.recycle(); err != nil {
+				logger.Warnf("failed to recycle database connection: %v", err)
+			}
+		}
+	}
+}
+
+// recycle waits for in-flight operations to drain, checkpoints the WAL and
+// replaces the connection with a freshly opened one. The old connection is
+// kept if reopening fails.
+func (es *EventStore) recycle() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	db, insertStmt, err := openDatabase(es.path, es.config)
+	if err != nil {
+		return err
+	}
+
+	// Best effort: a checkpoint can fail harmlessly if a reader is active
+	es.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	if es.insertStmt != nil {
+		es.insertStmt.Close()
+	}
+	es.db.Close()
+
+	es.db = db
+	es.insertStmt = insertStmt
+	return nil
+}
+
+// busyRetries is how many times beginWrite tries to take the write lock
+const busyRetries = 5
+
+// beginWrite begins a write transaction. When another process still holds
+// the write lock after the busy timeout, it retries a few times with a
+// growing pause before giving up.
+func (es *EventStore) beginWrite(ctx context.Context) (*sql.Tx, error) {
+	pause := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		tx, err := es.db.BeginTx(ctx, nil)
+		if err == nil || !isBusy(err) || attempt == busyRetries {
+			return tx, err
+		}
+		logger.Warnf("database is locked by another process; retrying (%d of %d)", attempt, busyRetries-1)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pause):
+		}
+		pause *= 2
+	}
+}
+
+// isBusy reports whether err is SQLite failing to get a lock
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// CheckpointResult reports what Checkpoint did
+type CheckpointResult struct {
+	WAL          bool `json:"wal"`          // false when the database is not in WAL mode
+	Busy         bool `json:"busy"`         // a reader or writer kept the checkpoint from finishing
+	LogFrames    int  `json:"log_frames"`   // frames in the WAL before the checkpoint
+	Checkpointed int  `json:"checkpointed"` // frames copied into the database
+}
+
+// Checkpoint copies the WAL into the database file and truncates it to zero
+// bytes, so a large import does not leave a large -wal file behind. A
+// database in another journal mode has no WAL; that is reported, not an
+// error.
+func (es *EventStore) Checkpoint() (*CheckpointResult, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.writable("checkpoint"); err != nil {
+		return nil, err
+	}
+
+	var mode string
+	if err := es.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		return nil, fmt.Errorf("failed to read journal mode: %v", err)
+	}
+	if !strings.EqualFold(mode, "wal") {
+		return &CheckpointResult{}, nil
+	}
+
+	// A successful TRUNCATE checkpoint resets the WAL before reporting, so
+	// it always reports zero frames. Count them with a PASSIVE checkpoint,
+	// which copies what it can without waiting, then truncate.
+	result := &CheckpointResult{WAL: true}
+	var busy int
+	err := es.db.QueryRow("PRAGMA wal_checkpoint(PASSIVE)").Scan(&busy, &result.LogFrames, &result.Checkpointed)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint failed: %v", err)
+	}
+	var logFrames, checkpointed int
+	err = es.db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint failed: %v", err)
+	}
+	result.Busy = busy != 0
+	if result.Busy {
+		result.LogFrames, result.Checkpointed = logFrames, checkpointed
+	}
+	// A checkpoint that could not start at all, because another process
+	// was writing, reports -1 frames
+	if result.LogFrames < 0 {
+		result.LogFrames, result.Checkpointed = 0, 0
+	}
+	return result, nil
+}
+
+// Close stops connection recycling and closes the database connection
+func (es *EventStore) Close() error {
+	if es.stopRecycle != nil {
+		close(es.stopRecycle)
+		<-es.recycleDone
+		es.stopRecycle = nil
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.insertStmt != nil {
+		es.insertStmt.Close()
+	}
+	if es.db != nil {
+		return es.db.Close()
+	}
+	return nil
+}
+
+// EventCount returns the total number of stored events
+func (es *EventStore) EventCount() (int, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	var count int
+	if err := es.db.QueryRow("SELECT COUNT(*) FROM events").Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count events: %v", err)
+	}
+	return count, nil
+}
+
+// Truncate removes every stored event in one transaction and returns the
+// number of rows deleted. The ID sequence is reset too, so the next event
+// recorded gets ID 1 again.
+func (es *EventStore) Truncate() (int64, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.writable("truncate"); err != nil {
+		return 0, err
+	}
+
+	tx, err := es.beginWrite(context.Background())
+	if err != nil {
+		return 0, &StoreError{Op: "begin transaction", Err: err}
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM events")
+	if err != nil {
+		return 0, fmt.Errorf("failed to truncate events: %v", err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read affected rows: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM sqlite_sequence WHERE name = 'events'"); err != nil {
+		return 0, fmt.Errorf("failed to reset event IDs: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit truncate: %v", err)
+	}
+	return removed, nil
+}
+
+// Delete removes a user's events matching the type, time and payload
+// filters in a single transaction and returns the number of rows deleted
+func (es *EventStore) Delete(userID int64, filters QueryFilters) (int64, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.writable("delete events"); err != nil {
+		return 0, err
+	}
+
+	if err := filters.Validate(); err != nil {
+		return 0, &FilterError{Err: err}
+	}
+	if filters.AllUsers || filters.UserRange {
+		return 0, fmt.Errorf("delete requires a user ID")
+	}
+
+	tx, err := es.beginWrite(context.Background())
+	if err != nil {
+		return 0, &StoreError{Op: "begin transaction", Err: err}
+	}
+	defer tx.Rollback()
+
+	where, args := buildWhereClause(userID, es.storeFilters(filters))
+	result, err := tx.Exec("DELETE FROM events"+where, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete events: %v", err)
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read affected rows: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit delete: %v", err)
+	}
+	return removed, nil
+}
+
+// PurgeOlderThan deletes the events of every user with a timestamp before
+// cutoff and returns the number of rows deleted. The freed pages are only
+// returned to the file system by a later VACUUM.
+func (es *EventStore) PurgeOlderThan(cutoff time.Time) (int64, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.writable("purge events"); err != nil {
+		return 0, err
+	}
+
+	tx, err := es.beginWrite(context.Background())
+	if err != nil {
+		return 0, &StoreError{Op: "begin transaction", Err: err}
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM events WHERE timestamp < ?", storedTime(cutoff))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge events: %v", err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read affected rows: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit purge: %v", err)
+	}
+	return removed, nil
+}
+
+// CountOlderThan returns how many events PurgeOlderThan would delete
+func (es *EventStore) CountOlderThan(cutoff time.Time) (int64, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	var count int64
+	err := es.db.QueryRow("SELECT COUNT(*) FROM events WHERE timestamp < ?", storedTime(cutoff)).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count query failed: %v", err)
+	}
+	return count, nil
+}
+
+// lineSource yields input lines one at a time; *bufio.Scanner satisfies it
+type lineSource interface {
+	Scan() bool
+	Text() string
+	Err() error
+}
+
+// linePositioner is implemented by line sources that can describe where the
+// current line came from better than a running line count
+type linePositioner interface {
+	Position() string
+}
+
+// recordParser is implemented by line sources whose records are not in the
+// pipe-delimited format; ingest lets them parse the current record
+type recordParser interface {
+	ParseRecord() (*Event, error)
+}
+
+// lineValidator is implemented by line sources that can reject the current
+// line before it is parsed, for example because it is too long
+type lineValidator interface {
+	LineErr() error
+}
+
+// input formats accepted by RecordOptions.InputFormat
+const (
+	InputFormatPipe = "pipe"
+	InputFormatCSV  = "csv"
+	InputFormatJSON = "json" // one JSON event object per line (NDJSON)
+)
+
+// DefaultBatchSize is the number of events committed per transaction when
+// RecordOptions.BatchSize is not set
+const DefaultBatchSize = 10000
+
+// RecordOptions tunes how events are ingested
+type RecordOptions struct {
+	// BatchSize is the number of events per transaction; progress is
+	// reported after every batch. Non-positive values use DefaultBatchSize.
+	BatchSize int
+
+	// Strict fails on the first invalid line instead of skipping it. The
+	// batch in progress is rolled back; earlier batches stay committed.
+	Strict bool
+
+	// Dedupe adds a unique index over user, timestamp, type and payload if
+	// it is missing and ignores events that are already stored. Existing
+	// duplicates must be removed before the index can be created.
+	Dedupe bool
+
+	// FlushInterval commits a partial batch once this much time has passed
+	// since the last commit. Zero only commits full batches.
+	FlushInterval time.Duration
+
+	// InputFormat is InputFormatPipe (default when empty), InputFormatCSV or
+	// InputFormatJSON
+	InputFormat string
+
+	// Parser names the LineParser, registered with RegisterLineParser, that
+	// reads each input line. Empty uses the parser of InputFormat; a name
+	// needs the default pipe InputFormat, whose line reading it replaces.
+	Parser string
+
+	// Delimiter separates the fields of pipe-format lines; empty means
+	// DefaultDelimiter
+	Delimiter string
+
+	// EmptyPayload is passed on to Parser.EmptyPayload
+	EmptyPayload string
+
+	// MaxLineSize is the longest accepted line in bytes; longer lines are
+	// skipped as invalid. Non-positive values use DefaultMaxLineSize.
+	MaxLineSize int
+
+	// Workers is the number of goroutines parsing lines in parallel.
+	// Non-positive values use runtime.NumCPU().
+	Workers int
+
+	// MinTime and MaxTime, when set, bound the accepted event timestamps.
+	// Events outside the range are treated as invalid lines, keeping corrupt
+	// dates such as year 0001 out of the stored time range.
+	MinTime time.Time
+	MaxTime time.Time
+
+	// Canonicalize stores payloads in the form canonicalizeJSON produces,
+	// so identical objects compare equal (and dedupe) whatever their key
+	// order or spacing. Off by default to store payloads exactly as given.
+	Canonicalize bool
+
+	// Schema, when set, skips events whose payload lacks the keys required
+	// for their type, or fails on them in strict mode
+	Schema *Schema
+
+	// DryRun parses and checks every line and reports what would be
+	// recorded or skipped, without writing. The database is not used at all,
+	// so a zero EventStore will do; Dedupe has no effect.
+	DryRun bool
+
+	// Stop, when closed, ends the ingest early, for example on Ctrl-C: no
+	// further lines are recorded and the events recorded so far, including
+	// the open batch, are committed
+	Stop <-chan struct{}
+
+	// Sample, when between 0 and 1, records roughly that fraction of the
+	// valid events and drops the rest, drawing from a generator seeded with
+	// Seed so that the same input and seed keep the same events. Zero
+	// records every event.
+	Sample float64
+	Seed   int64
+
+	// Rejects, when set, receives each skipped line as a rejectedLine JSON
+	// object on a line of its own, instead of a warning on stderr
+	Rejects io.Writer
+
+	// NormalizeType trims and lowercases event types before they are
+	// checked and stored. The database remembers it: later ingests
+	// normalize too, and type filters are normalized to match.
+	NormalizeType bool
+
+	// NoJSONValidate stores pipe-format payloads as given without checking
+	// that they are JSON. The database remembers it, and payload filters
+	// then skip events whose payload is not JSON.
+	NoJSONValidate bool
+}
+
+// parser returns the line parser for the configured delimiter
+func (opts *RecordOptions) parser() *Parser {
+	return &Parser{Delimiter: opts.Delimiter, EmptyPayload: opts.EmptyPayload, RawPayload: opts.NoJSONValidate}
+}
+
+// parseLine returns the parser for lines of the input format. CSV records
+// are parsed by their source instead. Validate has checked the parser name.
+func (opts *RecordOptions) parseLine() func(string) (*Event, error) {
+	parser, _ := opts.lineParser()
+	return parser.Parse
+}
+
+// workers returns the effective number of parse workers
+func (opts *RecordOptions) workers() int {
+	if opts.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return opts.Workers
+}
+
+// Validate checks the option values
+func (opts *RecordOptions) Validate() error {
+	switch opts.InputFormat {
+	case InputFormatPipe, InputFormatCSV, InputFormatJSON, "":
+	default:
+		return fmt.Errorf("unknown input format %q (expected pipe, csv or json)", opts.InputFormat)
+	}
+	if err := opts.parser().Validate(); err != nil {
+		return err
+	}
+	if opts.Parser != "" && opts.InputFormat != InputFormatPipe && opts.InputFormat != "" {
+		return fmt.Errorf("a parser cannot be combined with the %s input format", opts.InputFormat)
+	}
+	if _, err := opts.lineParser(); err != nil {
+		return err
+	}
+	if opts.NoJSONValidate {
+		if opts.InputFormat == InputFormatCSV || opts.InputFormat == InputFormatJSON || (opts.Parser != "" && opts.Parser != InputFormatPipe) {
+			return fmt.Errorf("skipping JSON validation only applies to the pipe input format")
+		}
+		if opts.Canonicalize || opts.Schema != nil {
+			return fmt.Errorf("canonicalizing and schema checks need JSON payloads and cannot skip JSON validation")
+		}
+	}
+	if opts.Sample < 0 || opts.Sample > 1 {
+		return fmt.Errorf("sample must be between 0 and 1, got %v", opts.Sample)
+	}
+	if !opts.MinTime.IsZero() && !opts.MaxTime.IsZero() && opts.MinTime.After(opts.MaxTime) {
+		return fmt.Errorf("min time cannot be after max time")
+	}
+	if opts.Schema != nil {
+		if err := opts.Schema.Validate(); err != nil {
+			return fmt.Errorf("invalid schema: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkEvent reports why a parsed event must be skipped: a timestamp
+// outside MinTime and MaxTime, or a payload violating the Schema
+func (opts *RecordOptions) checkEvent(event *Event) error {
+	if err := opts.checkTimeRange(event.Timestamp); err != nil {
+		return err
+	}
+	if opts.Schema != nil {
+		return ValidatePayload(event.EventType, event.Payload, *opts.Schema)
+	}
+	return nil
+}
+
+// checkTimeRange reports an error if the timestamp falls outside MinTime
+// and MaxTime
+func (opts *RecordOptions) checkTimeRange(timestamp time.Time) error {
+	if !opts.MinTime.IsZero() && timestamp.Before(opts.MinTime) {
+		return fmt.Errorf("timestamp out of range: %s is before %s", timestamp.Format(time.RFC3339), opts.MinTime.Format(time.RFC3339))
+	}
+	if !opts.MaxTime.IsZero() && timestamp.After(opts.MaxTime) {
+		return fmt.Errorf("timestamp out of range: %s is after %s", timestamp.Format(time.RFC3339), opts.MaxTime.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Record ingests events from a file, or from stdin if filename is "-", into
+// the database, in the pipe-delimited, CSV or NDJSON format given by
+// opts.InputFormat. Files ending in .gz are decompressed. Invalid lines are
+// reported with their line number and counted as skipped.
+func (es *EventStore) Record(filename string, opts RecordOptions) (recorded int, skipped int, err error) {
+	return es.RecordContext(context.Background(), filename, opts)
 }
 
-// NewEventStore creates a new EventStore with SQLite backend
-func NewEventStore(dbPath string) (*EventStore, error) {
-	// Open SQLite database
-	db, err := sql.Open("sqlite3", dbPath)
+// RecordContext is Record bounded by ctx. Once ctx is done the open batch is
+// rolled back and the context's error is returned; earlier batches stay
+// committed and are counted as recorded.
+func (es *EventStore) RecordContext(ctx context.Context, filename string, opts RecordOptions) (recorded int, skipped int, err error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	file, err := openInput(filename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		return 0, 0, err
 	}
+	defer file.Close()
 
-	// Configure SQLite for performance
-	pragmas := []string{
-		"PRAGMA journal_mode = WAL",    // Write-ahead logging for better concurrency
-		"PRAGMA synchronous = NORMAL",  // Balance safety and performance
-		"PRAGMA cache_size = 10000",    // 10MB cache
-		"PRAGMA temp_store = MEMORY",   // Use memory for temporary tables
-		"PRAGMA mmap_size = 268435456", // 256MB memory-mapped I/O
-	}
+	return es.ingest(ctx, newRecordSource(file, opts), opts)
+}
 
-	for _, pragma := range pragmas {
-		if _, err := db.Exec(pragma); err != nil {
-			db.Close()
-			return nil, fmt.Errorf("failed to set pragma: %v", err)
-		}
+// newRecordSource reads r in the input format given by opts
+func newRecordSource(r io.Reader, opts RecordOptions) lineSource {
+	if opts.InputFormat == InputFormatCSV {
+		return newCSVSource(r, opts.parser())
 	}
+	return newLineReader(r, opts.MaxLineSize)
+}
 
-	// Create table if not exists
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS events (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		timestamp TEXT NOT NULL,
-		event_type TEXT NOT NULL,
-		payload TEXT NOT NULL
-	);`
-
-	if _, err := db.Exec(createTableSQL); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to create table: %v", err)
+// openInput opens a file to ingest, "-" meaning stdin. Files whose name ends
+// in .gz are decompressed on the fly.
+func openInput(filename string) (io.ReadCloser, error) {
+	if filename == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return file, nil
 	}
 
-	// Create indexes for fast queries
-	indexes := []string{
-		"CREATE INDEX IF NOT EXISTS idx_user_timestamp ON events(user_id, timestamp)",
-		"CREATE INDEX IF NOT EXISTS idx_user_type_timestamp ON events(user_id, event_type, timestamp)",
+	decompressed, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read %s: %v", filename, err)
 	}
+	return &gzipInput{Reader: decompressed, file: file}, nil
+}
 
-	for _, indexSQL := range indexes {
-		if _, err := db.Exec(indexSQL); err != nil {
-			db.Close()
-			return nil, fmt.Errorf("failed to create index: %v", err)
-		}
+// gzipInput closes both the decompressor and the file underneath it
+type gzipInput struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (gi *gzipInput) Close() error {
+	gi.Reader.Close()
+	return gi.file.Close()
+}
+
+// RecordMerged ingests several files that are each sorted by timestamp,
+// merging them so events are inserted in global timestamp order
+func (es *EventStore) RecordMerged(filenames []string, opts RecordOptions) (recorded int, skipped int, err error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if (opts.InputFormat != InputFormatPipe && opts.InputFormat != "") || (opts.Parser != InputFormatPipe && opts.Parser != "") {
+		return 0, 0, fmt.Errorf("merging requires pipe-delimited input")
 	}
 
-	// Prepare insert statement
-	insertStmt, err := db.Prepare(`
-		INSERT INTO events (user_id, timestamp, event_type, payload) 
-		VALUES (?, ?, ?, ?)
-	`)
+	merge, err := newSortedMerge(filenames, opts.parser().delimiter(), opts.MaxLineSize)
 	if err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to prepare insert statement: %v", err)
+		return 0, 0, err
 	}
+	defer merge.Close()
 
-	return &EventStore{
-		db:         db,
-		insertStmt: insertStmt,
-	}, nil
+	return es.ingest(context.Background(), merge, opts)
 }
 
-// Close closes the database connection
-func (es *EventStore) Close() error {
-	if es.insertStmt != nil {
-		es.insertStmt.Close()
+// Follow ingests a file and then keeps polling it for appended lines until
+// stop is closed, committing partial batches every opts.FlushInterval
+// (DefaultFollowFlushInterval if unset). Truncated or rotated files are
+// reopened from the start. The read lock is held throughout, so connection
+// recycling waits until following stops.
+func (es *EventStore) Follow(filename string, opts RecordOptions, stop <-chan struct{}) (recorded int, skipped int, err error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if opts.InputFormat == InputFormatCSV {
+		return 0, 0, fmt.Errorf("following requires line-based input")
 	}
-	if es.db != nil {
-		return es.db.Close()
+
+	follower, err := newFileFollower(filename, stop)
+	if err != nil {
+		return 0, 0, err
 	}
-	return nil
+	defer follower.Close()
+
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFollowFlushInterval
+	}
+	return es.ingest(context.Background(), follower, opts)
 }
 
-// Record ingests events from a file into the database
-func (es *EventStore) Record(filename string) (int, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return 0, fmt.Errorf("failed to open file: %v", err)
+// ingest parses every line from the source and inserts the valid events in
+// batched transactions, returning the number recorded and skipped.
+// Duplicates ignored because of the unique index are not counted as either.
+// The database work is bounded by ctx.
+func (es *EventStore) ingest(ctx context.Context, source lineSource, opts RecordOptions) (int, int, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, 0, err
 	}
-	defer file.Close()
 
-	// Begin transaction for batch insert
-	tx, err := es.db.Begin()
-	if err != nil {
-		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	maxBatchSize := opts.BatchSize
+	if maxBatchSize <= 0 {
+		maxBatchSize = DefaultBatchSize
 	}
-	defer tx.Rollback()
 
-	// Use transaction version of prepared statement
-	stmt := tx.Stmt(es.insertStmt)
-	defer stmt.Close()
+	// A dry run never touches the database
+	var insertStmt, stmt *sql.Stmt
+	var tx *sql.Tx
+	dedupe := false
+	if !opts.DryRun {
+		if err := es.writable("record events"); err != nil {
+			return 0, 0, err
+		}
+
+		// Duplicates are ignored once the unique index exists, whether it
+		// was asked for now or by an earlier run
+		var err error
+		dedupe, err = es.hasDedupeIndex()
+		if err != nil {
+			return 0, 0, err
+		}
+		if opts.Dedupe && !dedupe {
+			if err := es.createDedupeIndex(ctx); err != nil {
+				return 0, 0, err
+			}
+			dedupe = true
+		}
+		if opts.NormalizeType && !es.normalizeTypes.Load() {
+			if err := es.setSetting(ctx, settingNormalizeTypes, "true"); err != nil {
+				return 0, 0, err
+			}
+			es.normalizeTypes.Store(true)
+		}
+		if opts.NoJSONValidate && !es.rawPayloads.Load() {
+			if err := es.setSetting(ctx, settingRawPayloads, "true"); err != nil {
+				return 0, 0, err
+			}
+			es.rawPayloads.Store(true)
+		}
+
+		var closeInsert func()
+		insertStmt, closeInsert, err = es.insertStatement(dedupe)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer closeInsert()
+
+		// Begin transaction for batch insert
+		tx, err = es.beginWrite(ctx)
+		if err != nil {
+			return 0, 0, &StoreError{Op: "begin transaction", Err: err}
+		}
+
+		// Use transaction version of prepared statement
+		stmt = tx.Stmt(insertStmt)
+
+		// Roll back whichever batch is open if we return early; this is a
+		// no-op once the batch has been committed
+		defer func() {
+			stmt.Close()
+			tx.Rollback()
+		}()
+	}
 
-	scanner := bufio.NewScanner(file)
 	count := 0
+	skipped := 0
+	ignored := 0
 	batchSize := 0
-	const maxBatchSize = 10000
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue // Skip empty lines
+	var sampler *rand.Rand
+	sampledOut := 0
+	if opts.Sample > 0 && opts.Sample < 1 {
+		sampler = rand.New(rand.NewSource(opts.Seed))
+	}
+
+	// commitBatch commits the open batch and starts the next one
+	lastCommit := time.Now()
+	commitBatch := func() error {
+		if opts.DryRun {
+			lastCommit = time.Now()
+			batchSize = 0
+			return nil
+		}
+		if err := tx.Commit(); err != nil {
+			return &StoreError{Op: "commit batch", Err: err}
 		}
+		stmt.Close()
+		lastCommit = time.Now()
 
-		event, err := ParseEvent(line)
+		// Start new transaction
+		var err error
+		tx, err = es.beginWrite(ctx)
 		if err != nil {
-			fmt.Printf("Warning: Skipping invalid line: %v\n", err)
-			continue
+			return &StoreError{Op: "begin new transaction", Err: err}
 		}
+		stmt = tx.Stmt(insertStmt)
+		batchSize = 0
+		return nil
+	}
 
-		_, err = stmt.Exec(
-			event.UserID,
-			event.Timestamp.Format(time.RFC3339),
-			event.EventType,
-			string(event.Payload),
-		)
-		if err != nil {
-			return count, fmt.Errorf("failed to insert event: %v", err)
+	// Lines are parsed on worker goroutines; inserts stay on this one since
+	// SQLite writes are serialized anyway
+	pipeline := newParsePipeline(source, opts.parseLine(), opts.workers(), opts.FlushInterval > 0)
+	defer pipeline.Stop()
+
+	progress := newProgressReporter(os.Stderr)
+	defer progress.Clear()
+
+	stopped := false
+chunks:
+	for chunk := range pipeline.ordered {
+		<-chunk.results
+
+		if opts.FlushInterval > 0 && batchSize > 0 && time.Since(lastCommit) >= opts.FlushInterval {
+			if err := commitBatch(); err != nil {
+				return count, skipped, err
+			}
 		}
 
-		count++
-		batchSize++
+		for _, line := range chunk.lines {
+			select {
+			case <-opts.Stop:
+				stopped = true
+				break chunks
+			case <-ctx.Done():
+				// The transaction was rolled back with the context
+				return count - batchSize, skipped, fmt.Errorf("recording stopped: %v", ctx.Err())
+			default:
+			}
 
-		// Commit in batches to manage memory and provide progress
-		if batchSize >= maxBatchSize {
-			if err = tx.Commit(); err != nil {
-				return count, fmt.Errorf("failed to commit batch: %v", err)
+			if line.err == nil && (opts.NormalizeType || es.normalizeTypes.Load()) {
+				line.event.EventType = normalizeEventType(line.event.EventType)
+			}
+			if line.err == nil {
+				line.err = opts.checkEvent(line.event)
+			}
+			if line.err != nil {
+				position := line.position
+				if position == "" {
+					position = fmt.Sprintf("line %d", line.lineNum)
+				}
+				if opts.Strict {
+					return count - batchSize, skipped, fmt.Errorf("%s: %w: %q", position, lineError(line.err, line.lineNum), truncateLine(line.text))
+				}
+				if opts.Rejects != nil {
+					if err := writeRejectedLine(opts.Rejects, position, line); err != nil {
+						return count - batchSize, skipped, err
+					}
+				} else {
+					progress.Clear()
+					logger.Warnf("Skipping %s: %v", position, line.err)
+				}
+				skipped++
+				continue
+			}
+			if sampler != nil && sampler.Float64() >= opts.Sample {
+				sampledOut++
+				continue
 			}
 
-			fmt.Printf("Processed %d events...\n", count)
+			event := line.event
+			if opts.Canonicalize {
+				// Parsed payloads are valid JSON, so this cannot fail
+				event.Payload, _ = canonicalizeJSON(event.Payload)
+			}
+			if !opts.DryRun {
+				result, err := stmt.ExecContext(ctx, es.insertArgs(event)...)
+				if err != nil {
+					return count, skipped, &StoreError{Op: "insert event", Err: err}
+				}
+				if dedupe {
+					if inserted, _ := result.RowsAffected(); inserted == 0 {
+						ignored++
+						continue
+					}
+				}
+			}
 
-			// Start new transaction
-			tx, err = es.db.Begin()
-			if err != nil {
-				return count, fmt.Errorf("failed to begin new transaction: %v", err)
+			if logger.enabled(LogVerbose) {
+				logger.Debugf("Recorded line %d: user %d, %s at %s", line.lineNum, event.UserID, event.EventType, event.Timestamp.UTC().Format(time.RFC3339))
+			}
+			count++
+			batchSize++
+
+			// Commit in batches to manage memory and provide progress
+			if batchSize >= maxBatchSize {
+				if err := commitBatch(); err != nil {
+					return count, skipped, err
+				}
+				if !progress.interactive {
+					logger.Infof("Processed %d events...", count)
+				}
 			}
-			stmt = tx.Stmt(es.insertStmt)
-			batchSize = 0
 		}
+		progress.Update(count)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return count, fmt.Errorf("error reading file: %v", err)
+	// After a stop the reader may still be mid-file; the deferred Stop ends it
+	if !stopped {
+		if err := pipeline.Err(); err != nil {
+			return count, skipped, fmt.Errorf("error reading file: %v", err)
+		}
 	}
 
 	// Commit remaining events
-	if err = tx.Commit(); err != nil {
-		return count, fmt.Errorf("failed to commit final batch: %v", err)
+	if !opts.DryRun {
+		if err := tx.Commit(); err != nil {
+			return count, skipped, &StoreError{Op: "commit final batch", Err: err}
+		}
 	}
 
-	return count, nil
+	if dedupe {
+		logger.Infof("Ignored %d duplicate events", ignored)
+	}
+	if sampler != nil {
+		logger.Infof("Sampled out %d valid events", sampledOut)
+	}
+
+	return count, skipped, nil
 }
 
-// Query retrieves events for a specific user with optional filters
-func (es *EventStore) Query(userID int64, filters QueryFilters) (int, error) {
-	if err := filters.Validate(); err != nil {
-		return 0, fmt.Errorf("invalid filters: %v", err)
+// rejectedLine is what RecordOptions.Rejects receives for a skipped line.
+// Text is the raw line, so it can be fixed and recorded again.
+type rejectedLine struct {
+	Position string `json:"position"`
+	Line     int    `json:"line"`
+	Error    string `json:"error"`
+	Text     string `json:"text"`
+}
+
+// writeRejectedLine writes a skipped line to w as one JSON object
+func writeRejectedLine(w io.Writer, position string, line parsedLine) error {
+	encoded, err := json.Marshal(rejectedLine{
+		Position: position,
+		Line:     line.lineNum,
+		Error:    line.err.Error(),
+		Text:     line.text,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode rejected line: %v", err)
+	}
+	if _, err := w.Write(append(encoded, '\n')); err != nil {
+		return fmt.Errorf("failed to write rejected line: %v", err)
 	}
+	return nil
+}
 
-	// Build dynamic query based on filters
-	query := `
-		SELECT timestamp, user_id, event_type, payload 
-		FROM events 
-		WHERE user_id = ?`
+// truncateLine shortens a raw input line for inclusion in error messages
+func truncateLine(line string) string {
+	const maxLen = 200
+	if len(line) <= maxLen {
+		return line
+	}
+	return line[:maxLen] + "..."
+}
 
-	args := []interface{}{userID}
+// Query writes the events matching the filters to out, one rendered line
+// per event, and returns how many were written. Output is buffered
+// internally and flushed before returning.
+func (es *EventStore) Query(userID int64, filters QueryFilters, output OutputOptions, out io.Writer) (int, error) {
+	return es.QueryContext(context.Background(), userID, filters, output, out)
+}
+
+// QueryContext is Query bounded by ctx. Once ctx is done the query is
+// interrupted and the context's error is returned, after the events already
+// written.
+func (es *EventStore) QueryContext(ctx context.Context, userID int64, filters QueryFilters, output OutputOptions, out io.Writer) (int, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
 
-	if filters.EventType != "" {
-		query += " AND event_type = ?"
-		args = append(args, filters.EventType)
+	if err := output.Validate(); err != nil {
+		return 0, fmt.Errorf("invalid output options: %v", err)
+	}
+	header, err := output.header()
+	if err != nil {
+		return 0, fmt.Errorf("failed to format header: %v", err)
+	}
+	render, err := output.renderer()
+	if err != nil {
+		return 0, fmt.Errorf("invalid output options: %v", err)
 	}
+	if output.Number {
+		render = output.numbered(render, filters.Offset)
+	}
+	filters = output.queryFilters(filters)
+	return es.writeEvents(ctx, userID, filters, out, output.BufferSize, header, render)
+}
 
-	if !filters.From.IsZero() {
-		query += " AND timestamp >= ?"
-		args = append(args, filters.From.Format(time.RFC3339))
+// Export writes the events matching the filters to w in the line format of
+// the parser, so the output can be ingested again with Record using the same
+// delimiter
+func (es *EventStore) Export(userID int64, filters QueryFilters, parser *Parser, w io.Writer) (int, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := parser.Validate(); err != nil {
+		return 0, err
 	}
+	return es.writeEvents(context.Background(), userID, filters, w, 0, nil, func(e *Event) ([]byte, error) {
+		return []byte(parser.Format(e)), nil
+	})
+}
 
-	if !filters.To.IsZero() {
-		query += " AND timestamp <= ?"
-		args = append(args, filters.To.Format(time.RFC3339))
+// QueryEvents returns the events matching the filters, in the same order and
+// with the same dedupe handling as Query, for callers embedding the store
+func (es *EventStore) QueryEvents(userID int64, filters QueryFilters) ([]*Event, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	var events []*Event
+	_, err := es.eachEvent(context.Background(), userID, filters, func(event *Event) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return events, nil
+}
 
-	query += " ORDER BY timestamp"
+// RecentEvents returns a user's n most recent events of any type, newest
+// first. They are read backwards along idx_user_timestamp, so the cost does
+// not grow with the user's history.
+func (es *EventStore) RecentEvents(userID int64, n int) ([]*Event, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("number of events must be at least 1, got %d", n)
+	}
+	return es.QueryEvents(userID, QueryFilters{Order: OrderDesc, Limit: n})
+}
 
-	// Execute query
-	rows, err := es.db.Query(query, args...)
+// writeEvents streams the matching events through render to out, buffering
+// bufferSize bytes (DefaultOutputBufferSize if zero), after the header line
+// if one is given
+func (es *EventStore) writeEvents(ctx context.Context, userID int64, filters QueryFilters, out io.Writer, bufferSize int, header []byte, render func(*Event) ([]byte, error)) (int, error) {
+	var suppressed int
+	count, err := writeEventStream(out, bufferSize, header, render, func(fn func(*Event) error) error {
+		var err error
+		suppressed, err = es.eachEvent(ctx, userID, filters, fn)
+		return err
+	})
 	if err != nil {
-		return 0, fmt.Errorf("query failed: %v", err)
+		return count, err
+	}
+
+	if filters.DedupeWindow > 0 {
+		logger.Infof("Suppressed %d near-duplicate events", suppressed)
+	}
+
+	return count, nil
+}
+
+// writeEventStream writes the events each yields through render to out, as
+// described for writeEvents
+func writeEventStream(out io.Writer, bufferSize int, header []byte, render func(*Event) ([]byte, error), each func(fn func(*Event) error) error) (int, error) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultOutputBufferSize
+	}
+	writer := bufio.NewWriterSize(out, bufferSize)
+	if header != nil {
+		writer.Write(header)
+		writer.WriteByte('\n')
 	}
-	defer rows.Close()
 
 	count := 0
+	err := each(func(event *Event) error {
+		line, err := render(event)
+		if err != nil {
+			return fmt.Errorf("failed to format event: %v", err)
+		}
+		writer.Write(line)
+		if err := writer.WriteByte('\n'); err != nil {
+			return fmt.Errorf("failed to write event: %v", err)
+		}
+		count++
+		return nil
+	})
+	if flushErr := writer.Flush(); err == nil && flushErr != nil {
+		err = fmt.Errorf("failed to write events: %v", flushErr)
+	}
+	return count, err
+}
+
+// eachEvent validates the filters and calls fn for every matching event in
+// order, applying the dedupe window if one is set. It returns the number of
+// events suppressed as near-duplicates.
+func (es *EventStore) eachEvent(ctx context.Context, userID int64, filters QueryFilters, fn func(*Event) error) (int, error) {
+	if err := filters.Validate(); err != nil {
+		return 0, &FilterError{Err: err}
+	}
+	// Guard against dumping the whole database by accident
+	if filters.AllUsers && !filters.bounded() {
+		return 0, fmt.Errorf("all-users queries need a time range, an ID range or a limit")
+	}
+
+	if filters.DedupeWindow <= 0 {
+		query, args := buildSelectQuery(userID, es.storeFilters(filters))
+		return 0, es.scanEvents(ctx, query, args, fn)
+	}
+
+	// Limit and offset count deduped events, so they are applied here
+	// rather than in SQL, and the scan stops once the limit is reached
+	dedupe := newDedupeFilter(filters.DedupeWindow)
+	limit, skip := filters.Limit, filters.Offset
+	filters.Limit, filters.Offset = 0, 0
+	emitted := 0
+
+	query, args := buildSelectQuery(userID, es.storeFilters(filters))
+	err := es.scanEvents(ctx, query, args, func(event *Event) error {
+		if !dedupe.allow(event) {
+			return nil
+		}
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+		emitted++
+		if limit > 0 && emitted >= limit {
+			return errScanDone
+		}
+		return nil
+	})
+	if err == errScanDone {
+		err = nil
+	}
+	return dedupe.suppressed, err
+}
+
+// errScanDone stops a scan early once enough events have been emitted
+var errScanDone = errors.New("scan done")
+
+// scanEvents runs a query selecting id, timestamp, user_id, event_type and
+// payload, then any extracted payload values, and calls fn for every row in
+// order, stopping at the first error
+func (es *EventStore) scanEvents(ctx context.Context, query string, args []interface{}, fn func(*Event) error) error {
+	rows, err := es.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &StoreError{Op: "run query", Err: err}
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return &StoreError{Op: "read columns", Err: err}
+	}
+	fixed := 5
+	var ingestedStr sql.NullString
+	if len(columns) > fixed && columns[fixed] == "ingested_at" {
+		fixed++
+	}
+	extracted := make([]sql.NullString, len(columns)-fixed)
+
 	for rows.Next() {
 		var timestampStr string
-		var payloadStr string
+		var payload interface{}
 		var event Event
 
-		err := rows.Scan(&timestampStr, &event.UserID, &event.EventType, &payloadStr)
-		if err != nil {
-			return count, fmt.Errorf("failed to scan row: %v", err)
+		dest := []interface{}{&event.ID, &timestampStr, &event.UserID, &event.EventType, &payload}
+		if fixed > 5 {
+			dest = append(dest, &ingestedStr)
+		}
+		for i := range extracted {
+			dest = append(dest, &extracted[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return &StoreError{Op: "scan row", Err: err}
+		}
+		if len(extracted) > 0 {
+			event.extracted = make([]string, len(extracted))
+			for i, value := range extracted {
+				event.extracted[i] = value.String
+			}
 		}
 
 		// Parse timestamp
 		event.Timestamp, err = time.Parse(time.RFC3339, timestampStr)
 		if err != nil {
-			return count, fmt.Errorf("failed to parse timestamp: %v", err)
+			return fmt.Errorf("failed to parse timestamp: %v", err)
+		}
+		if ingestedStr.Valid {
+			event.IngestedAt, err = time.Parse(time.RFC3339, ingestedStr.String)
+			if err != nil {
+				return fmt.Errorf("failed to parse ingest time: %v", err)
+			}
 		}
 
-		event.Payload = json.RawMessage(payloadStr)
+		// Rows written by other tools may have a NULL or empty payload.
+		// Only BLOBs are compressed, as in payloadSQL; a raw TEXT payload
+		// may start with any byte.
+		event.Payload = json.RawMessage(EmptyPayloadNull)
+		switch stored := payload.(type) {
+		case []byte:
+			if len(stored) > 0 {
+				event.Payload, err = decompressPayload(stored)
+				if err != nil {
+					return err
+				}
+			}
+		case string:
+			if stored != "" {
+				event.Payload = json.RawMessage(stored)
+			}
+		}
 
-		// Output in required format
-		fmt.Println(event.String())
-		count++
+		if err := fn(&event); err != nil {
+			return err
+		}
 	}
 
 	if err = rows.Err(); err != nil {
-		return count, fmt.Errorf("rows iteration error: %v", err)
+		return &StoreError{Op: "read rows", Err: err}
+	}
+	return nil
+}
+
+// buildSelectQuery builds the ordered, paginated SELECT for a user's events
+func buildSelectQuery(userID int64, filters QueryFilters) (string, []interface{}) {
+	where, args := buildWhereClause(userID, filters)
+	payload := "payload"
+	if filters.omitPayload {
+		payload = "NULL"
+	}
+	var extracted string
+	if len(filters.extract) > 0 {
+		extractArgs := make([]interface{}, 0, len(filters.extract)+len(args))
+		for _, path := range filters.extract {
+			extracted += ", json_extract(" + payloadJSONSQL(filters) + ", ?)"
+			extractArgs = append(extractArgs, path)
+		}
+		args = append(extractArgs, args...)
+	}
+	ingested := ""
+	if filters.ingested {
+		ingested = ", ingested_at"
+	}
+	query := `
+		SELECT id, timestamp, user_id, event_type, ` + payload + ingested + extracted + `
+		FROM events` + where
+
+	// Ties on timestamp break by ID, i.e. insertion order, so output is
+	// reproducible. The indexes end in the rowid, so this adds no sort.
+	order := " ORDER BY timestamp ASC, id ASC"
+	if filters.Order == OrderDesc {
+		order = " ORDER BY timestamp DESC, id DESC"
+	}
+	if filters.SortPayload != "" {
+		// Validate has checked the key. Events lacking it sort last.
+		path, _ := payloadPath(filters.SortPayload)
+		key := "json_extract(" + payloadJSONSQL(filters) + ", ?)"
+		if filters.SortNumeric {
+			key = "CAST(" + key + " AS REAL)"
+		}
+		direction := " ASC"
+		if filters.SortDir == OrderDesc {
+			direction = " DESC"
+		}
+		order = " ORDER BY " + key + " IS NULL, " + key + direction + "," + strings.TrimPrefix(order, " ORDER BY")
+		args = append(args, path, path)
+	}
+	query += order
+
+	// SQLite only accepts OFFSET after a LIMIT; -1 lifts the limit
+	if filters.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filters.Limit, filters.Offset)
+	} else if filters.Offset > 0 {
+		query += " LIMIT -1 OFFSET ?"
+		args = append(args, filters.Offset)
+	}
+
+	return query, args
+}
+
+// Count returns the number of events matching the filters without reading
+// the rows themselves. Limit, offset and dedupe window are ignored.
+func (es *EventStore) Count(userID int64, filters QueryFilters) (int, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := filters.Validate(); err != nil {
+		return 0, &FilterError{Err: err}
 	}
 
+	where, args := buildWhereClause(userID, es.storeFilters(filters))
+
+	var count int
+	if err := es.db.QueryRow("SELECT COUNT(*) FROM events"+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("count query failed: %v", err)
+	}
 	return count, nil
 }
 
+// ExplainQuery returns SQLite's query plan for the SELECT that Query would
+// run with these filters, one step per line and nested steps indented, to
+// check which index is used
+func (es *EventStore) ExplainQuery(userID int64, filters QueryFilters) (string, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := filters.Validate(); err != nil {
+		return "", &FilterError{Err: err}
+	}
+
+	query, args := buildSelectQuery(userID, es.storeFilters(filters))
+	rows, err := es.db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return "", fmt.Errorf("explain failed: %v", err)
+	}
+	defer rows.Close()
+
+	var plan strings.Builder
+	depth := make(map[int]int)
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			return "", fmt.Errorf("failed to scan plan row: %v", err)
+		}
+		// Steps reference their parent step; the root's parent is 0
+		depth[id] = depth[parent] + 1
+		plan.WriteString(strings.Repeat("  ", depth[id]-1) + detail + "\n")
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("rows iteration error: %v", err)
+	}
+	return plan.String(), nil
+}
+
+// buildWhereClause builds the WHERE clause and its arguments shared by every
+// per-user query path, so counting and listing always agree on the filters.
+// With filters.AllUsers the user condition is left out, and with
+// filters.UserRange it is a range that idx_user_timestamp still serves.
+func buildWhereClause(userID int64, filters QueryFilters) (string, []interface{}) {
+	if filters.AllUsers {
+		conditions, args := appendFilterConditions("", nil, filters)
+		if conditions == "" {
+			return "", nil
+		}
+		return " WHERE" + strings.TrimPrefix(conditions, " AND"), args
+	}
+	if filters.UserRange {
+		where := " WHERE user_id BETWEEN ? AND ?"
+		args := []interface{}{filters.FromUser, filters.ToUser}
+		return appendFilterConditions(where, args, filters)
+	}
+
+	where := " WHERE user_id = ?"
+	args := []interface{}{userID}
+	return appendFilterConditions(where, args, filters)
+}
+
+// appendFilterConditions appends the event type, time range, ID and payload
+// conditions from the filters to a WHERE clause
+func appendFilterConditions(where string, args []interface{}, filters QueryFilters) (string, []interface{}) {
+	if len(filters.EventTypes) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(filters.EventTypes)), ", ")
+		where += " AND event_type IN (" + placeholders + ")"
+		for _, eventType := range filters.EventTypes {
+			args = append(args, eventType)
+		}
+	}
+
+	if !filters.From.IsZero() {
+		where += " AND timestamp >= ?"
+		args = append(args, storedTime(filters.From))
+	}
+
+	if !filters.To.IsZero() {
+		where += " AND timestamp <= ?"
+		args = append(args, storedTime(filters.To))
+	}
+
+	// ingested_at has no index; events ingested before it existed are NULL
+	// and match no bound
+	if !filters.IngestedFrom.IsZero() {
+		where += " AND ingested_at >= ?"
+		args = append(args, storedTime(filters.IngestedFrom))
+	}
+	if !filters.IngestedTo.IsZero() {
+		where += " AND ingested_at <= ?"
+		args = append(args, storedTime(filters.IngestedTo))
+	}
+
+	switch {
+	case filters.ID != 0:
+		where += " AND id = ?"
+		args = append(args, filters.ID)
+	case filters.FromID != 0 && filters.ToID != 0:
+		where += " AND id BETWEEN ? AND ?"
+		args = append(args, filters.FromID, filters.ToID)
+	case filters.FromID != 0:
+		where += " AND id >= ?"
+		args = append(args, filters.FromID)
+	case filters.ToID != 0:
+		where += " AND id <= ?"
+		args = append(args, filters.ToID)
+	}
+
+	// Payload conditions use SQLite's JSON functions; the operator was
+	// checked against a fixed list by Validate
+	for _, condition := range filters.PayloadConditions {
+		path, _ := payloadPath(condition.Field)
+		where += " AND json_extract(" + payloadJSONSQL(filters) + ", ?) " + condition.Op + " ?"
+		args = append(args, path, condition.Value)
+	}
+
+	// json_type, unlike json_extract, tells a key holding null from a
+	// missing one
+	for _, key := range filters.HasKeys {
+		path, _ := payloadPath(key)
+		where += " AND json_type(" + payloadJSONSQL(filters) + ", ?) IS NOT NULL"
+		args = append(args, path)
+	}
+	for _, key := range filters.MissingKeys {
+		path, _ := payloadPath(key)
+		where += " AND json_type(" + payloadJSONSQL(filters) + ", ?) IS NULL"
+		args = append(args, path)
+	}
+	if filters.Sample > 0 {
+		// Knuth's multiplicative hash spreads consecutive IDs over 32 bits.
+		// A 32-bit value times the 32-bit constant overflows int64, which
+		// SQLite turns into REAL arithmetic, so the key is multiplied in
+		// 16-bit halves: the high half's product only matters mod 2^16.
+		seed := int64(uint32(filters.Seed))
+		where += " AND ((((((id + ?) & 4294967295) >> 16) * 2654435761 & 65535) << 16)" +
+			" + (((id + ?) & 65535) * 2654435761)) & 4294967295 < ?"
+		args = append(args, seed, seed, int64(filters.Sample*(1<<32)))
+	}
+
+	return where, args
+}
+
 // GetStats returns basic statistics about the stored events
 func (es *EventStore) GetStats() (map[string]interface{}, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
 	stats := make(map[string]interface{})
 
 	// Total events
@@ -264,13 +2013,40 @@ func (es *EventStore) GetStats() (map[string]interface{}, error) {
 	}
 	stats["unique_users"] = uniqueUsers
 
-	// Date range
-	var minTime, maxTime string
+	// Date range (MIN/MAX are NULL on an empty table)
+	var minTime, maxTime sql.NullString
 	err = es.db.QueryRow("SELECT MIN(timestamp), MAX(timestamp) FROM events").Scan(&minTime, &maxTime)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
-	stats["time_range"] = map[string]string{"from": minTime, "to": maxTime}
+	stats["time_range"] = map[string]string{"from": displayTime(minTime.String), "to": displayTime(maxTime.String)}
+
+	// Per-type breakdown
+	rows, err := es.db.Query("SELECT event_type, COUNT(*), COUNT(DISTINCT user_id) FROM events GROUP BY event_type")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byType := make(map[string]TypeStats)
+	for rows.Next() {
+		var eventType string
+		var typeStats TypeStats
+		if err := rows.Scan(&eventType, &typeStats.Events, &typeStats.UniqueUsers); err != nil {
+			return nil, err
+		}
+		byType[eventType] = typeStats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	stats["by_type"] = byType
 
 	return stats, nil
 }
+
+// TypeStats summarizes the events of one type in GetStats
+type TypeStats struct {
+	Events      int `json:"events"`
+	UniqueUsers int `json:"unique_users"`
+}
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestStore opens an empty in-memory store that is closed when the test
+// ends
+func newTestStore(t testing.TB) *EventStore {
+	t.Helper()
+	store, err := NewEventStore(MemoryDBPath)
+	if err != nil {
+		t.Fatalf("NewEventStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// insertTestEvents stores n events for user, a minute apart from base,
+// alternating between the login and purchase types
+func insertTestEvents(t testing.TB, store *EventStore, user int64, n int, base time.Time) {
+	t.Helper()
+	events := make([]*Event, n)
+	for i := range events {
+		eventType := "login"
+		if i%2 == 1 {
+			eventType = "purchase"
+		}
+		events[i] = &Event{
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+			UserID:    user,
+			EventType: eventType,
+			Payload:   json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)),
+		}
+	}
+	if _, err := store.InsertBatch(events); err != nil {
+		t.Fatalf("InsertBatch: %v", err)
+	}
+}
+
+// writeTestInput writes lines to a file in a temporary directory and
+// returns its path
+func writeTestInput(t testing.TB, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "events.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var testBase = time.Date(2023, 8, 14, 10, 0, 0, 0, time.UTC)
+
+func TestSampleExtremeSeeds(t *testing.T) {
+	store := newTestStore(t)
+	insertTestEvents(t, store, 1, 2000, testBase)
+
+	seeds := []int64{0, 7, -1, -5, 3400000000, 3500000000, 4000000000, math.MaxUint32, math.MaxInt64, math.MinInt64}
+	for _, seed := range seeds {
+		count, err := store.Count(1, QueryFilters{Sample: 0.5, Seed: seed})
+		if err != nil {
+			t.Fatalf("seed %d: Count: %v", seed, err)
+		}
+		if count < 800 || count > 1200 {
+			t.Errorf("seed %d: sampled %d of 2000 events, want about 1000", seed, count)
+		}
+	}
+}
+
+func TestSampleIsRepeatable(t *testing.T) {
+	store := newTestStore(t)
+	insertTestEvents(t, store, 1, 500, testBase)
+
+	filters := QueryFilters{Sample: 0.2, Seed: 4000000000}
+	first, err := store.QueryEvents(1, filters)
+	if err != nil {
+		t.Fatalf("QueryEvents: %v", err)
+	}
+	second, err := store.QueryEvents(1, filters)
+	if err != nil {
+		t.Fatalf("QueryEvents: %v", err)
+	}
+	if len(first) == 0 || len(first) != len(second) {
+		t.Fatalf("got %d then %d events, want the same non-empty sample", len(first), len(second))
+	}
+	for i := range first {
+		if first[i].ID != second[i].ID {
+			t.Fatalf("event %d: ID %d then %d", i, first[i].ID, second[i].ID)
+		}
+	}
+}
+
+// writeEventLines writes n events for user in the pipe format, a second
+// apart from base
+func writeEventLines(t testing.TB, user int64, n int, base time.Time) string {
+	t.Helper()
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%s | %d | login | {\"n\":%d}", base.Add(time.Duration(i)*time.Second).Format(time.RFC3339), user, i)
+	}
+	return writeTestInput(t, lines...)
+}
+
+func TestConcurrentRecorders(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "events.db")
+	const perRecorder = 5000
+
+	// Each recorder has its own store, as two processes would
+	stores := make([]*EventStore, 2)
+	inputs := make([]string, len(stores))
+	for i := range stores {
+		store, err := NewEventStore(dbPath)
+		if err != nil {
+			t.Fatalf("NewEventStore: %v", err)
+		}
+		defer store.Close()
+		stores[i] = store
+		inputs[i] = writeEventLines(t, int64(i+1), perRecorder, testBase)
+	}
+
+	errs := make(chan error, len(stores))
+	for i, store := range stores {
+		go func(store *EventStore, input string) {
+			// Small batches make the recorders take turns on the lock
+			recorded, _, err := store.Record(input, RecordOptions{BatchSize: 100})
+			if err == nil && recorded != perRecorder {
+				err = fmt.Errorf("recorded %d of %d events", recorded, perRecorder)
+			}
+			errs <- err
+		}(store, inputs[i])
+	}
+	for range stores {
+		if err := <-errs; err != nil {
+			t.Errorf("recorder: %v", err)
+		}
+	}
+
+	for user := int64(1); user <= int64(len(stores)); user++ {
+		count, err := stores[0].Count(user, QueryFilters{})
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+		if count != perRecorder {
+			t.Errorf("user %d has %d events, want %d", user, count, perRecorder)
+		}
+	}
+}
+
+func TestPurgeWaitsForWriter(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "events.db")
+	writer, err := NewEventStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewEventStore: %v", err)
+	}
+	defer writer.Close()
+	purger, err := NewEventStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewEventStore: %v", err)
+	}
+	defer purger.Close()
+	insertTestEvents(t, writer, 1, 10, testBase)
+
+	// Hold the write lock for a moment; the purge must wait, not fail
+	tx, err := writer.beginWrite(context.Background())
+	if err != nil {
+		t.Fatalf("beginWrite: %v", err)
+	}
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		tx.Rollback()
+		close(released)
+	}()
+
+	removed, err := purger.PurgeOlderThan(testBase.Add(5 * time.Minute))
+	<-released
+	if err != nil {
+		t.Fatalf("PurgeOlderThan: %v", err)
+	}
+	if removed != 5 {
+		t.Errorf("purged %d events, want 5", removed)
+	}
+}
+
+func TestWritesRetryWhileLocked(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "events.db")
+	holder, err := NewEventStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewEventStore: %v", err)
+	}
+	defer holder.Close()
+	// A busy timeout far shorter than the lock is held leaves it to
+	// beginWrite's retries to wait
+	config := DefaultStoreConfig()
+	config.BusyTimeout = 10 * time.Millisecond
+	store, err := NewEventStoreWithConfig(dbPath, config)
+	if err != nil {
+		t.Fatalf("NewEventStoreWithConfig: %v", err)
+	}
+	defer store.Close()
+
+	writes := []struct {
+		name  string
+		write func() error
+	}{
+		{"InsertBatch", func() error {
+			_, err := store.InsertBatch([]*Event{{Timestamp: testBase, UserID: 1, EventType: "login"}})
+			return err
+		}},
+		{"RebuildSummary", func() error {
+			_, err := store.RebuildSummary()
+			return err
+		}},
+		{"DropSummary", store.DropSummary},
+	}
+	for _, w := range writes {
+		tx, err := holder.beginWrite(context.Background())
+		if err != nil {
+			t.Fatalf("beginWrite: %v", err)
+		}
+		released := make(chan struct{})
+		go func() {
+			time.Sleep(150 * time.Millisecond)
+			tx.Rollback()
+			close(released)
+		}()
+
+		err = w.write()
+		<-released
+		if err != nil {
+			t.Errorf("%s while locked: %v", w.name, err)
+		}
+	}
+}
+
+func TestQueriesAcrossRecycle(t *testing.T) {
+	config := DefaultStoreConfig()
+	config.RecycleInterval = 5 * time.Millisecond
+	store, err := NewEventStoreWithConfig(filepath.Join(t.TempDir(), "events.db"), config)
+	if err != nil {
+		t.Fatalf("NewEventStoreWithConfig: %v", err)
+	}
+	defer store.Close()
+	insertTestEvents(t, store, 1, 100, testBase)
+
+	// Query and insert while the background loop swaps the connection
+	deadline := time.Now().Add(200 * time.Millisecond)
+	inserted := 0
+	for time.Now().Before(deadline) {
+		count, err := store.Count(1, QueryFilters{})
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+		if count != 100+inserted {
+			t.Fatalf("counted %d events, want %d", count, 100+inserted)
+		}
+		events, err := store.QueryEvents(1, QueryFilters{Limit: 10})
+		if err != nil || len(events) != 10 {
+			t.Fatalf("QueryEvents: %d events, %v", len(events), err)
+		}
+		if err := store.Insert(&Event{Timestamp: testBase, UserID: 1, EventType: "login"}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+		inserted++
+	}
+
+	// And right after a recycle done in the foreground
+	if err := store.recycle(); err != nil {
+		t.Fatalf("recycle: %v", err)
+	}
+	count, err := store.Count(1, QueryFilters{})
+	if err != nil || count != 100+inserted {
+		t.Errorf("after recycle counted %d events, %v; want %d", count, err, 100+inserted)
+	}
+}
+
+func TestMemoryStoreRefusesRecycle(t *testing.T) {
+	config := DefaultStoreConfig()
+	config.RecycleInterval = time.Second
+	if _, err := NewEventStoreWithConfig(MemoryDBPath, config); err == nil {
+		t.Error("recycling an in-memory store was accepted")
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	lines := []string{
+		`2023-08-14T10:00:00Z | 1 | login | {"ip":"10.0.0.1"}`,
+		`2023-08-14T10:00:00.123456789Z | 1 | search | {"q":"a | b"}`,
+		`2023-08-14T10:05:00+02:00 | 1 | purchase | {"item":"A123","price":80.15}`,
+		`2023-08-14T10:06:00Z | 1 | logout | null`,
+		`2023-08-14T10:07:00Z | 2 | login | {}`,
+	}
+	for _, parser := range []*Parser{defaultParser, {Delimiter: "\t"}} {
+		source := newTestStore(t)
+		input := writeTestInput(t, lines...)
+		if _, _, err := source.Record(input, RecordOptions{}); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+
+		exported := filepath.Join(t.TempDir(), "export.txt")
+		file, err := os.Create(exported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written, err := source.Export(1, QueryFilters{}, parser, file)
+		file.Close()
+		if err != nil || written != 4 {
+			t.Fatalf("Export: wrote %d events, %v; want 4", written, err)
+		}
+
+		target := newTestStore(t)
+		recorded, skipped, err := target.Record(exported, RecordOptions{Delimiter: parser.Delimiter})
+		if err != nil || recorded != 4 || skipped != 0 {
+			t.Fatalf("Record export: %d recorded, %d skipped, %v", recorded, skipped, err)
+		}
+
+		want, err := source.QueryEvents(1, QueryFilters{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := target.QueryEvents(1, QueryFilters{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("delimiter %q: got %d events back, want %d", parser.Delimiter, len(got), len(want))
+		}
+		for i := range want {
+			if !got[i].Timestamp.Equal(want[i].Timestamp) || got[i].UserID != want[i].UserID ||
+				got[i].EventType != want[i].EventType || string(got[i].Payload) != string(want[i].Payload) {
+				t.Errorf("delimiter %q: event %d is %s, want %s", parser.Delimiter, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestRecordAndQueryEmptyPayloads(t *testing.T) {
+	store := newTestStore(t)
+	input := writeTestInput(t,
+		"2023-08-14T10:00:00Z | 1 | logout | ",
+		"2023-08-14T10:01:00Z | 1 | logout |    ",
+		"2023-08-14T10:02:00Z | 1 | logout | null",
+	)
+	recorded, skipped, err := store.Record(input, RecordOptions{EmptyPayload: EmptyPayloadObject})
+	if err != nil || recorded != 3 || skipped != 0 {
+		t.Fatalf("Record: %d recorded, %d skipped, %v", recorded, skipped, err)
+	}
+	if err := store.Insert(&Event{Timestamp: testBase.Add(3 * time.Minute), UserID: 1, EventType: "logout"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	events, err := store.QueryEvents(1, QueryFilters{})
+	if err != nil {
+		t.Fatalf("QueryEvents: %v", err)
+	}
+	want := []string{"{}", "{}", "null", "null"}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, event := range events {
+		if string(event.Payload) != want[i] {
+			t.Errorf("event %d: payload %s, want %s", i, event.Payload, want[i])
+		}
+	}
+
+	// Payload filters see null payloads as having no keys
+	count, err := store.Count(1, QueryFilters{MissingKeys: []string{"item"}})
+	if err != nil || count != 4 {
+		t.Errorf("Count missing key: %d, %v; want 4", count, err)
+	}
+}
+
+func TestRecordCSVEmptyPayloads(t *testing.T) {
+	records := []string{
+		"2023-08-14T10:00:00Z,1,logout,",
+		`2023-08-14T10:01:00Z,1,login,"{""ip"":""10.0.0.1""}"`,
+	}
+	// The csv input format skips a header; the csv line parser does not
+	tests := []struct {
+		name  string
+		opts  RecordOptions
+		input string
+	}{
+		{"input format", RecordOptions{InputFormat: InputFormatCSV}, writeTestInput(t, append([]string{"timestamp,user_id,event_type,payload"}, records...)...)},
+		{"line parser", RecordOptions{Parser: InputFormatCSV}, writeTestInput(t, records...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			opts := tt.opts
+			opts.EmptyPayload = EmptyPayloadObject
+			recorded, skipped, err := store.Record(tt.input, opts)
+			if err != nil || recorded != 2 || skipped != 0 {
+				t.Fatalf("Record: %d recorded, %d skipped, %v", recorded, skipped, err)
+			}
+			events, err := store.QueryEvents(1, QueryFilters{Limit: 1})
+			if err != nil || len(events) != 1 || string(events[0].Payload) != "{}" {
+				t.Errorf("empty payload not stored as {}: %v, %v", events, err)
+			}
+
+			opts.EmptyPayload = EmptyPayloadReject
+			recorded, skipped, err = newTestStore(t).Record(tt.input, opts)
+			if err != nil || recorded != 1 || skipped != 1 {
+				t.Errorf("Record: %d recorded, %d skipped, %v; want the empty payload rejected", recorded, skipped, err)
+			}
+		})
+	}
+}
+
+func TestRecordLineOverScannerLimit(t *testing.T) {
+	long := `{"blob":"` + strings.Repeat("a", 64*1024) + `"}`
+	input := writeTestInput(t,
+		"2023-08-14T10:00:00Z | 1 | upload | "+long,
+		"2023-08-14T10:01:00Z | 1 | login | {}",
+	)
+
+	store := newTestStore(t)
+	recorded, skipped, err := store.Record(input, RecordOptions{})
+	if err != nil || recorded != 2 || skipped != 0 {
+		t.Fatalf("Record: %d recorded, %d skipped, %v; want 2, 0", recorded, skipped, err)
+	}
+	events, err := store.QueryEvents(1, QueryFilters{EventTypes: []string{"upload"}})
+	if err != nil || len(events) != 1 || string(events[0].Payload) != long {
+		t.Fatalf("long payload did not survive: %d events, %v", len(events), err)
+	}
+
+	// Over --max-line the line is skipped, not lost silently
+	store = newTestStore(t)
+	recorded, skipped, err = store.Record(input, RecordOptions{MaxLineSize: 64 * 1024})
+	if err != nil || recorded != 1 || skipped != 1 {
+		t.Errorf("Record with a smaller limit: %d recorded, %d skipped, %v; want 1, 1", recorded, skipped, err)
+	}
+	_, _, err = newTestStore(t).Record(input, RecordOptions{MaxLineSize: 64 * 1024, Strict: true})
+	if err == nil || !strings.Contains(err.Error(), "line too long") {
+		t.Errorf("strict Record = %v, want a line too long error", err)
+	}
+}
+
+func TestInsertAndQueryBack(t *testing.T) {
+	store := newTestStore(t)
+	offset := time.FixedZone("CEST", 2*60*60)
+	event := &Event{
+		Timestamp: time.Date(2023, 8, 14, 12, 30, 0, 500, offset),
+		UserID:    7,
+		EventType: "purchase",
+		Payload:   json.RawMessage(`{ "item": "A123",  "price": 80.15 }`),
+	}
+	if err := store.Insert(event); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	events, err := store.QueryEvents(7, QueryFilters{})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("QueryEvents: %d events, %v", len(events), err)
+	}
+	got := events[0]
+	if !got.Timestamp.Equal(event.Timestamp) || got.Timestamp.Location() != time.UTC {
+		t.Errorf("timestamp = %v, want %v in UTC", got.Timestamp, event.Timestamp)
+	}
+	if string(got.Payload) != `{"item":"A123","price":80.15}` {
+		t.Errorf("payload = %s, want it compacted", got.Payload)
+	}
+	if got.ID == 0 {
+		t.Error("event read back has no ID")
+	}
+}
+
+func TestInsertStoresTimestampsLikeRecord(t *testing.T) {
+	store := newTestStore(t)
+	input := writeTestInput(t, "2023-08-14T12:30:00.25+02:00 | 1 | login | {}")
+	if _, _, err := store.Record(input, RecordOptions{}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	timestamp, _ := time.Parse(time.RFC3339Nano, "2023-08-14T12:30:00.25+02:00")
+	if err := store.Insert(&Event{Timestamp: timestamp, UserID: 2, EventType: "login", Payload: json.RawMessage(`{}`)}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	rows, err := store.db.Query("SELECT timestamp FROM events ORDER BY user_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var stored []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, value)
+	}
+	if len(stored) != 2 || stored[0] != stored[1] {
+		t.Errorf("stored timestamps %q, want the same text for both", stored)
+	}
+}
+
+func TestInsertBatchIsAllOrNothing(t *testing.T) {
+	store := newTestStore(t)
+	events := []*Event{
+		{Timestamp: testBase, UserID: 1, EventType: "login"},
+		{Timestamp: testBase, UserID: 1, EventType: "login", Payload: json.RawMessage(`{broken`)},
+	}
+	if _, err := store.InsertBatch(events); err == nil {
+		t.Fatal("InsertBatch accepted an invalid payload")
+	}
+	if count, _ := store.Count(1, QueryFilters{}); count != 0 {
+		t.Errorf("a failed batch left %d events, want 0", count)
+	}
+
+	inserted, err := store.InsertBatch(events[:1])
+	if err != nil || inserted != 1 {
+		t.Errorf("InsertBatch: %d inserted, %v; want 1", inserted, err)
+	}
+}
+
+func TestRecordJSONInput(t *testing.T) {
+	store := newTestStore(t)
+	input := writeTestInput(t,
+		`{"timestamp":"2023-08-14T10:00:00Z","user_id":1,"event_type":"login","payload":{"ip":"10.0.0.1"}}`,
+		`{"timestamp":"2023-08-14T10:01:00Z","user_id":"1","event_type":"login"}`,
+		`{"timestamp":"2023-08-14T10:02:00Z","user_id":1,"event_type":"logout"}`,
+	)
+	recorded, skipped, err := store.Record(input, RecordOptions{InputFormat: InputFormatJSON})
+	if err != nil || recorded != 2 || skipped != 1 {
+		t.Errorf("Record: %d recorded, %d skipped, %v; want 2, 1", recorded, skipped, err)
+	}
+}
+
+func TestMemoryStoreRecordAndQuery(t *testing.T) {
+	store := newTestStore(t)
+	input := writeTestInput(t,
+		`2023-08-14T10:00:00Z | 1 | login | {"ip":"10.0.0.1"}`,
+		`2023-08-14T10:01:00Z | 1 | purchase | {"item":"A123"}`,
+		`2023-08-14T10:02:00Z | 2 | login | {}`,
+	)
+	if recorded, _, err := store.Record(input, RecordOptions{}); err != nil || recorded != 3 {
+		t.Fatalf("Record: %d recorded, %v", recorded, err)
+	}
+
+	var out bytes.Buffer
+	count, err := store.Query(1, QueryFilters{}, OutputOptions{}, &out)
+	if err != nil || count != 2 {
+		t.Fatalf("Query: %d events, %v", count, err)
+	}
+	want := "2023-08-14T10:00:00Z | 1 | login | {\"ip\":\"10.0.0.1\"}\n" +
+		"2023-08-14T10:01:00Z | 1 | purchase | {\"item\":\"A123\"}\n"
+	if out.String() != want {
+		t.Errorf("Query wrote %q, want %q", out.String(), want)
+	}
+
+	// Every goroutine must see the one in-memory database, not a fresh
+	// empty one on another connection
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if total, err := store.EventCount(); err != nil || total != 3 {
+				t.Errorf("EventCount: %d, %v; want 3", total, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMemoryStoresAreSeparate(t *testing.T) {
+	first := newTestStore(t)
+	second := newTestStore(t)
+	insertTestEvents(t, first, 1, 5, testBase)
+	if total, err := second.EventCount(); err != nil || total != 0 {
+		t.Errorf("second in-memory store has %d events, %v; want 0", total, err)
+	}
+}
+
+func TestSameTimestampOrderIsStable(t *testing.T) {
+	store := newTestStore(t)
+	types := []string{"e", "b", "d", "a", "c"}
+	for _, eventType := range types {
+		if err := store.Insert(&Event{Timestamp: testBase, UserID: 1, EventType: eventType}); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+	// A later event first in insertion order must still sort last
+	if err := store.Insert(&Event{Timestamp: testBase.Add(time.Second), UserID: 1, EventType: "z"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := store.Insert(&Event{Timestamp: testBase.Add(-time.Second), UserID: 1, EventType: "y"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	tests := []struct {
+		order string
+		want  string
+	}{
+		{OrderAsc, "yebdacz"},
+		{OrderDesc, "zcadbey"},
+	}
+	for _, tt := range tests {
+		for run := 0; run < 3; run++ {
+			events, err := store.QueryEvents(1, QueryFilters{Order: tt.order})
+			if err != nil {
+				t.Fatalf("QueryEvents: %v", err)
+			}
+			var got strings.Builder
+			for _, event := range events {
+				got.WriteString(event.EventType)
+			}
+			if got.String() != tt.want {
+				t.Errorf("order %s: got %s, want %s", tt.order, got.String(), tt.want)
+			}
+		}
+	}
+
+	// Paging through ties neither repeats nor skips an event
+	var paged strings.Builder
+	for offset := 0; offset < 7; offset += 2 {
+		events, err := store.QueryEvents(1, QueryFilters{Limit: 2, Offset: offset})
+		if err != nil {
+			t.Fatalf("QueryEvents: %v", err)
+		}
+		for _, event := range events {
+			paged.WriteString(event.EventType)
+		}
+	}
+	if paged.String() != "yebdacz" {
+		t.Errorf("paged order %s, want yebdacz", paged.String())
+	}
+}
+
+func TestSubSecondTimestampsRoundTrip(t *testing.T) {
+	// Written out of order, and with fractions whose text would sort
+	// wrongly without zero padding: .5 > .123456789 > .05 > .000000001
+	lines := []string{
+		"2023-08-14T10:00:00.5Z | 1 | d | {}",
+		"2023-08-14T10:00:00.000000001Z | 1 | b | {}",
+		"2023-08-14T10:00:00.123456789Z | 1 | c | {}",
+		"2023-08-14T10:00:01Z | 1 | e | {}",
+		"2023-08-14T12:00:00.05+02:00 | 1 | c0 | {}",
+		"2023-08-14T10:00:00Z | 1 | a | {}",
+	}
+	store := newTestStore(t)
+	if _, _, err := store.Record(writeTestInput(t, lines...), RecordOptions{}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	events, err := store.QueryEvents(1, QueryFilters{})
+	if err != nil {
+		t.Fatalf("QueryEvents: %v", err)
+	}
+	want := []struct {
+		eventType string
+		nanos     int
+	}{
+		{"a", 0}, {"b", 1}, {"c0", 50000000}, {"c", 123456789}, {"d", 500000000}, {"e", 0},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, event := range events {
+		if event.EventType != want[i].eventType || event.Timestamp.Nanosecond() != want[i].nanos {
+			t.Errorf("event %d: %s at %s, want %s with %d ns", i, event.EventType, event.Timestamp.Format(time.RFC3339Nano), want[i].eventType, want[i].nanos)
+		}
+	}
+
+	// Range bounds compare at full precision
+	count, err := store.Count(1, QueryFilters{From: testBase.Add(1), To: testBase.Add(123456789)})
+	if err != nil || count != 3 {
+		t.Errorf("Count in range: %d, %v; want 3", count, err)
+	}
+
+	// And the text output keeps the digits
+	var out bytes.Buffer
+	if _, err := store.Query(1, QueryFilters{EventTypes: []string{"c"}}, OutputOptions{}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "2023-08-14T10:00:00.123456789Z | 1 | c | {}\n" {
+		t.Errorf("Query wrote %q", got)
+	}
+}
+
+func TestDedupeWindowLimitAndOffset(t *testing.T) {
+	store := newTestStore(t)
+	// Ten bursts a minute apart, each the same event three times in a row
+	var events []*Event
+	for burst := 0; burst < 10; burst++ {
+		for i := 0; i < 3; i++ {
+			events = append(events, &Event{
+				Timestamp: testBase.Add(time.Duration(burst)*time.Minute + time.Duration(i)*time.Second),
+				UserID:    1,
+				EventType: "login",
+				Payload:   json.RawMessage(`{}`),
+			})
+		}
+	}
+	if _, err := store.InsertBatch(events); err != nil {
+		t.Fatalf("InsertBatch: %v", err)
+	}
+
+	for _, order := range []string{OrderAsc, OrderDesc} {
+		all, err := store.QueryEvents(1, QueryFilters{Order: order, DedupeWindow: 10 * time.Second})
+		if err != nil || len(all) != 10 {
+			t.Fatalf("order %s: QueryEvents: %d events, want 10: %v", order, len(all), err)
+		}
+
+		var paged []*Event
+		for offset := 0; offset < 10; offset += 4 {
+			page, err := store.QueryEvents(1, QueryFilters{Order: order, DedupeWindow: 10 * time.Second, Limit: 4, Offset: offset})
+			if err != nil {
+				t.Fatalf("order %s: QueryEvents: %v", order, err)
+			}
+			if want := min(4, 10-offset); len(page) != want {
+				t.Errorf("order %s, offset %d: %d events, want %d", order, offset, len(page), want)
+			}
+			paged = append(paged, page...)
+		}
+		if len(paged) != len(all) {
+			t.Fatalf("order %s: paged %d events, want %d", order, len(paged), len(all))
+		}
+		for i := range all {
+			if paged[i].ID != all[i].ID {
+				t.Errorf("order %s: paged event %d has ID %d, want %d", order, i, paged[i].ID, all[i].ID)
+			}
+		}
+	}
+}
+
+func TestRawPayloadStartingWithFormatByte(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	config := DefaultStoreConfig()
+	config.CompressPayload = true
+	compressed, err := NewEventStoreWithConfig(path, config)
+	if err != nil {
+		t.Fatalf("NewEventStoreWithConfig: %v", err)
+	}
+	insertTestEvents(t, compressed, 1, 1, testBase)
+	compressed.Close()
+
+	// Raw text that happens to start with payloadFormatDeflate is not a
+	// compressed payload
+	store, err := NewEventStore(path)
+	if err != nil {
+		t.Fatalf("NewEventStore: %v", err)
+	}
+	defer store.Close()
+	input := writeTestInput(t, "2023-08-14T10:05:00Z | 1 | note | \x01abc")
+	if recorded, _, err := store.Record(input, RecordOptions{NoJSONValidate: true}); err != nil || recorded != 1 {
+		t.Fatalf("Record: recorded %d events: %v", recorded, err)
+	}
+
+	events, err := store.QueryEvents(1, QueryFilters{})
+	if err != nil || len(events) != 2 {
+		t.Fatalf("QueryEvents: %d events, %v", len(events), err)
+	}
+	if string(events[0].Payload) != `{"n":0}` {
+		t.Errorf("compressed payload read back as %q", events[0].Payload)
+	}
+	if string(events[1].Payload) != "\x01abc" {
+		t.Errorf("raw payload read back as %q, want %q", events[1].Payload, "\x01abc")
+	}
+}
+
+func TestInsertNormalizesTypesOnNormalizedStore(t *testing.T) {
+	store := newTestStore(t)
+	input := writeTestInput(t, "2023-08-14T10:00:00Z | 1 | LOGOUT | {}")
+	if _, _, err := store.Record(input, RecordOptions{NormalizeType: true}); err != nil || !store.TypesNormalized() {
+		t.Fatalf("Record with NormalizeType: normalized %v, %v", store.TypesNormalized(), err)
+	}
+
+	if err := store.Insert(&Event{Timestamp: testBase.Add(time.Minute), UserID: 1, EventType: "Login"}); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if _, err := store.InsertBatch([]*Event{{Timestamp: testBase.Add(2 * time.Minute), UserID: 1, EventType: " Purchase "}}); err != nil {
+		t.Fatalf("InsertBatch: %v", err)
+	}
+
+	for _, eventType := range []string{"login", "Purchase", "logout"} {
+		events, err := store.QueryEvents(1, QueryFilters{EventTypes: []string{eventType}})
+		if err != nil || len(events) != 1 {
+			t.Fatalf("type %s: QueryEvents: %d events, %v", eventType, len(events), err)
+		}
+		if want := normalizeEventType(eventType); events[0].EventType != want {
+			t.Errorf("type %s: stored as %q, want %q", eventType, events[0].EventType, want)
+		}
+	}
+}
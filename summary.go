@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// The summary table holds per-user, per-type event counts so that stats and
+// aggregates need not scan the events. It is opt-in: RebuildSummary creates
+// it along with triggers that keep it current on every insert, delete and
+// update, whatever the code path, at some cost to write speed.
+var summarySchema = []string{
+	`CREATE TABLE IF NOT EXISTS user_event_counts (
+		user_id INTEGER NOT NULL,
+		event_type TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (user_id, event_type)
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS summary_insert AFTER INSERT ON events BEGIN
+		INSERT INTO user_event_counts (user_id, event_type, count) VALUES (NEW.user_id, NEW.event_type, 1)
+		ON CONFLICT (user_id, event_type) DO UPDATE SET count = count + 1;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS summary_delete AFTER DELETE ON events BEGIN
+		UPDATE user_event_counts SET count = count - 1 WHERE user_id = OLD.user_id AND event_type = OLD.event_type;
+		DELETE FROM user_event_counts WHERE user_id = OLD.user_id AND event_type = OLD.event_type AND count <= 0;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS summary_update AFTER UPDATE OF user_id, event_type ON events BEGIN
+		UPDATE user_event_counts SET count = count - 1 WHERE user_id = OLD.user_id AND event_type = OLD.event_type;
+		DELETE FROM user_event_counts WHERE user_id = OLD.user_id AND event_type = OLD.event_type AND count <= 0;
+		INSERT INTO user_event_counts (user_id, event_type, count) VALUES (NEW.user_id, NEW.event_type, 1)
+		ON CONFLICT (user_id, event_type) DO UPDATE SET count = count + 1;
+	END`,
+}
+
+// dropSummarySQL removes the summary table and its triggers
+var dropSummarySQL = []string{
+	"DROP TRIGGER IF EXISTS summary_insert",
+	"DROP TRIGGER IF EXISTS summary_delete",
+	"DROP TRIGGER IF EXISTS summary_update",
+	"DROP TABLE IF EXISTS user_event_counts",
+}
+
+// RebuildSummary creates the summary table if needed and recomputes it from
+// the events in one transaction, returning the number of user and type
+// pairs. From then on it is maintained as events change.
+func (es *EventStore) RebuildSummary() (int64, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.writable("rebuild summary"); err != nil {
+		return 0, err
+	}
+
+	tx, err := es.beginWrite(context.Background())
+	if err != nil {
+		return 0, &StoreError{Op: "begin transaction", Err: err}
+	}
+	defer tx.Rollback()
+
+	for _, statement := range summarySchema {
+		if _, err := tx.Exec(statement); err != nil {
+			return 0, fmt.Errorf("failed to create summary table: %v", err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM user_event_counts"); err != nil {
+		return 0, fmt.Errorf("failed to clear summary table: %v", err)
+	}
+	result, err := tx.Exec(`INSERT INTO user_event_counts (user_id, event_type, count)
+		SELECT user_id, event_type, COUNT(*) FROM events GROUP BY user_id, event_type`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fill summary table: %v", err)
+	}
+	pairs, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read affected rows: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit summary: %v", err)
+	}
+	return pairs, nil
+}
+
+// DropSummary removes the summary table and stops maintaining it
+func (es *EventStore) DropSummary() error {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.writable("drop summary"); err != nil {
+		return err
+	}
+
+	tx, err := es.beginWrite(context.Background())
+	if err != nil {
+		return &StoreError{Op: "begin transaction", Err: err}
+	}
+	defer tx.Rollback()
+
+	for _, statement := range dropSummarySQL {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to drop summary table: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %v", err)
+	}
+	return nil
+}
+
+// requireSummary fails with a hint to run rebuild-summary unless the summary
+// table exists
+func (es *EventStore) requireSummary() error {
+	var count int
+	err := es.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'user_event_counts'").Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to inspect tables: %v", err)
+	}
+	if count == 0 {
+		return fmt.Errorf("no summary table; run rebuild-summary first")
+	}
+	return nil
+}
+
+// SummaryStats returns the same statistics as GetStats, read from the
+// summary table. The time range comes from one index lookup per event type.
+func (es *EventStore) SummaryStats() (map[string]interface{}, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.requireSummary(); err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]interface{})
+
+	var totalEvents sql.NullInt64
+	var uniqueUsers int
+	err := es.db.QueryRow("SELECT SUM(count), COUNT(DISTINCT user_id) FROM user_event_counts").Scan(&totalEvents, &uniqueUsers)
+	if err != nil {
+		return nil, fmt.Errorf("summary query failed: %v", err)
+	}
+	stats["total_events"] = int(totalEvents.Int64)
+	stats["unique_users"] = uniqueUsers
+
+	rows, err := es.db.Query("SELECT event_type, SUM(count), COUNT(*) FROM user_event_counts GROUP BY event_type")
+	if err != nil {
+		return nil, fmt.Errorf("summary query failed: %v", err)
+	}
+	defer rows.Close()
+
+	byType := make(map[string]TypeStats)
+	for rows.Next() {
+		var eventType string
+		var typeStats TypeStats
+		if err := rows.Scan(&eventType, &typeStats.Events, &typeStats.UniqueUsers); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		byType[eventType] = typeStats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	stats["by_type"] = byType
+
+	// MIN and MAX per type are seeks on idx_type_timestamp, unlike a MIN
+	// over the whole table
+	var from, to string
+	for eventType := range byType {
+		var typeFrom, typeTo string
+		err := es.db.QueryRow(`SELECT
+			(SELECT MIN(timestamp) FROM events WHERE event_type = ?1),
+			(SELECT MAX(timestamp) FROM events WHERE event_type = ?1)`, eventType).Scan(&typeFrom, &typeTo)
+		if err != nil {
+			return nil, fmt.Errorf("time range query failed: %v", err)
+		}
+		if from == "" || typeFrom < from {
+			from = typeFrom
+		}
+		if typeTo > to {
+			to = typeTo
+		}
+	}
+	stats["time_range"] = map[string]string{"from": displayTime(from), "to": displayTime(to)}
+
+	return stats, nil
+}
+
+// SummaryAggregate counts a user's events per event type from the summary
+// table. Unlike Aggregate it takes no filters.
+func (es *EventStore) SummaryAggregate(userID int64) (map[string]int, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	if err := es.requireSummary(); err != nil {
+		return nil, err
+	}
+
+	rows, err := es.db.Query("SELECT event_type, count FROM user_event_counts WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("summary query failed: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var eventType string
+		var count int
+		if err := rows.Scan(&eventType, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		counts[eventType] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return counts, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ValidationReport lists the lines of an input file that Record would skip
+type ValidationReport struct {
+	Lines   int               `json:"lines"` // non-empty lines
+	Valid   int               `json:"valid"`
+	Invalid int               `json:"invalid"`
+	Errors  []ValidationError `json:"errors"`
+}
+
+// ValidationError is one line Record would skip, and why
+type ValidationError struct {
+	Position string `json:"position"` // "line N", or "record N (line M)" for CSV
+	Reason   string `json:"reason"`
+}
+
+// ValidateFile checks every line of a file the way Record with the same
+// options would, through the same sources and parser, without opening a
+// database
+func ValidateFile(filename string, opts RecordOptions) (*ValidationReport, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	file, err := openInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pipeline := newParsePipeline(newRecordSource(file, opts), opts.parseLine(), opts.workers(), false)
+	defer pipeline.Stop()
+
+	report := &ValidationReport{Errors: []ValidationError{}}
+	for chunk := range pipeline.ordered {
+		<-chunk.results
+
+		for _, line := range chunk.lines {
+			report.Lines++
+			if line.err == nil {
+				line.err = opts.checkEvent(line.event)
+			}
+			if line.err == nil {
+				report.Valid++
+				continue
+			}
+
+			position := line.position
+			if position == "" {
+				position = fmt.Sprintf("line %d", line.lineNum)
+			}
+			report.Invalid++
+			report.Errors = append(report.Errors, ValidationError{Position: position, Reason: line.err.Error()})
+		}
+	}
+
+	if err := pipeline.Err(); err != nil {
+		return report, fmt.Errorf("error reading file: %v", err)
+	}
+	return report, nil
+}